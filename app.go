@@ -168,10 +168,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	startBlockPageServer()
 
 	URL := fmt.Sprintf("http://%s", address)
 	log.Println("Go to " + URL)
-	log.Fatal(http.ListenAndServe(address, nil))
+	log.Fatal(http.ListenAndServe(address, blockPageOrHandler(http.DefaultServeMux)))
 }
 
 func getInput() (string, error) {
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// Returns the full path of the blocked services catalog file, empty if the built-in one is used
+func getBlockedServicesCatalogPath() string {
+	path := config.CoreDNS.ServicesCatalog
+	if len(path) != 0 && !filepath.IsAbs(path) {
+		path = filepath.Join(config.ourBinaryDir, path)
+	}
+	return path
+}
+
+// Returns the list of services that can be blocked
+func getBlockedServicesCatalog() ([]dnsfilter.BlockedService, error) {
+	path := getBlockedServicesCatalogPath()
+	if len(path) == 0 {
+		return dnsfilter.DefaultBlockedServices(), nil
+	}
+	return dnsfilter.LoadBlockedServices(path)
+}
+
+// Creates a helper object for working with the rules of the blocked services
+// fails if the catalog can't be loaded, the services can't be blocked without their rules
+func getBlockedServicesFilter() (filter, error) {
+	var contents []byte
+	if len(config.BlockedServices) != 0 {
+		services, err := getBlockedServicesCatalog()
+		if err != nil {
+			return filter{}, fmt.Errorf("couldn't load blocked services catalog: %s", err)
+		}
+
+		enabled := map[string]bool{}
+		for _, id := range config.BlockedServices {
+			enabled[id] = true
+		}
+		for i := range services {
+			if !enabled[services[i].ID] {
+				continue
+			}
+			for _, rule := range services[i].FilterRules() {
+				contents = append(contents, []byte(rule)...)
+				contents = append(contents, '\n')
+			}
+		}
+	}
+
+	return filter{
+		// Blocked services filter always has constant ID=-1
+		ID:       BlockedServicesFilterId,
+		contents: contents,
+		Enabled:  true,
+	}, nil
+}
+
+// ----------------
+// blocked services
+// ----------------
+
+type blockedServiceJSON struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Rules   []string `json:"rules"`
+	Enabled bool     `json:"enabled"`
+}
+
+//noinspection GoUnusedParameter
+func handleBlockedServicesList(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	services, err := getBlockedServicesCatalog()
+	if err != nil {
+		config.RUnlock()
+		httpError(w, http.StatusInternalServerError, "Couldn't load blocked services catalog: %s", err)
+		return
+	}
+	enabled := map[string]bool{}
+	for _, id := range config.BlockedServices {
+		enabled[id] = true
+	}
+	config.RUnlock()
+
+	data := []blockedServiceJSON{}
+	for _, service := range services {
+		data = append(data, blockedServiceJSON{
+			ID:      service.ID,
+			Name:    service.Name,
+			Rules:   service.Rules,
+			Enabled: enabled[service.ID],
+		})
+	}
+
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal blocked services json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+}
+
+// handleBlockedServicesSet replaces the list of blocked services with the IDs from the request
+func handleBlockedServicesSet(w http.ResponseWriter, r *http.Request) {
+	ids := []string{}
+	err := json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	config.Lock()
+	services, err := getBlockedServicesCatalog()
+	if err != nil {
+		config.Unlock()
+		httpError(w, http.StatusInternalServerError, "Couldn't load blocked services catalog: %s", err)
+		return
+	}
+	known := map[string]bool{}
+	for _, service := range services {
+		known[service.ID] = true
+	}
+	blocked := []string{}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !known[id] {
+			config.Unlock()
+			httpError(w, http.StatusBadRequest, "Unknown service %s", id)
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			blocked = append(blocked, id)
+		}
+	}
+	config.BlockedServices = blocked
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
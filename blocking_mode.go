@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	corednsplugin "github.com/whitehat/whitehat/coredns_plugin"
+)
+
+// checkBlockingModes validates the global blocking mode and its overrides
+func checkBlockingModes(c *coreDNSConfig) error {
+	err := corednsplugin.CheckBlockingMode(c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6)
+	if err != nil {
+		return err
+	}
+	for reason, m := range c.BlockingModes {
+		if !corednsplugin.IsBlockingModeReason(reason) {
+			return fmt.Errorf("blocking mode can't be set for %q", reason)
+		}
+		if len(m.Mode) != 0 {
+			err = corednsplugin.CheckBlockingMode(m.Mode, m.IPv4, m.IPv6)
+			if err != nil {
+				return fmt.Errorf("%s: %s", reason, err)
+			}
+		}
+		if m.BlockedResponseTTL != nil && *m.BlockedResponseTTL < 0 {
+			return fmt.Errorf("%s: blocked response TTL can't be negative", reason)
+		}
+	}
+	return nil
+}
+
+// --------------
+// blocking modes
+// --------------
+
+type blockingModeJSON struct {
+	Mode               string        `json:"blocking_mode"`
+	IPv4               string        `json:"blocking_ipv4"`
+	IPv6               string        `json:"blocking_ipv6"`
+	BlockedResponseTTL int           `json:"blocked_response_ttl"`
+	Reasons            blockingModes `json:"reasons"`
+}
+
+// handleBlockingMode shows the blocking modes on GET and replaces them on POST
+func handleBlockingMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleBlockingModeGet(w, r)
+	case "POST":
+		handleBlockingModeSet(w, r)
+	default:
+		http.Error(w, "This request must be GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+//noinspection GoUnusedParameter
+func handleBlockingModeGet(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	data := blockingModeJSON{
+		Mode:               config.CoreDNS.BlockingMode,
+		IPv4:               config.CoreDNS.BlockingIPv4,
+		IPv6:               config.CoreDNS.BlockingIPv6,
+		BlockedResponseTTL: config.CoreDNS.BlockedResponseTTL,
+		Reasons:            config.CoreDNS.BlockingModes,
+	}
+	jsonVal, err := json.Marshal(data)
+	config.RUnlock()
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal blocking mode json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+}
+
+// handleBlockingModeSet replaces the global blocking mode and all the overrides with the ones from the request
+func handleBlockingModeSet(w http.ResponseWriter, r *http.Request) {
+	req := blockingModeJSON{BlockedResponseTTL: -1}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	config.Lock()
+	c := config.CoreDNS
+	c.BlockingMode, c.BlockingIPv4, c.BlockingIPv6 = req.Mode, req.IPv4, req.IPv6
+	c.BlockingModes = req.Reasons
+	if req.BlockedResponseTTL >= 0 {
+		c.BlockedResponseTTL = req.BlockedResponseTTL
+	}
+	err = checkBlockingModes(&c)
+	if err != nil {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "Invalid blocking mode: %s", err)
+		return
+	}
+	config.CoreDNS = c
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	corednsplugin "github.com/whitehat/whitehat/coredns_plugin"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// the path the unblock request form is posted to, it's on the blocked host so it must not clash with the usual paths
+const unblockRequestPath = "/whitehat-unblock-request"
+
+// blockPageConfig describes the page that is shown instead of the blocked sites
+// only plain HTTP can be served, browsers show a certificate error for HTTPS sites
+type blockPageConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	BindHost        string `yaml:"bind_host"`        // a separate listener, the page is served by the admin HTTP server if empty
+	BindPort        int    `yaml:"bind_port"`        // port of the separate listener
+	IPv4            string `yaml:"ipv4"`             // blocked requests are answered with it, the bind host is used if empty
+	IPv6            string `yaml:"ipv6"`             // blocked AAAA requests are answered with it, they get no records if empty
+	UnblockRequests bool   `yaml:"unblock_requests"` // show the button that asks the admin to unblock the host, needs the separate listener
+}
+
+// checkBlockPageConfig validates the addresses of the block page
+func checkBlockPageConfig(c *blockPageConfig) error {
+	if len(c.IPv4) != 0 {
+		ip := net.ParseIP(c.IPv4)
+		if ip == nil || ip.To4() == nil || ip.IsUnspecified() {
+			return fmt.Errorf("%s is not a valid IPv4 address of the block page", c.IPv4)
+		}
+	}
+	if len(c.IPv6) != 0 {
+		ip := net.ParseIP(c.IPv6)
+		if ip == nil || ip.To4() != nil || ip.IsUnspecified() {
+			return fmt.Errorf("%s is not a valid IPv6 address of the block page", c.IPv6)
+		}
+	}
+	if len(c.BindHost) != 0 && (c.BindPort <= 0 || c.BindPort > 65535) {
+		return fmt.Errorf("block page port %d is invalid", c.BindPort)
+	}
+	// the admin HTTP server serves the block page before the authentication, it mustn't accept the requests there
+	if c.Enabled && c.UnblockRequests && len(c.BindHost) == 0 {
+		return fmt.Errorf("unblock requests need the separate listener of the block page, set block_page.bind_host")
+	}
+	return nil
+}
+
+// Returns the addresses blocked requests are pointed to, empty if the block page is disabled, config must be read-locked
+func getBlockPageAddresses() []string {
+	c := config.BlockPage
+	if !c.Enabled {
+		return nil
+	}
+
+	addresses := []string{}
+	ipv4 := c.IPv4
+	if len(ipv4) == 0 {
+		// the page is on the address we listen to, unless we listen to all of them
+		bindHost := c.BindHost
+		if len(bindHost) == 0 {
+			bindHost = config.BindHost
+		}
+		ip := net.ParseIP(bindHost)
+		if ip != nil && ip.To4() != nil && !ip.IsUnspecified() {
+			ipv4 = ip.String()
+		}
+	}
+	if len(ipv4) != 0 {
+		addresses = append(addresses, ipv4)
+	}
+	if len(c.IPv6) != 0 {
+		addresses = append(addresses, c.IPv6)
+	}
+	if len(addresses) == 0 {
+		log.Printf("Block page is enabled, but its address is unknown, set block_page.ipv4 in the config")
+	}
+	return addresses
+}
+
+// startBlockPageServer starts the separate listener of the block page if it's configured
+func startBlockPageServer() {
+	config.RLock()
+	c := config.BlockPage
+	config.RUnlock()
+	if !c.Enabled || len(c.BindHost) == 0 {
+		return
+	}
+
+	address := net.JoinHostPort(c.BindHost, strconv.Itoa(c.BindPort))
+	log.Printf("Serving the block page on %s", address)
+	go func() {
+		log.Fatal(http.ListenAndServe(address, http.HandlerFunc(handleBlockPage)))
+	}()
+}
+
+// blockPageOrHandler serves the block page for the requests that came to the admin HTTP server because
+// their host is blocked, all the other requests are passed to the handler
+// the host comes from the client, so anyone can get the page without the authentication,
+// it only explains why the host is blocked, unblock requests are accepted by the separate listener only
+func blockPageOrHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config.RLock()
+		onAdminServer := config.BlockPage.Enabled && len(config.BlockPage.BindHost) == 0
+		config.RUnlock()
+		if onAdminServer && isBlockedHostRequest(r) {
+			handleBlockPage(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isBlockedHostRequest checks if the request is for a host name that is blocked for the client,
+// the admin interface is opened by IP address or by a host name that isn't blocked
+// every request to the admin interface is checked, so it stops at the first match
+// and only the rules and the cached lookups are used, the explanation is for rendering the page
+func isBlockedHostRequest(r *http.Request) bool {
+	host := requestHost(r)
+	if len(host) == 0 || host == "localhost" || net.ParseIP(host) != nil {
+		return false
+	}
+	ctx := dnsfilter.WithCachedLookupsOnly(r.Context())
+	result, err := corednsplugin.CheckHost(ctx, host, dns.TypeA, requestClientIP(r))
+	if err != nil {
+		return false
+	}
+	return result.IsFiltered
+}
+
+// explainBlockedHost explains the filtering of the host the request was sent to without the network lookups,
+// the browser got here because of the DNS response that has just been filtered, so its lookups are cached
+// the requests from anyone on the network mustn't make us query safebrowsing and parental for arbitrary hosts
+func explainBlockedHost(r *http.Request, host string) (dnsfilter.Explanation, string, error) {
+	ctx := dnsfilter.WithCachedLookupsOnly(r.Context())
+	return corednsplugin.ExplainHost(ctx, host, dns.TypeA, requestClientIP(r))
+}
+
+// returns the host name the request was sent to, without the port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func requestClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// ----------
+// block page
+// ----------
+
+type blockPageData struct {
+	Host            string
+	Blocked         bool
+	Why             string
+	Rule            string
+	FilterName      string
+	Client          string
+	UnblockRequests bool
+	Requested       bool
+	UnblockPath     string
+}
+
+// Returns the text explaining the reason to the user, config must be read-locked
+func describeBlockReason(res dnsfilter.Result) string {
+	switch res.Reason {
+	case dnsfilter.FilteredBlackList:
+		return "It matches a filtering rule."
+	case dnsfilter.FilteredSafeBrowsing:
+		return "It is known to distribute malware or to be used for phishing."
+	case dnsfilter.FilteredParental:
+		return "It is not suitable for children."
+	case dnsfilter.FilteredBlockedService:
+		name := res.ServiceID
+		services, err := getBlockedServicesCatalog()
+		if err == nil {
+			for _, service := range services {
+				if service.ID == res.ServiceID {
+					name = service.Name
+					break
+				}
+			}
+		}
+		return fmt.Sprintf("%s is blocked on this network.", name)
+	case dnsfilter.FilteredBlockedIP:
+		return "It points to a blocked network."
+	case dnsfilter.FilteredInvalid:
+		return "Its name is invalid."
+	default:
+		return res.Reason.String()
+	}
+}
+
+// handleBlockPage explains why the host the request was sent to is blocked
+func handleBlockPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == unblockRequestPath {
+		handleUnblockRequestSubmit(w, r)
+		return
+	}
+
+	host := requestHost(r)
+	client := requestClientIP(r)
+	explanation, profile, err := explainBlockedHost(r, host)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, "Couldn't check %s: %s", host, err)
+		return
+	}
+
+	config.RLock()
+	data := blockPageData{
+		Host:            host,
+		Blocked:         explanation.Result.IsFiltered,
+		Client:          client,
+		UnblockRequests: unblockRequestsEnabled(),
+		Requested:       r.URL.Query().Get("requested") == "1",
+		UnblockPath:     unblockRequestPath,
+	}
+	if data.Blocked {
+		data.Why = describeBlockReason(explanation.Result)
+		data.Rule = explanation.Result.Rule
+		if len(explanation.Result.Rule) != 0 {
+			data.FilterName = getFilterName(explanation.Result.FilterID)
+		}
+	}
+	config.RUnlock()
+	if len(profile) != 0 {
+		data.Client = fmt.Sprintf("%s (%s)", client, profile)
+	}
+
+	var body bytes.Buffer
+	err = blockPageTemplate.Execute(&body, data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't generate the block page: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if data.Blocked {
+		w.WriteHeader(http.StatusForbidden)
+	}
+	_, err = w.Write(body.Bytes())
+	if err != nil {
+		log.Printf("Couldn't write the block page: %s", err)
+	}
+}
+
+var blockPageTemplate = template.Must(template.New("blockpage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{if .Blocked}}Blocked{{else}}Not blocked{{end}}: {{.Host}}</title>
+<style>
+body { font-family: sans-serif; background: #f5f5f5; color: #333; margin: 0; }
+.page { max-width: 600px; margin: 10% auto; padding: 24px 32px; background: #fff; border-radius: 4px; box-shadow: 0 1px 4px rgba(0, 0, 0, .2); }
+h1 { font-size: 24px; word-break: break-all; }
+dt { font-weight: bold; margin-top: 8px; }
+dd { margin: 0; word-break: break-all; }
+code { background: #f0f0f0; padding: 2px 4px; }
+textarea { width: 100%; box-sizing: border-box; }
+button { margin-top: 8px; padding: 8px 16px; }
+</style>
+</head>
+<body>
+<div class="page">
+{{if .Blocked}}
+<h1>{{.Host}} is blocked</h1>
+<p>WhiteHat Security Home blocked access to this site. {{.Why}}</p>
+<dl>
+{{if .Rule}}<dt>Rule</dt><dd><code>{{.Rule}}</code></dd>{{end}}
+{{if .FilterName}}<dt>Filter</dt><dd>{{.FilterName}}</dd>{{end}}
+<dt>Your device</dt><dd>{{.Client}}</dd>
+</dl>
+{{if .Requested}}
+<p>The request to unblock this site was sent to the administrator.</p>
+{{else if .UnblockRequests}}
+<form method="post" action="{{.UnblockPath}}">
+<p>If you think this site is blocked by mistake, you can ask the administrator to unblock it.</p>
+<textarea name="comment" rows="3" maxlength="500" placeholder="Why do you need this site? (optional)"></textarea>
+<button type="submit">Request unblock</button>
+</form>
+{{end}}
+{{else}}
+<h1>{{.Host}} is not blocked</h1>
+<p>This site isn't blocked anymore, it will open when your device forgets the old DNS answer. Try again in a few minutes.</p>
+{{end}}
+</div>
+</body>
+</html>
+`))
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+	corednsplugin "github.com/whitehat/whitehat/coredns_plugin"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// Returns the name of the filter with the specified ID, config must be read-locked
+func getFilterName(id int64) string {
+	if id == UserFilterId {
+		return "Custom filtering rules"
+	}
+	if id == BlockedServicesFilterId {
+		return "Blocked services"
+	}
+	if id == ClientRulesFilterId {
+		return "Client rules"
+	}
+	filter := findFilterByID(id)
+	if filter == nil {
+		return ""
+	}
+	return filter.Name
+}
+
+// Converts the result to JSON-friendly map, config must be read-locked
+func checkHostResultToJSON(res dnsfilter.Result) map[string]interface{} {
+	data := map[string]interface{}{
+		"reason":      res.Reason.String(),
+		"is_filtered": res.IsFiltered,
+	}
+	if len(res.Rule) > 0 {
+		data["rule"] = res.Rule
+		data["filter_id"] = res.FilterID
+		data["filter_name"] = getFilterName(res.FilterID)
+	}
+	if res.Ip != nil {
+		data["ip"] = res.Ip.String()
+	}
+	if len(res.ServiceID) > 0 {
+		data["service_id"] = res.ServiceID
+	}
+	return data
+}
+
+// -------------------
+// filtering explained
+// -------------------
+
+// handleCheckHost shows every rule matching the host and what each of the checks would do with it
+func handleCheckHost(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	host := strings.TrimSpace(q.Get("name"))
+	if len(host) == 0 {
+		httpError(w, http.StatusBadRequest, "name parameter is required")
+		return
+	}
+
+	qtype := dns.TypeA
+	if qtypeStr := strings.TrimSpace(q.Get("qtype")); len(qtypeStr) != 0 {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(qtypeStr)]
+		if !ok {
+			httpError(w, http.StatusBadRequest, "unknown qtype %s", qtypeStr)
+			return
+		}
+	}
+	clientID := strings.TrimSpace(q.Get("client"))
+
+	explanation, profile, err := corednsplugin.ExplainHost(r.Context(), host, qtype, clientID)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't check %s: %s", host, err)
+		return
+	}
+
+	config.RLock()
+	rules := []map[string]interface{}{}
+	for _, rule := range explanation.Rules {
+		data := checkHostResultToJSON(rule.Result)
+		data["table"] = rule.Table
+		data["winner"] = rule.Rule == explanation.RulesResult.Rule && rule.FilterID == explanation.RulesResult.FilterID
+		rules = append(rules, data)
+	}
+	data := map[string]interface{}{
+		"name":    strings.ToLower(host),
+		"qtype":   dns.TypeToString[qtype],
+		"client":  clientID,
+		"profile": profile,
+		"result":  checkHostResultToJSON(explanation.Result),
+		"why":     explanation.Why,
+		"note":    explanation.Note,
+		"rules":   rules,
+		"safebrowsing": map[string]interface{}{
+			"enabled": explanation.SafeBrowsingEnabled,
+			"result":  checkHostResultToJSON(explanation.SafeBrowsing),
+			"error":   explanation.SafeBrowsingError,
+		},
+		"parental": map[string]interface{}{
+			"enabled": explanation.ParentalEnabled,
+			"result":  checkHostResultToJSON(explanation.Parental),
+			"error":   explanation.ParentalError,
+		},
+		"safesearch": map[string]interface{}{
+			"enabled": explanation.SafeSearchEnabled,
+			"host":    explanation.SafeSearchHost,
+			"engine":  explanation.SafeSearchEngine,
+		},
+	}
+	config.RUnlock()
+
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal check_host json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+		return
+	}
+}
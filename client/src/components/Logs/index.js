@@ -115,7 +115,10 @@ class Logs extends Component {
                 const responses = row.value;
                 const { reason } = row.original;
                 const isFiltered = row ? reason.indexOf('Filtered') === 0 : false;
-                const parsedFilteredReason = reason.replace('Filtered', 'Filtered by ');
+                const { serviceName } = row.original;
+                const parsedFilteredReason = reason === 'FilteredBlockedService'
+                    ? `Blocked service: ${serviceName}`
+                    : reason.replace('Filtered', 'Filtered by ');
                 const rule = row && row.original && row.original.rule;
                 const { filterId } = row.original;
                 const { filters } = this.props.filtering;
@@ -124,6 +127,8 @@ class Logs extends Component {
                 if (reason === 'FilteredBlackList' || reason === 'NotFilteredWhiteList') {
                     if (filterId === 0) {
                         filterName = 'Custom filtering rules';
+                    } else if (filterId === -2) {
+                        filterName = 'Client rules';
                     } else {
                         const filterItem = Object.keys(filters)
                             .filter(key => filters[key].id === filterId);
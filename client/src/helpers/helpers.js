@@ -20,6 +20,7 @@ export const normalizeLogs = logs => logs.map((log) => {
         client,
         filterId,
         rule,
+        serviceName,
     } = log;
     const { host: domain, type } = question;
     const responsesArray = response ? response.map((response) => {
@@ -35,6 +36,7 @@ export const normalizeLogs = logs => logs.map((log) => {
         client,
         filterId,
         rule,
+        serviceName,
     };
 });
 
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/asaskevich/govalidator.v4"
+)
+
+// clientProfile is a filtering profile applied to requests coming from the specified IP addresses, networks or host names
+type clientProfile struct {
+	Name                string   `json:"name" yaml:"name"`
+	IDs                 []string `json:"ids" yaml:"ids"`               // IP addresses, CIDR networks or host names from the hosts file
+	FilterIDs           []int64  `json:"filter_ids" yaml:"filter_ids"` // enabled filters, UserFilterId stands for the user rules and BlockedServicesFilterId for the blocked services
+	SafeBrowsingEnabled bool     `json:"safebrowsing_enabled" yaml:"safebrowsing_enabled"`
+	SafeSearchEnabled   bool     `json:"safesearch_enabled" yaml:"safesearch_enabled"`
+	ParentalEnabled     bool     `json:"parental_enabled" yaml:"parental_enabled"`
+	ParentalSensitivity int      `json:"parental_sensitivity" yaml:"parental_sensitivity"`
+	Rules               []string `json:"rules" yaml:"rules"` // rules applied to this profile only, e.g. the exceptions of the approved unblock requests
+}
+
+// Returns the filter with the specified ID or nil if there's none
+func findFilterByID(id int64) *filter {
+	for i := range config.Filters {
+		if config.Filters[i].ID == id {
+			return &config.Filters[i]
+		}
+	}
+	return nil
+}
+
+// Returns the index of the client with the specified name or -1 if there's none
+func findClientIndex(name string) int {
+	for i := range config.Clients {
+		if config.Clients[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Checks if the filter is referenced by any client profile
+func isFilterUsedByClients(id int64) bool {
+	for i := range config.Clients {
+		for _, filterID := range config.Clients[i].FilterIDs {
+			if filterID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Removes the deleted filter from the client profiles, otherwise they can't be updated anymore
+// config must be locked
+func removeFilterFromClients(id int64) {
+	for i := range config.Clients {
+		c := &config.Clients[i]
+		filterIDs := c.FilterIDs[:0]
+		for _, filterID := range c.FilterIDs {
+			if filterID != id {
+				filterIDs = append(filterIDs, filterID)
+			}
+		}
+		c.FilterIDs = filterIDs
+	}
+}
+
+// Returns the path of the file with the rules of the client profile with the specified index
+func getClientRulesFilePath(index int) string {
+	return filepath.Join(config.ourBinaryDir, config.ourDataDir, FiltersDir, fmt.Sprintf("client-%d.txt", index))
+}
+
+// Saves the rules of every client profile to its file, the files are named by the profile indexes
+// so they're all rewritten along with the DNS config
+func saveClientRules() error {
+	for i := range config.Clients {
+		var contents []byte
+		for _, rule := range config.Clients[i].Rules {
+			contents = append(contents, []byte(rule)...)
+			contents = append(contents, '\n')
+		}
+		err := writeFileSafe(getClientRulesFilePath(i), contents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Loads the contents of the client filters that might have been skipped because they're disabled globally
+func loadClientFilters(c *clientProfile) {
+	config.Lock()
+	for _, id := range c.FilterIDs {
+		filter := findFilterByID(id)
+		if filter == nil || len(filter.contents) > 0 {
+			continue
+		}
+		err := filter.load()
+		if err != nil {
+			log.Printf("Couldn't load filter %d contents due to %s", filter.ID, err)
+		}
+	}
+	config.Unlock()
+
+	// download the filters that haven't been saved to disk yet
+	checkFiltersUpdates(false)
+}
+
+// Checks that the client profile is valid and doesn't clash with other profiles
+// skipIndex is the index of the profile being updated, -1 if it's a new one
+func (c *clientProfile) validate(skipIndex int) error {
+	if len(c.Name) == 0 {
+		return fmt.Errorf("client name must not be empty")
+	}
+	if strings.ContainsAny(c.Name, "\"\n{}") {
+		return fmt.Errorf("client name contains invalid characters")
+	}
+	if len(c.IDs) == 0 {
+		return fmt.Errorf("client %s has no IP addresses, networks or host names", c.Name)
+	}
+
+	for _, id := range c.IDs {
+		if net.ParseIP(id) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(id); err == nil {
+			continue
+		}
+		if !govalidator.IsDNSName(id) {
+			return fmt.Errorf("%s is neither an IP address, a CIDR nor a host name", id)
+		}
+	}
+
+	for _, id := range c.FilterIDs {
+		if id != UserFilterId && id != BlockedServicesFilterId && findFilterByID(id) == nil {
+			return fmt.Errorf("filter %d doesn't exist", id)
+		}
+	}
+
+	if c.ParentalEnabled {
+		switch c.ParentalSensitivity {
+		case 3, 10, 13, 17:
+		default:
+			return fmt.Errorf("parental sensitivity must be either 3, 10, 13 or 17")
+		}
+	}
+
+	for i := range config.Clients {
+		if i == skipIndex {
+			continue
+		}
+		other := &config.Clients[i]
+		if other.Name == c.Name {
+			return fmt.Errorf("client %s already exists", c.Name)
+		}
+		for _, id := range c.IDs {
+			for _, otherID := range other.IDs {
+				if id == otherID {
+					return fmt.Errorf("%s is already used by client %s", id, other.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// -------
+// clients
+// -------
+
+// noinspection GoUnusedParameter
+func handleClientsList(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	clients := config.Clients
+	if clients == nil {
+		clients = []clientProfile{}
+	}
+	jsonVal, err := json.Marshal(clients)
+	config.RUnlock()
+
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal clients json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+}
+
+func handleClientsAdd(w http.ResponseWriter, r *http.Request) {
+	c := clientProfile{}
+	err := json.NewDecoder(r.Body).Decode(&c)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	config.Lock()
+	err = c.validate(-1)
+	if err != nil {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "Invalid client: %s", err)
+		return
+	}
+	config.Clients = append(config.Clients, c)
+	config.Unlock()
+
+	loadClientFilters(&c)
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleClientsUpdate(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string        `json:"name"`
+		Data clientProfile `json:"data"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	config.Lock()
+	index := findClientIndex(req.Name)
+	if index < 0 {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "Client %s doesn't exist", req.Name)
+		return
+	}
+	err = req.Data.validate(index)
+	if err != nil {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "Invalid client: %s", err)
+		return
+	}
+	config.Clients[index] = req.Data
+	config.Unlock()
+
+	loadClientFilters(&req.Data)
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+func handleClientsDelete(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	config.Lock()
+	index := findClientIndex(req.Name)
+	if index < 0 {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "Client %s doesn't exist", req.Name)
+		return
+	}
+	config.Clients = append(config.Clients[:index], config.Clients[index+1:]...)
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClientProfileValidate(t *testing.T) {
+	config.Filters = []filter{{ID: 1}}
+	config.Clients = nil
+	defer func() {
+		config.Filters = nil
+		config.Clients = nil
+	}()
+
+	tests := []struct {
+		ids   []string
+		valid bool
+	}{
+		{[]string{"192.168.1.10"}, true},
+		{[]string{"192.168.1.0/24"}, true},
+		{[]string{"kids-tablet.lan"}, true},
+		{[]string{"192.168.1.0/33"}, false},
+		{[]string{"kids tablet"}, false},
+	}
+	for _, tc := range tests {
+		c := clientProfile{Name: "client", IDs: tc.ids, FilterIDs: []int64{1}}
+		err := c.validate(-1)
+		if (err == nil) != tc.valid {
+			t.Errorf("validate(%v) returned %v", tc.ids, err)
+		}
+	}
+}
+
+func TestRemoveFilterFromClients(t *testing.T) {
+	config.Filters = []filter{{ID: 1}}
+	config.Clients = []clientProfile{
+		{Name: "kids", IDs: []string{"192.168.1.10"}, FilterIDs: []int64{UserFilterId, 1, 2}},
+	}
+	defer func() {
+		config.Filters = nil
+		config.Clients = nil
+	}()
+
+	removeFilterFromClients(2)
+	if !reflect.DeepEqual(config.Clients[0].FilterIDs, []int64{UserFilterId, 1}) {
+		t.Fatalf("filter wasn't removed from the client: %v", config.Clients[0].FilterIDs)
+	}
+	err := config.Clients[0].validate(0)
+	if err != nil {
+		t.Fatalf("client can't be updated after the filter is removed: %s", err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
@@ -21,9 +22,23 @@ const SchemaVersion = 1
 // Directory where we'll store all downloaded filters contents
 const FiltersDir = "filters"
 
+// File in the data directory where safebrowsing and parental caches are saved
+const lookupCacheFileName = "lookup_cache.json"
+
+// File in the data directory where the stats are saved
+const statsFileName = "stats.json"
+
+const queryLogDirName = "querylog" // in the data directory
+
 // User filter ID is always 0
 const UserFilterId = 0
 
+// Blocked services filter ID is always -1
+const BlockedServicesFilterId = -1
+
+// The rules of a client profile have ID -2, each profile has its own file
+const ClientRulesFilterId = -2
+
 // Just a counter that we use for incrementing the filter ID
 var NextFilterId = time.Now().Unix()
 
@@ -37,14 +52,17 @@ type configuration struct {
 	ourDataDir string
 
 	// Schema version of the config file. This value is used when performing the app updates.
-	SchemaVersion int           `yaml:"schema_version"`
-	BindHost      string        `yaml:"bind_host"`
-	BindPort      int           `yaml:"bind_port"`
-	AuthName      string        `yaml:"auth_name"`
-	AuthPass      string        `yaml:"auth_pass"`
-	CoreDNS       coreDNSConfig `yaml:"coredns"`
-	Filters       []filter      `yaml:"filters"`
-	UserRules     []string      `yaml:"user_rules"`
+	SchemaVersion   int             `yaml:"schema_version"`
+	BindHost        string          `yaml:"bind_host"`
+	BindPort        int             `yaml:"bind_port"`
+	AuthName        string          `yaml:"auth_name"`
+	AuthPass        string          `yaml:"auth_pass"`
+	CoreDNS         coreDNSConfig   `yaml:"coredns"`
+	Filters         []filter        `yaml:"filters"`
+	UserRules       []string        `yaml:"user_rules"`
+	BlockedServices []string        `yaml:"blocked_services"` // IDs of the services from the blocked services catalog
+	BlockPage       blockPageConfig `yaml:"block_page"`
+	Clients         []clientProfile `yaml:"clients"`
 
 	sync.RWMutex `yaml:"-"`
 }
@@ -54,10 +72,21 @@ type coreDnsFilter struct {
 	Path string `yaml:"-"`
 }
 
+type coreDnsClient struct {
+	Name                string
+	IDs                 []string
+	Filters             []coreDnsFilter
+	SafeBrowsingEnabled bool
+	SafeSearchEnabled   bool
+	ParentalEnabled     bool
+	ParentalSensitivity int
+}
+
 type coreDNSConfig struct {
 	binaryFile          string
 	coreFile            string
 	Filters             []coreDnsFilter `yaml:"-"`
+	Clients             []coreDnsClient `yaml:"-"`
 	Port                int             `yaml:"port"`
 	ProtectionEnabled   bool            `yaml:"protection_enabled"`
 	FilteringEnabled    bool            `yaml:"filtering_enabled"`
@@ -67,6 +96,34 @@ type coreDNSConfig struct {
 	ParentalSensitivity int             `yaml:"parental_sensitivity"`
 	BlockedResponseTTL  int             `yaml:"blocked_response_ttl"`
 	QueryLogEnabled     bool            `yaml:"querylog_enabled"`
+	QueryLogRetention   int             `yaml:"querylog_retention_days"` // 0 means the entries are kept until the size limit is reached
+	QueryLogMaxSize     int             `yaml:"querylog_max_size_mb"`    // 0 means no limit
+	QueryLogCompress    bool            `yaml:"querylog_compress"`       // compress the query log files with gzip
+	StatsRetention      int             `yaml:"stats_retention_days"`    // how long the stats are kept, per hour for the last 30 days at most and per day after that
+	QueryLogDir         string          `yaml:"-"`
+	CheckResponseIPs    bool            `yaml:"check_response_ips"`        // match A/AAAA records of responses against the rules too
+	SafeBrowsingDBFile  string          `yaml:"safebrowsing_db_file"`      // local safebrowsing database, relative to the directory of our binary
+	ParentalDBFile      string          `yaml:"parental_db_file"`          // local parental database, relative to the directory of our binary
+	LookupDBRefresh     int             `yaml:"lookup_db_refresh_minutes"` // how often the local databases are checked for updates
+	LookupTimeout       int             `yaml:"lookup_timeout_ms"`         // safebrowsing and parental lookups fail open after it, 0 means no limit
+	LookupCacheSize     int             `yaml:"lookup_cache_size"`         // number of entries in each of safebrowsing and parental caches
+	LookupCacheTTL      int             `yaml:"lookup_cache_ttl"`          // in seconds
+	LookupCacheFile     string          `yaml:"-"`
+	StatsFile           string          `yaml:"-"`
+	SafeSearchCatalog   string          `yaml:"safesearch_catalog_file"`       // list of search engines, relative to the directory of our binary, built-in if empty
+	SafeSearchEngines   map[string]bool `yaml:"safesearch_engines"`            // engines enabled or disabled by the user, others use the catalog default
+	ServicesCatalog     string          `yaml:"blocked_services_catalog_file"` // list of services, relative to the directory of our binary, built-in if empty
+	QueryLogAnonymize   string          `yaml:"querylog_anonymize_client_ip"`  // none, truncate (to /24 and /48) or hash
+	QueryLogHashKey     string          `yaml:"querylog_anonymize_key"`        // the key of the hash mode, generated if empty
+	QueryLogIgnored     []string        `yaml:"querylog_ignored_clients"`      // IP addresses, networks or client names whose requests aren't logged
+	MetricsClientLabel  bool            `yaml:"metrics_client_label"`          // label the Prometheus responses with the client address, one series per client
+	BlockingMode        string          `yaml:"blocking_mode"`                 // default, nxdomain, null_ip, refused or custom_ip
+	BlockingIPv4        string          `yaml:"blocking_ipv4"`                 // custom_ip only
+	BlockingIPv6        string          `yaml:"blocking_ipv6"`                 // custom_ip only
+	BlockingModes       blockingModes   `yaml:"blocking_modes"`                // overrides for blacklist, safebrowsing, parental, blocked_service and blocked_ip
+	SafeBrowsingHost    string          `yaml:"safebrowsing_block_host"`       // CNAME target of the requests blocked by safebrowsing, the plugin default if empty
+	ParentalHost        string          `yaml:"parental_block_host"`           // CNAME target of the requests blocked by parental control, the plugin default if empty
+	BlockPage           []string        `yaml:"-"`                             // addresses of the block page server
 	Pprof               string          `yaml:"-"`
 	Cache               string          `yaml:"-"`
 	Prometheus          string          `yaml:"-"`
@@ -75,6 +132,17 @@ type coreDNSConfig struct {
 	Bind                string          `yaml:"bind"`
 }
 
+// blockingModes are the blocking mode overrides keyed by reason
+type blockingModes map[string]blockingModeConfig
+
+// blockingModeConfig overrides the blocking mode and TTL of the blocked responses for a reason
+type blockingModeConfig struct {
+	Mode               string `yaml:"mode,omitempty" json:"mode,omitempty"` // the global mode is used if empty
+	IPv4               string `yaml:"blocking_ipv4,omitempty" json:"blocking_ipv4,omitempty"`
+	IPv6               string `yaml:"blocking_ipv6,omitempty" json:"blocking_ipv6,omitempty"`
+	BlockedResponseTTL *int   `yaml:"blocked_response_ttl,omitempty" json:"blocked_response_ttl,omitempty"` // the global TTL is used if not set
+}
+
 type filter struct {
 	ID          int64  `json:"id" yaml:"id"` // auto-assigned when filter is added (see NextFilterId)
 	URL         string `json:"url"`
@@ -101,13 +169,25 @@ var config = configuration{
 		FilteringEnabled:    true,
 		SafeBrowsingEnabled: true,
 		BlockedResponseTTL:  10, // in seconds
+		BlockingMode:        "default",
+		LookupDBRefresh:     60,   // in minutes
+		LookupTimeout:       1000, // in milliseconds
+		LookupCacheSize:     64 * 1024,
+		LookupCacheTTL:      30 * 60, // in seconds
 		QueryLogEnabled:     true,
+		QueryLogRetention:   7,   // in days
+		QueryLogMaxSize:     100, // in megabytes
+		StatsRetention:      90,  // in days
+		QueryLogAnonymize:   "none",
 		BootstrapDNS:        "8.8.8.8:53",
 		UpstreamDNS:         defaultDNS,
 		Cache:               "cache",
 		Prometheus:          "prometheus :9153",
 		Bind:                "185.220.184.184",
 	},
+	BlockPage: blockPageConfig{
+		BindPort: 80,
+	},
 	Filters: []filter{
 		{ID: 1, Enabled: true, URL: "https://whitehat.ro/~zmeu/whs/filter.txt", Name: "WhiteHat Simplified Domain Names filter"},
 	},
@@ -152,6 +232,31 @@ func parseConfig() error {
 		log.Printf("Couldn't parse config file: %s", err)
 		return err
 	}
+	err = checkBlockingModes(&config.CoreDNS)
+	if err != nil {
+		log.Printf("Invalid blocking mode in config file: %s", err)
+		return err
+	}
+	err = checkBlockPageConfig(&config.BlockPage)
+	if err != nil {
+		log.Printf("Invalid block page settings in config file: %s", err)
+		return err
+	}
+	if config.CoreDNS.QueryLogRetention < 0 || config.CoreDNS.QueryLogMaxSize < 0 {
+		err = fmt.Errorf("querylog_retention_days and querylog_max_size_mb can't be negative")
+		log.Printf("Invalid query log settings in config file: %s", err)
+		return err
+	}
+	if config.CoreDNS.StatsRetention <= 0 {
+		err = fmt.Errorf("stats_retention_days must be positive")
+		log.Printf("Invalid stats settings in config file: %s", err)
+		return err
+	}
+	err = checkQueryLogAnonymization(&config.CoreDNS)
+	if err != nil {
+		log.Printf("Invalid query log settings in config file: %s", err)
+		return err
+	}
 
 	// Deduplicate filters
 	{
@@ -201,6 +306,25 @@ func writeConfig() error {
 		return err
 	}
 
+	// the YAML and the user filter are saved already, so the unrelated settings aren't lost if the catalog is broken
+	// the previous rules of the blocked services are kept then
+	blockedServicesFilter, err := getBlockedServicesFilter()
+	if err != nil {
+		log.Printf("Couldn't save the blocked services filter: %s", err)
+		return err
+	}
+	err = blockedServicesFilter.save()
+	if err != nil {
+		log.Printf("Couldn't save the blocked services filter: %s", err)
+		return err
+	}
+
+	err = saveClientRules()
+	if err != nil {
+		log.Printf("Couldn't save the rules of the clients: %s", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -243,12 +367,49 @@ const coreDNSConfigTemplate = `:{{.Port}} {
         {{if .ParentalEnabled}}parental {{.ParentalSensitivity}}{{end}}
         {{if .SafeSearchEnabled}}safesearch{{end}}
         {{if .QueryLogEnabled}}querylog{{end}}
+        querylog_dir "{{.QueryLogDir}}"
+        querylog_retention {{.QueryLogRetention}} {{.QueryLogMaxSize}}
+        {{if .QueryLogCompress}}querylog_compress{{end}}
+        querylog_anonymize_client_ip {{.QueryLogAnonymize}}{{if eq .QueryLogAnonymize "hash"}} "{{.QueryLogHashKey}}"{{end}}
+        {{if .QueryLogIgnored}}querylog_ignore{{range .QueryLogIgnored}} "{{.}}"{{end}}{{end}}
+        {{if .MetricsClientLabel}}metrics_client_label{{end}}
+        {{if .CheckResponseIPs}}check_response_ips{{end}}
+        {{if .SafeBrowsingDBFile}}safebrowsing_db "{{.SafeBrowsingDBFile}}"{{end}}
+        {{if .ParentalDBFile}}parental_db "{{.ParentalDBFile}}"{{end}}
+        {{if or .SafeBrowsingDBFile .ParentalDBFile}}lookup_db_refresh {{.LookupDBRefresh}}{{end}}
+        {{if .SafeBrowsingHost}}safebrowsing_block_host {{.SafeBrowsingHost}}{{end}}
+        {{if .ParentalHost}}parental_block_host {{.ParentalHost}}{{end}}
+        {{if .BlockPage}}block_page{{range .BlockPage}} {{.}}{{end}}{{end}}
         blocked_ttl {{.BlockedResponseTTL}}
+        blocking_mode {{.BlockingMode}}{{if eq .BlockingMode "custom_ip"}} {{.BlockingIPv4}} {{.BlockingIPv6}}{{end}}
+        {{range $reason, $mode := .BlockingModes}}
+        {{if $mode.Mode}}blocking_mode_for {{$reason}} {{$mode.Mode}}{{if eq $mode.Mode "custom_ip"}} {{$mode.IPv4}} {{$mode.IPv6}}{{end}}{{end}}
+        {{with $mode.BlockedResponseTTL}}blocked_ttl_for {{$reason}} {{.}}{{end}}
+        {{end}}
+        lookup_timeout {{.LookupTimeout}}
+        lookup_cache {{.LookupCacheSize}} {{.LookupCacheTTL}}
+        lookup_cache_file "{{.LookupCacheFile}}"
+        stats_file "{{.StatsFile}}"
+        stats_retention {{.StatsRetention}}
+        {{if .SafeSearchCatalog}}safesearch_catalog "{{.SafeSearchCatalog}}"{{end}}
+        {{if .ServicesCatalog}}blocked_services_catalog "{{.ServicesCatalog}}"{{end}}
+        {{range $engine, $enabled := .SafeSearchEngines}}
+        safesearch_engine {{$engine}} {{$enabled}}
+        {{end}}
 		{{if .FilteringEnabled}}
 		{{range .Filters}}
 		filter {{.ID}} "{{.Path}}"
 		{{end}}
 		{{end}}
+		{{range .Clients}}
+		client "{{.Name}}"{{range .IDs}} {{.}}{{end}}
+		{{if .SafeBrowsingEnabled}}client_safebrowsing "{{.Name}}"{{end}}
+		{{if .ParentalEnabled}}client_parental "{{.Name}}" {{.ParentalSensitivity}}{{end}}
+		{{if .SafeSearchEnabled}}client_safesearch "{{.Name}}"{{end}}
+		{{$name := .Name}}{{range .Filters}}
+		client_filter "{{$name}}" {{.ID}} "{{.Path}}"
+		{{end}}
+		{{end}}
     }{{end}}
     {{.Pprof}}
     hosts {
@@ -284,6 +445,16 @@ func generateCoreDNSConfigText() (string, error) {
 		filters = append(filters, coreDnsFilter{ID: userFilter.ID, Path: userFilter.getFilterFilePath()})
 	}
 
+	// the rules of the blocked services go next
+	blockedServicesFilter, err := getBlockedServicesFilter()
+	if err != nil {
+		log.Printf("Couldn't generate DNS config: %s", err)
+		return "", err
+	}
+	if len(blockedServicesFilter.contents) > 0 {
+		filters = append(filters, coreDnsFilter{ID: blockedServicesFilter.ID, Path: blockedServicesFilter.getFilterFilePath()})
+	}
+
 	// then go through other filters
 	for i := range config.Filters {
 		filter := &config.Filters[i]
@@ -294,6 +465,62 @@ func generateCoreDNSConfigText() (string, error) {
 	}
 	temporaryConfig.Filters = filters
 
+	// client profiles have their own sets of filters and settings
+	clients := make([]coreDnsClient, 0)
+	for i := range config.Clients {
+		c := &config.Clients[i]
+		clientFilters := make([]coreDnsFilter, 0)
+		if config.CoreDNS.FilteringEnabled {
+			// the own rules of the profile, e.g. the exceptions of the approved unblock requests
+			if len(c.Rules) != 0 {
+				clientFilters = append(clientFilters, coreDnsFilter{ID: ClientRulesFilterId, Path: getClientRulesFilePath(i)})
+			}
+			for _, id := range c.FilterIDs {
+				if id == UserFilterId {
+					if len(userFilter.contents) > 0 {
+						clientFilters = append(clientFilters, coreDnsFilter{ID: userFilter.ID, Path: userFilter.getFilterFilePath()})
+					}
+					continue
+				}
+				if id == BlockedServicesFilterId {
+					if len(blockedServicesFilter.contents) > 0 {
+						clientFilters = append(clientFilters, coreDnsFilter{ID: blockedServicesFilter.ID, Path: blockedServicesFilter.getFilterFilePath()})
+					}
+					continue
+				}
+				filter := findFilterByID(id)
+				if filter != nil && len(filter.contents) > 0 {
+					clientFilters = append(clientFilters, coreDnsFilter{ID: filter.ID, Path: filter.getFilterFilePath()})
+				}
+			}
+		}
+		clients = append(clients, coreDnsClient{
+			Name:                c.Name,
+			IDs:                 c.IDs,
+			Filters:             clientFilters,
+			SafeBrowsingEnabled: c.SafeBrowsingEnabled,
+			SafeSearchEnabled:   c.SafeSearchEnabled,
+			ParentalEnabled:     c.ParentalEnabled,
+			ParentalSensitivity: c.ParentalSensitivity,
+		})
+	}
+	temporaryConfig.Clients = clients
+
+	temporaryConfig.LookupCacheFile = filepath.Join(config.ourBinaryDir, config.ourDataDir, lookupCacheFileName)
+	temporaryConfig.StatsFile = filepath.Join(config.ourBinaryDir, config.ourDataDir, statsFileName)
+	temporaryConfig.QueryLogDir = filepath.Join(config.ourBinaryDir, config.ourDataDir, queryLogDirName)
+
+	// local databases can be specified relative to the directory of our binary
+	if len(temporaryConfig.SafeBrowsingDBFile) != 0 && !filepath.IsAbs(temporaryConfig.SafeBrowsingDBFile) {
+		temporaryConfig.SafeBrowsingDBFile = filepath.Join(config.ourBinaryDir, temporaryConfig.SafeBrowsingDBFile)
+	}
+	if len(temporaryConfig.ParentalDBFile) != 0 && !filepath.IsAbs(temporaryConfig.ParentalDBFile) {
+		temporaryConfig.ParentalDBFile = filepath.Join(config.ourBinaryDir, temporaryConfig.ParentalDBFile)
+	}
+	temporaryConfig.SafeSearchCatalog = getSafeSearchCatalogPath()
+	temporaryConfig.ServicesCatalog = getBlockedServicesCatalogPath()
+	temporaryConfig.BlockPage = getBlockPageAddresses()
+
 	// run the template
 	err = t.Execute(&configBytes, &temporaryConfig)
 	if err != nil {
@@ -37,29 +37,16 @@ var client = &http.Client{
 // -------------------
 // coredns run control
 // -------------------
-func tellCoreDNSToReload() {
-	corednsplugin.Reload <- true
-}
-
-func writeAllConfigsAndReloadCoreDNS() error {
-	err := writeAllConfigs()
-	if err != nil {
-		log.Printf("Couldn't write all configs: %s", err)
-		return err
-	}
-	tellCoreDNSToReload()
-	return nil
-}
-
+//noinspection GoUnusedParameter
 func httpUpdateConfigReloadDNSReturnOK(w http.ResponseWriter, r *http.Request) {
-	err := writeAllConfigsAndReloadCoreDNS()
+	err := writeAllConfigs()
 	if err != nil {
 		errorText := fmt.Sprintf("Couldn't write config file: %s", err)
 		log.Println(errorText)
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
-	returnOK(w, r)
+	respondWithReload(w, "OK\n")
 }
 
 //noinspection GoUnusedParameter
@@ -154,13 +141,7 @@ func handleSetUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, errorText, http.StatusInternalServerError)
 		return
 	}
-	tellCoreDNSToReload()
-	_, err = fmt.Fprintf(w, "OK %d servers\n", len(hosts))
-	if err != nil {
-		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
-		http.Error(w, errorText, http.StatusInternalServerError)
-	}
+	respondWithReload(w, fmt.Sprintf("OK %d servers\n", len(hosts)))
 }
 
 func handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
@@ -390,14 +371,7 @@ func handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tellCoreDNSToReload()
-
-	_, err = fmt.Fprintf(w, "OK %d rules\n", filter.RulesCount)
-	if err != nil {
-		errorText := fmt.Sprintf("Couldn't write body: %s", err)
-		log.Println(errorText)
-		http.Error(w, errorText, http.StatusInternalServerError)
-	}
+	respondWithReload(w, fmt.Sprintf("OK %d rules\n", filter.RulesCount))
 }
 
 func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
@@ -422,10 +396,12 @@ func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
 
 	// go through each element and delete if url matches
 	newFilters := config.Filters[:0]
+	deletedIDs := []int64{}
 	for _, filter := range config.Filters {
 		if filter.URL != url {
 			newFilters = append(newFilters, filter)
 		} else {
+			deletedIDs = append(deletedIDs, filter.ID)
 			// Remove the filter file
 			err := os.Remove(filter.getFilterFilePath())
 			if err != nil {
@@ -437,6 +413,9 @@ func handleFilteringRemoveURL(w http.ResponseWriter, r *http.Request) {
 	}
 	// Update the configuration after removing filter files
 	config.Filters = newFilters
+	for _, id := range deletedIDs {
+		removeFilterFromClients(id)
+	}
 	httpUpdateConfigReloadDNSReturnOK(w, r)
 }
 
@@ -572,7 +551,7 @@ func checkFiltersUpdates(force bool) int {
 	config.Unlock()
 
 	if updateCount > 0 {
-		tellCoreDNSToReload()
+		requestReload()
 	}
 	return updateCount
 }
@@ -600,11 +579,16 @@ func parseFilterContents(contents []byte) (int, string) {
 	return rulesCount, name
 }
 
+// Checks if the filter is enabled globally or used by any of the client profiles
+func (filter *filter) isUsed() bool {
+	return filter.Enabled || isFilterUsedByClients(filter.ID)
+}
+
 // Checks for filters updates
 // If "force" is true -- does not check the filter's LastUpdated field
 // Call "save" to persist the filter contents
 func (filter *filter) update(force bool) (bool, error) {
-	if !filter.Enabled {
+	if !filter.isUsed() {
 		return false, nil
 	}
 	if !force && time.Since(filter.LastUpdated) <= updatePeriod {
@@ -679,7 +663,7 @@ func (filter *filter) save() error {
 // loads filter contents from the file in config.ourDataDir
 func (filter *filter) load() error {
 
-	if !filter.Enabled {
+	if !filter.isUsed() {
 		// No need to load a filter that is not enabled
 		return nil
 	}
@@ -867,14 +851,22 @@ func handleSafeSearchStatus(w http.ResponseWriter, r *http.Request) {
 
 func registerControlHandlers() {
 	http.HandleFunc("/control/status", optionalAuth(ensureGET(handleStatus)))
+	http.HandleFunc("/control/reload/status", optionalAuth(ensureGET(handleReloadStatus)))
 	http.HandleFunc("/control/enable_protection", optionalAuth(ensurePOST(handleProtectionEnable)))
 	http.HandleFunc("/control/disable_protection", optionalAuth(ensurePOST(handleProtectionDisable)))
 	http.HandleFunc("/control/querylog", optionalAuth(ensureGET(corednsplugin.HandleQueryLog)))
+	http.HandleFunc("/control/querylog/stream", optionalAuth(ensureGET(corednsplugin.HandleQueryLogStream)))
+	http.HandleFunc("/control/querylog/stream/ws", optionalAuth(ensureGET(corednsplugin.HandleQueryLogWebSocket)))
 	http.HandleFunc("/control/querylog_enable", optionalAuth(ensurePOST(handleQueryLogEnable)))
 	http.HandleFunc("/control/querylog_disable", optionalAuth(ensurePOST(handleQueryLogDisable)))
 	http.HandleFunc("/control/set_upstream_dns", optionalAuth(ensurePOST(handleSetUpstreamDNS)))
 	http.HandleFunc("/control/test_upstream_dns", optionalAuth(ensurePOST(handleTestUpstreamDNS)))
 	http.HandleFunc("/control/stats_top", optionalAuth(ensureGET(corednsplugin.HandleStatsTop)))
+	http.HandleFunc("/control/stats/trackers", optionalAuth(ensureGET(corednsplugin.HandleStatsTrackers)))
+	http.HandleFunc("/control/stats/filters", optionalAuth(ensureGET(corednsplugin.HandleStatsFilters)))
+	http.HandleFunc("/control/stats/rules", optionalAuth(ensureGET(corednsplugin.HandleStatsRules)))
+	http.HandleFunc("/control/stats/clients", optionalAuth(ensureGET(corednsplugin.HandleStatsClients)))
+	http.HandleFunc("/control/stats/client", optionalAuth(ensureGET(corednsplugin.HandleStatsClient)))
 	http.HandleFunc("/control/stats", optionalAuth(ensureGET(corednsplugin.HandleStats)))
 	http.HandleFunc("/control/stats_history", optionalAuth(ensureGET(corednsplugin.HandleStatsHistory)))
 	http.HandleFunc("/control/stats_reset", optionalAuth(ensurePOST(corednsplugin.HandleStatsReset)))
@@ -888,6 +880,7 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/filtering/refresh", optionalAuth(ensurePOST(handleFilteringRefresh)))
 	http.HandleFunc("/control/filtering/status", optionalAuth(ensureGET(handleFilteringStatus)))
 	http.HandleFunc("/control/filtering/set_rules", optionalAuth(ensurePUT(handleFilteringSetRules)))
+	http.HandleFunc("/control/filtering/check_host", optionalAuth(ensureGET(handleCheckHost)))
 	http.HandleFunc("/control/safebrowsing/enable", optionalAuth(ensurePOST(handleSafeBrowsingEnable)))
 	http.HandleFunc("/control/safebrowsing/disable", optionalAuth(ensurePOST(handleSafeBrowsingDisable)))
 	http.HandleFunc("/control/safebrowsing/status", optionalAuth(ensureGET(handleSafeBrowsingStatus)))
@@ -897,4 +890,15 @@ func registerControlHandlers() {
 	http.HandleFunc("/control/safesearch/enable", optionalAuth(ensurePOST(handleSafeSearchEnable)))
 	http.HandleFunc("/control/safesearch/disable", optionalAuth(ensurePOST(handleSafeSearchDisable)))
 	http.HandleFunc("/control/safesearch/status", optionalAuth(ensureGET(handleSafeSearchStatus)))
+	http.HandleFunc("/control/safesearch/settings", optionalAuth(handleSafeSearchSettings))
+	http.HandleFunc("/control/clients/list", optionalAuth(ensureGET(handleClientsList)))
+	http.HandleFunc("/control/clients/add", optionalAuth(ensurePUT(handleClientsAdd)))
+	http.HandleFunc("/control/clients/update", optionalAuth(ensurePOST(handleClientsUpdate)))
+	http.HandleFunc("/control/clients/delete", optionalAuth(ensureDELETE(handleClientsDelete)))
+	http.HandleFunc("/control/blocked_services/list", optionalAuth(ensureGET(handleBlockedServicesList)))
+	http.HandleFunc("/control/blocked_services/set", optionalAuth(ensurePOST(handleBlockedServicesSet)))
+	http.HandleFunc("/control/blocking_mode", optionalAuth(handleBlockingMode))
+	http.HandleFunc("/control/unblock_requests/list", optionalAuth(ensureGET(handleUnblockRequestsList)))
+	http.HandleFunc("/control/unblock_requests/approve", optionalAuth(ensurePOST(handleUnblockRequestApprove)))
+	http.HandleFunc("/control/unblock_requests/dismiss", optionalAuth(ensurePOST(handleUnblockRequestDismiss)))
 }
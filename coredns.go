@@ -123,6 +123,11 @@ func startDNSServer() error {
 		return errortext
 	}
 
+	err = rememberWorkingConfig()
+	if err != nil {
+		log.Printf("Couldn't remember the working config: %s", err)
+	}
+
 	go coremain.Run()
 	return nil
 }
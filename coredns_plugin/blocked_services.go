@@ -0,0 +1,52 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// names of the blocked services for the query log, they need to survive coredns reload
+var (
+	blockedServiceNames     = map[string]string{}
+	blockedServiceNamesLock sync.RWMutex
+)
+
+// loadBlockedServiceNames reads the names of the services from the catalog the rules were generated from
+func loadBlockedServiceNames(path string) (map[string]string, error) {
+	services := dnsfilter.DefaultBlockedServices()
+	if len(path) != 0 {
+		var err error
+		services, err = dnsfilter.LoadBlockedServices(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load blocked services catalog: %s", err)
+		}
+		log.Printf("Loaded %d blocked services from %s", len(services), path)
+	}
+
+	names := map[string]string{}
+	for _, service := range services {
+		names[service.ID] = service.Name
+	}
+	return names, nil
+}
+
+// setBlockedServiceNames replaces the names used by the query log
+func setBlockedServiceNames(names map[string]string) {
+	blockedServiceNamesLock.Lock()
+	blockedServiceNames = names
+	blockedServiceNamesLock.Unlock()
+}
+
+// getBlockedServiceName returns the name of the service with the specified ID, or the ID if it's unknown
+func getBlockedServiceName(id string) string {
+	blockedServiceNamesLock.RLock()
+	name, ok := blockedServiceNames[id]
+	blockedServiceNamesLock.RUnlock()
+	if !ok {
+		return id
+	}
+	return name
+}
@@ -0,0 +1,216 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// how blocked requests are answered
+const (
+	blockingModeDefault  = "default"   // the block page if there's one, otherwise NXDOMAIN for rules, the IP address of hosts rules, CNAME to the block host for safebrowsing and parental
+	blockingModeNXDomain = "nxdomain"  // NXDOMAIN
+	blockingModeNullIP   = "null_ip"   // 0.0.0.0 for A, :: for AAAA, no records for other types
+	blockingModeRefused  = "refused"   // REFUSED
+	blockingModeCustomIP = "custom_ip" // the specified addresses for A and AAAA, no records for other types
+)
+
+type blockingMode struct {
+	mode string
+	ipv4 net.IP // custom_ip only
+	ipv6 net.IP // custom_ip only
+}
+
+// the reasons the blocking mode can be set for, the names are used in the config
+var blockingModeReasons = map[string]dnsfilter.Reason{
+	"blacklist":       dnsfilter.FilteredBlackList,
+	"safebrowsing":    dnsfilter.FilteredSafeBrowsing,
+	"parental":        dnsfilter.FilteredParental,
+	"blocked_service": dnsfilter.FilteredBlockedService,
+	"blocked_ip":      dnsfilter.FilteredBlockedIP,
+}
+
+// parseBlockingMode parses the mode followed by the addresses for custom_ip, e.g. "custom_ip 10.0.0.1 fd00::1"
+func parseBlockingMode(args []string) (blockingMode, error) {
+	if len(args) == 0 {
+		return blockingMode{}, fmt.Errorf("blocking mode is missing")
+	}
+	m := blockingMode{mode: args[0]}
+	switch m.mode {
+	case blockingModeDefault, blockingModeNXDomain, blockingModeNullIP, blockingModeRefused:
+		if len(args) != 1 {
+			return blockingMode{}, fmt.Errorf("blocking mode %s doesn't take addresses", m.mode)
+		}
+	case blockingModeCustomIP:
+		for _, arg := range args[1:] {
+			ip := net.ParseIP(arg)
+			switch {
+			case ip == nil:
+				return blockingMode{}, fmt.Errorf("%s is not an IP address", arg)
+			case ip.To4() != nil:
+				m.ipv4 = ip.To4()
+			default:
+				m.ipv6 = ip
+			}
+		}
+		if m.ipv4 == nil && m.ipv6 == nil {
+			return blockingMode{}, fmt.Errorf("blocking mode %s needs IPv4 or IPv6 address", m.mode)
+		}
+	default:
+		return blockingMode{}, fmt.Errorf("unknown blocking mode %s", m.mode)
+	}
+	return m, nil
+}
+
+// parseBlockingModeReason returns the reason by its config name
+func parseBlockingModeReason(name string) (dnsfilter.Reason, error) {
+	reason, ok := blockingModeReasons[name]
+	if !ok {
+		return 0, fmt.Errorf("blocking mode can't be set for %s", name)
+	}
+	return reason, nil
+}
+
+// IsBlockingModeReason tells if the blocking mode can be set for the reason with the config name
+func IsBlockingModeReason(name string) bool {
+	_, ok := blockingModeReasons[name]
+	return ok
+}
+
+// CheckBlockingMode checks the mode and its addresses the way they're set in the config, the addresses are used by custom_ip only
+func CheckBlockingMode(mode, ipv4, ipv6 string) error {
+	args := []string{mode}
+	if mode == blockingModeCustomIP {
+		if len(ipv4) != 0 {
+			ip := net.ParseIP(ipv4)
+			if ip == nil || ip.To4() == nil {
+				return fmt.Errorf("%s is not an IPv4 address", ipv4)
+			}
+			args = append(args, ipv4)
+		}
+		if len(ipv6) != 0 {
+			ip := net.ParseIP(ipv6)
+			if ip == nil || ip.To4() != nil {
+				return fmt.Errorf("%s is not an IPv6 address", ipv6)
+			}
+			args = append(args, ipv6)
+		}
+	}
+	_, err := parseBlockingMode(args)
+	return err
+}
+
+// getBlockingMode returns the blocking mode for the reason, the global one if it's not set for the reason
+func (p *plug) getBlockingMode(reason dnsfilter.Reason) blockingMode {
+	if m, ok := p.settings.BlockingModes[reason]; ok {
+		return m
+	}
+	return p.settings.BlockingMode
+}
+
+// getBlockedTTL returns TTL of the blocked responses for the reason, the global one if it's not set for the reason
+func (p *plug) getBlockedTTL(reason dnsfilter.Reason) uint32 {
+	if ttl, ok := p.settings.BlockedTTLs[reason]; ok {
+		return ttl
+	}
+	return p.settings.BlockedTTL
+}
+
+// writeBlocked replies to the blocked request according to the blocking mode of its reason
+func (p *plug) writeBlocked(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, host string, question dns.Question, result dnsfilter.Result) (int, error) {
+	m := p.getBlockingMode(result.Reason)
+	ttl := p.getBlockedTTL(result.Reason)
+	switch m.mode {
+	case blockingModeNXDomain:
+		return p.writeBlockedNXDomain(ctx, w, r, question, result, ttl)
+	case blockingModeRefused:
+		return p.writeBlockedRcode(ctx, w, r, dns.RcodeRefused, ttl)
+	case blockingModeNullIP:
+		return p.writeBlockedIPs(ctx, w, r, question, net.IPv4zero, net.IPv6unspecified, ttl)
+	case blockingModeCustomIP:
+		return p.writeBlockedIPs(ctx, w, r, question, m.ipv4, m.ipv6, ttl)
+	}
+
+	if p.settings.BlockPage.mode == blockingModeCustomIP && (result.Ip == nil || result.Ip.IsUnspecified() || result.Reason == dnsfilter.FilteredSafeBrowsing || result.Reason == dnsfilter.FilteredParental) {
+		// the block page explains why the host is blocked, hosts rules with real addresses still redirect there
+		m = p.settings.BlockPage
+		return p.writeBlockedIPs(ctx, w, r, question, m.ipv4, m.ipv6, ttl)
+	}
+
+	switch {
+	case result.Reason == dnsfilter.FilteredSafeBrowsing:
+		// return cname safebrowsing
+		return p.replaceHostWithValAndReply(ctx, w, r, host, p.settings.SafeBrowsingBlockHost, question, ttl)
+	case result.Reason == dnsfilter.FilteredParental:
+		// return cname family
+		return p.replaceHostWithValAndReply(ctx, w, r, host, p.settings.ParentalBlockHost, question, ttl)
+	case result.Ip == nil:
+		return p.writeBlockedNXDomain(ctx, w, r, question, result, ttl)
+	case result.Ip.IsUnspecified():
+		// 0.0.0.0 in a hosts rule means that the host is blocked, not that it has only IPv4 address
+		return p.writeBlockedIPs(ctx, w, r, question, net.IPv4zero, net.IPv6unspecified, ttl)
+	case result.Ip.To4() != nil:
+		// this is a hosts-syntax rule
+		return p.writeBlockedIPs(ctx, w, r, question, result.Ip, nil, ttl)
+	default:
+		return p.writeBlockedIPs(ctx, w, r, question, nil, result.Ip, ttl)
+	}
+}
+
+// replies with the address matching the question type, or with no records if there's no such address
+func (p *plug) writeBlockedIPs(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, question dns.Question, ipv4, ipv6 net.IP, ttl uint32) (int, error) {
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	var records []dns.RR
+	switch {
+	case question.Qtype == dns.TypeA && ipv4 != nil:
+		records = append(records, &dns.A{Hdr: header, A: ipv4.To4()})
+	case question.Qtype == dns.TypeAAAA && ipv6 != nil:
+		records = append(records, &dns.AAAA{Hdr: header, AAAA: ipv6})
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
+	m.Answer = records
+	if len(records) == 0 {
+		m.Ns = p.genSOA(r, ttl)
+	}
+	return p.writeBlockedMsg(ctx, w, r, m)
+}
+
+// replies with NXDOMAIN, or with no records if the result applies to some query types only
+// NXDOMAIN would make resolvers drop all the types of the name, not just the blocked ones
+func (p *plug) writeBlockedNXDomain(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, question dns.Question, result dnsfilter.Result, ttl uint32) (int, error) {
+	if result.IsDNSTypeSpecific() {
+		return p.writeBlockedIPs(ctx, w, r, question, nil, nil, ttl)
+	}
+	return p.writeBlockedRcode(ctx, w, r, dns.RcodeNameError, ttl)
+}
+
+// replies with the specified rcode, NXDOMAIN has SOA to make clients cache it
+func (p *plug) writeBlockedRcode(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, rcode int, ttl uint32) (int, error) {
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
+	if rcode == dns.RcodeNameError {
+		m.Ns = p.genSOA(r, ttl)
+	}
+	return p.writeBlockedMsg(ctx, w, r, m)
+}
+
+func (p *plug) writeBlockedMsg(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r, Context: ctx}
+	state.SizeAndDo(m)
+	err := state.W.WriteMsg(m)
+	if err != nil {
+		log.Printf("Got error %s\n", err)
+		return dns.RcodeServerFailure, fmt.Errorf("plugin/dnsfilter: %s", err)
+	}
+	// the response is already written, ServeDNS doesn't let the server write an error response instead
+	return m.Rcode, nil
+}
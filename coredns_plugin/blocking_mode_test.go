@@ -0,0 +1,87 @@
+package dnsfilter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// blockTestHost blocks the host with the rules and returns the response to the question
+func blockTestHost(t *testing.T, p *plug, host string, qtype uint16, rules ...string) *dns.Msg {
+	d := dnsfilter.New()
+	for _, text := range rules {
+		err := d.AddRule(text, 1)
+		if err != nil {
+			t.Fatalf("couldn't add rule %s: %s", text, err)
+		}
+	}
+	result, err := d.CheckRequest(context.Background(), host, qtype, dnsfilter.ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.IsFiltered {
+		t.Fatalf("%s isn't blocked by %v", host, rules)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(host), qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err = p.writeBlocked(context.Background(), rec, r, host, r.Question[0], result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Msg
+}
+
+func TestWriteBlockedDNSType(t *testing.T) {
+	p := &plug{settings: defaultPluginSettings}
+
+	m := blockTestHost(t, p, "example.org", dns.TypeAAAA, "||example.org^")
+	if m.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for the rule without $dnstype, got %s", dns.RcodeToString[m.Rcode])
+	}
+
+	// NXDOMAIN would block A requests of the name too
+	m = blockTestHost(t, p, "example.org", dns.TypeAAAA, "||example.org^$dnstype=AAAA")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Errorf("expected NODATA for the rule with $dnstype, got %s", m)
+	}
+
+	p.settings.BlockingMode = blockingMode{mode: blockingModeNXDomain}
+	m = blockTestHost(t, p, "example.org", dns.TypeAAAA, "||example.org^$dnstype=AAAA")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("expected NODATA in nxdomain mode for the rule with $dnstype, got %s", m)
+	}
+}
+
+func TestWriteBlockedTTL(t *testing.T) {
+	p := &plug{settings: defaultPluginSettings}
+	p.settings.SafeBrowsingBlockHost = "10.0.0.1"
+	p.settings.BlockedTTLs = map[dnsfilter.Reason]uint32{dnsfilter.FilteredSafeBrowsing: 60}
+
+	tests := []struct {
+		reason dnsfilter.Reason
+		ttl    uint32
+	}{
+		{dnsfilter.FilteredSafeBrowsing, 60},
+		{dnsfilter.FilteredBlackList, defaultPluginSettings.BlockedTTL},
+	}
+	for _, tc := range tests {
+		result := dnsfilter.Result{IsFiltered: true, Reason: tc.reason, Ip: net.ParseIP("10.0.0.1")}
+		r := new(dns.Msg)
+		r.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		_, err := p.writeBlocked(context.Background(), rec, r, "example.org", r.Question[0], result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Ttl != tc.ttl {
+			t.Errorf("%s: expected an answer with TTL %d, got %s", tc.reason, tc.ttl, rec.Msg)
+		}
+	}
+}
@@ -50,8 +50,46 @@ type plugSettings struct {
 	SafeBrowsingBlockHost string
 	ParentalBlockHost     string
 	QueryLogEnabled       bool
-	BlockedTTL            uint32 // in seconds, default 3600
+	QueryLogDir           string        // directory with the query log segments
+	QueryLogRetention     time.Duration // segments older than it are removed, 0 means no limit
+	QueryLogMaxSize       int64         // in bytes, oldest segments are removed when the log is bigger, 0 means no limit
+	QueryLogCompress      bool          // new segments are compressed with gzip
+	QueryLogAnonymize     string        // none, truncate or hash
+	QueryLogAnonymizeKey  []byte        // the key of the hash mode
+	QueryLogIgnored       clientList    // clients whose requests aren't logged
+	MetricsClientLabel    bool          // responses_total is labelled with the client address, it adds a series per client
+	BlockedTTL            uint32        // in seconds, default 3600
+	CheckResponseIPs      bool          // match A and AAAA records of the upstream response against the rules, not only CNAME
+	SafeBrowsingDB        string        // local safebrowsing database file, HTTP lookups are used if empty
+	ParentalDB            string        // local parental database file, HTTP lookups are used if empty
+	LookupDBRefresh       time.Duration // how often the local databases are checked for updates
+	LookupTimeout         time.Duration // safebrowsing and parental lookups are given up after it, 0 means no limit
+	LookupCacheSize       int           // number of entries in each of safebrowsing and parental caches
+	LookupCacheTTL        time.Duration // how long safebrowsing and parental results are cached
+	LookupCacheFile       string        // where the caches are saved to survive restarts, empty if they aren't saved
+	StatsFile             string        // where the stats are saved to survive restarts, empty if they aren't saved
+	StatsRetention        int           // in days
+	SafeSearchCatalog     string        // file with the list of search engines, the built-in one is used if empty
+	SafeSearchEngines     map[string]bool
+	BlockedServices       string // file with the list of blocked services, the built-in one is used if empty
 	Filters               []plugFilter
+
+	BlockingMode  blockingMode                      // how blocked requests are answered
+	BlockingModes map[dnsfilter.Reason]blockingMode // overrides BlockingMode for the reasons
+	BlockedTTLs   map[dnsfilter.Reason]uint32       // overrides BlockedTTL for the reasons
+	BlockPage     blockingMode                      // addresses of the block page server, empty if there's no block page
+}
+
+// plugClient is a filtering profile that is used instead of the default one
+// for requests coming from the specified IP addresses, networks or host names
+type plugClient struct {
+	Name    string
+	IPs     []net.IP
+	Nets    []*net.IPNet
+	Hosts   []string // host names, their addresses from the hosts file are added to IPs when the plugin starts
+	Filters []plugFilter
+
+	d *dnsfilter.Dnsfilter
 }
 
 type plug struct {
@@ -59,6 +97,13 @@ type plug struct {
 	Next     plugin.Handler
 	upstream upstream.Upstream
 	settings plugSettings
+	clients  []*plugClient
+
+	// local databases shared by the default and the client filters
+	safeBrowsingDB *dnsfilter.HashDB
+	parentalDB     *dnsfilter.HashDB
+
+	blockedServiceNames map[string]string // names of the services in the catalog, they're used when the instance starts
 
 	sync.RWMutex
 }
@@ -67,6 +112,15 @@ var defaultPluginSettings = plugSettings{
 	SafeBrowsingBlockHost: "bl.whitehat.ro",
 	ParentalBlockHost:     "blf.whitehat.ro",
 	BlockedTTL:            3600, // in seconds
+	QueryLogDir:           "querylog",
+	QueryLogRetention:     7 * 24 * time.Hour,
+	QueryLogAnonymize:     anonymizeNone,
+	BlockingMode:          blockingMode{mode: blockingModeDefault},
+	LookupDBRefresh:       time.Hour,
+	LookupTimeout:         time.Second,
+	LookupCacheSize:       64 * 1024,
+	LookupCacheTTL:        30 * time.Minute,
+	StatsRetention:        defaultStatsRetention,
 	Filters:               make([]plugFilter, 0),
 }
 
@@ -118,6 +172,27 @@ func setupPlugin(c *caddy.Controller) (*plug, error) {
 					}
 					p.settings.ParentalBlockHost = c.Val()
 				}
+			case "safebrowsing_block_host":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.SafeBrowsingBlockHost = c.Val()
+			case "parental_block_host":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.ParentalBlockHost = c.Val()
+			case "block_page":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				blockPage, err := parseBlockingMode(append([]string{blockingModeCustomIP}, args...))
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				log.Printf("Blocked requests are answered with the block page addresses %v", args)
+				p.settings.BlockPage = blockPage
 			case "blocked_ttl":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -128,9 +203,179 @@ func setupPlugin(c *caddy.Controller) (*plug, error) {
 				}
 				log.Printf("Blocked request TTL is %d", blockedTtl)
 				p.settings.BlockedTTL = uint32(blockedTtl)
+			case "blocked_ttl_for":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				reason, err := parseBlockingModeReason(args[0])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				blockedTtl, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+				if p.settings.BlockedTTLs == nil {
+					p.settings.BlockedTTLs = map[dnsfilter.Reason]uint32{}
+				}
+				p.settings.BlockedTTLs[reason] = uint32(blockedTtl)
+			case "blocking_mode":
+				mode, err := parseBlockingMode(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				log.Printf("Blocking mode is %s", mode.mode)
+				p.settings.BlockingMode = mode
+			case "blocking_mode_for":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				reason, err := parseBlockingModeReason(args[0])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				mode, err := parseBlockingMode(args[1:])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				if p.settings.BlockingModes == nil {
+					p.settings.BlockingModes = map[dnsfilter.Reason]blockingMode{}
+				}
+				p.settings.BlockingModes[reason] = mode
 			case "querylog":
 				log.Println("Query log is enabled")
 				p.settings.QueryLogEnabled = true
+			case "querylog_dir":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.QueryLogDir = c.Val()
+			case "querylog_retention":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				days, err := strconv.Atoi(args[0])
+				if err != nil || days < 0 {
+					return nil, c.ArgErr()
+				}
+				sizeMB, err := strconv.ParseInt(args[1], 10, 64)
+				if err != nil || sizeMB < 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.QueryLogRetention = time.Duration(days) * 24 * time.Hour
+				p.settings.QueryLogMaxSize = sizeMB * 1024 * 1024
+			case "querylog_compress":
+				p.settings.QueryLogCompress = true
+			case "querylog_anonymize_client_ip":
+				mode, key, err := parseAnonymizeMode(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				log.Printf("Query log client addresses anonymization: %s", mode)
+				p.settings.QueryLogAnonymize = mode
+				p.settings.QueryLogAnonymizeKey = key
+			case "querylog_ignore":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, id := range args {
+					p.settings.QueryLogIgnored.add(id)
+				}
+			case "metrics_client_label":
+				p.settings.MetricsClientLabel = true
+			case "safebrowsing_db":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.SafeBrowsingDB = c.Val()
+			case "parental_db":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.ParentalDB = c.Val()
+			case "lookup_db_refresh":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				minutes, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+				p.settings.LookupDBRefresh = time.Duration(minutes) * time.Minute
+			case "lookup_timeout":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				timeout, err := strconv.ParseUint(c.Val(), 10, 32)
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+				log.Printf("Safebrowsing and parental lookup timeout is %d ms", timeout)
+				p.settings.LookupTimeout = time.Duration(timeout) * time.Millisecond
+			case "lookup_cache":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				size, err := strconv.ParseUint(args[0], 10, 31)
+				if err != nil || size == 0 {
+					return nil, c.ArgErr()
+				}
+				ttl, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil || ttl == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.LookupCacheSize = int(size)
+				p.settings.LookupCacheTTL = time.Duration(ttl) * time.Second
+			case "lookup_cache_file":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.LookupCacheFile = c.Val()
+			case "stats_file":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.StatsFile = c.Val()
+			case "stats_retention":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				days, err := strconv.Atoi(c.Val())
+				if err != nil || days <= 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.StatsRetention = days
+			case "safesearch_catalog":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.SafeSearchCatalog = c.Val()
+			case "safesearch_engine":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				enabled, err := strconv.ParseBool(args[1])
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+				if p.settings.SafeSearchEngines == nil {
+					p.settings.SafeSearchEngines = map[string]bool{}
+				}
+				p.settings.SafeSearchEngines[args[0]] = enabled
+			case "blocked_services_catalog":
+				if !c.NextArg() || len(c.Val()) == 0 {
+					return nil, c.ArgErr()
+				}
+				p.settings.BlockedServices = c.Val()
+			case "check_response_ips":
+				log.Println("Checking IP addresses in responses is enabled")
+				p.settings.CheckResponseIPs = true
 			case "filter":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -150,56 +395,123 @@ func setupPlugin(c *caddy.Controller) (*plug, error) {
 					ID:   filterId,
 					Path: filterPath,
 				})
+			case "client":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args[0]) == 0 {
+					return nil, c.ArgErr()
+				}
+				if p.findClientByName(args[0]) != nil {
+					return nil, c.Errf("client %s is specified more than once", args[0])
+				}
+
+				client := &plugClient{
+					Name: args[0],
+					d:    dnsfilter.New(),
+				}
+				for _, id := range args[1:] {
+					if ip := net.ParseIP(id); ip != nil {
+						client.IPs = append(client.IPs, ip)
+						continue
+					}
+					if _, ipnet, err := net.ParseCIDR(id); err == nil {
+						client.Nets = append(client.Nets, ipnet)
+						continue
+					}
+					if _, ok := dns.IsDomainName(id); !ok {
+						return nil, c.Errf("client %s: %s is neither an IP address, a CIDR nor a host name", client.Name, id)
+					}
+					client.Hosts = append(client.Hosts, strings.ToLower(strings.TrimSuffix(id, ".")))
+				}
+				p.clients = append(p.clients, client)
+			case "client_safebrowsing":
+				client, err := p.parseClientName(c)
+				if err != nil {
+					return nil, err
+				}
+				client.d.EnableSafeBrowsing()
+			case "client_safesearch":
+				client, err := p.parseClientName(c)
+				if err != nil {
+					return nil, err
+				}
+				client.d.EnableSafeSearch()
+			case "client_parental":
+				client, err := p.parseClientName(c)
+				if err != nil {
+					return nil, err
+				}
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				sensitivity, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+				err = client.d.EnableParental(sensitivity)
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+			case "client_filter":
+				client, err := p.parseClientName(c)
+				if err != nil {
+					return nil, err
+				}
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				filterId, err := strconv.ParseInt(c.Val(), 10, 64)
+				if err != nil {
+					return nil, c.ArgErr()
+				}
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				client.Filters = append(client.Filters, plugFilter{
+					ID:   filterId,
+					Path: c.Val(),
+				})
 			}
 		}
 	}
 
-	for _, filter := range p.settings.Filters {
-		log.Printf("Loading rules from %s", filter.Path)
+	err := loadFilters(p.d, p.settings.Filters)
+	if err != nil {
+		return nil, err
+	}
 
-		file, err := os.Open(filter.Path)
+	for _, client := range p.clients {
+		log.Printf("Loading filters for client %s", client.Name)
+		err = loadFilters(client.d, client.Filters)
 		if err != nil {
 			return nil, err
 		}
-		//noinspection GoDeferInLoop
-		defer file.Close()
-
-		count := 0
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			text := scanner.Text()
+	}
 
-			err = p.d.AddRule(text, filter.ID)
-			if err == dnsfilter.ErrAlreadyExists || err == dnsfilter.ErrInvalidSyntax {
-				continue
-			}
-			if err != nil {
-				log.Printf("Cannot add rule %s: %s", text, err)
-				// Just ignore invalid rules
-				continue
-			}
-			count++
-		}
-		log.Printf("Added %d rules from filter ID=%d", count, filter.ID)
+	err = p.resolveClientHosts(clientHostsFile)
+	if err != nil {
+		return nil, err
+	}
 
-		if err = scanner.Err(); err != nil {
-			return nil, err
+	// the databases are reloaded periodically, they must be closed if the plugin fails to set up
+	setupDone := false
+	defer func() {
+		if !setupDone {
+			p.closeLookupDBs()
 		}
+	}()
+	err = p.loadLookupDBs()
+	if err != nil {
+		return nil, err
 	}
 
-	log.Printf("Loading stats from querylog")
-	err := fillStatsFromQueryLog()
+	err = p.setupSafeSearch()
 	if err != nil {
-		log.Printf("Failed to load stats from querylog: %s", err)
 		return nil, err
 	}
 
-	if p.settings.QueryLogEnabled {
-		onceQueryLog.Do(func() {
-			go periodicQueryLogRotate()
-			go periodicHourlyTopRotate()
-			go statsRotator()
-		})
+	p.blockedServiceNames, err = loadBlockedServiceNames(p.settings.BlockedServices)
+	if err != nil {
+		return nil, err
 	}
 
 	onceHook.Do(func() {
@@ -211,9 +523,264 @@ func setupPlugin(c *caddy.Controller) (*plug, error) {
 		return nil, err
 	}
 
+	setupDone = true
 	return p, nil
 }
 
+// onStartup applies the settings that are shared by all the instances, they are changed only when the instance starts
+// so that the instance that fails to set up during a reload doesn't change them for the running one
+// if the reload fails after that, the running instance applies its own settings again
+func (p *plug) onStartup() error {
+	setupLookupCaches(p.settings)
+	setBlockedServiceNames(p.blockedServiceNames)
+	setupQueryLogStore(p.settings)
+
+	setStatsRetention(p.settings.StatsRetention)
+	statsLoaded := setupStatsFile(p.settings)
+
+	log.Printf("Loading querylog")
+	err := fillStatsFromQueryLog(!statsLoaded)
+	if err != nil {
+		log.Printf("Failed to load querylog: %s", err)
+		return err
+	}
+
+	onceStats.Do(func() {
+		go periodicHourlyTopRotate()
+		go statsRotator()
+	})
+	if p.settings.QueryLogEnabled {
+		onceQueryLog.Do(func() {
+			go periodicQueryLogCleanup()
+		})
+	}
+	return nil
+}
+
+// loadLookupDBs loads the local safebrowsing and parental databases if they're configured
+// and makes the default and the client filters use them instead of HTTP lookups
+// HTTP lookups are bounded by the lookup timeout, they're coalesced and outlive the requests that started them otherwise
+func (p *plug) loadLookupDBs() error {
+	if p.settings.LookupTimeout > 0 {
+		p.d.SetHTTPTimeout(p.settings.LookupTimeout)
+		for _, client := range p.clients {
+			client.d.SetHTTPTimeout(p.settings.LookupTimeout)
+		}
+	}
+
+	if len(p.settings.SafeBrowsingDB) != 0 {
+		db, err := dnsfilter.NewHashDB(p.settings.SafeBrowsingDB, dnsfilter.FilteredSafeBrowsing, p.settings.LookupDBRefresh)
+		if err != nil {
+			return fmt.Errorf("failed to load safebrowsing database: %s", err)
+		}
+		p.safeBrowsingDB = db
+		p.d.SetSafeBrowsingProvider(db)
+		for _, client := range p.clients {
+			client.d.SetSafeBrowsingProvider(db)
+		}
+	}
+
+	if len(p.settings.ParentalDB) != 0 {
+		db, err := dnsfilter.NewHashDB(p.settings.ParentalDB, dnsfilter.FilteredParental, p.settings.LookupDBRefresh)
+		if err != nil {
+			return fmt.Errorf("failed to load parental database: %s", err)
+		}
+		p.parentalDB = db
+		p.d.SetParentalProvider(db)
+		for _, client := range p.clients {
+			client.d.SetParentalProvider(db)
+		}
+	}
+	return nil
+}
+
+// closeLookupDBs stops reloading the local databases
+func (p *plug) closeLookupDBs() {
+	if p.safeBrowsingDB != nil {
+		p.safeBrowsingDB.Close()
+		p.safeBrowsingDB = nil
+	}
+	if p.parentalDB != nil {
+		p.parentalDB.Close()
+		p.parentalDB = nil
+	}
+}
+
+// setupSafeSearch applies the safesearch catalog and engines to the default and the client filters
+func (p *plug) setupSafeSearch() error {
+	catalog := dnsfilter.DefaultSafeSearchCatalog()
+	if len(p.settings.SafeSearchCatalog) != 0 {
+		var err error
+		catalog, err = dnsfilter.LoadSafeSearchCatalog(p.settings.SafeSearchCatalog)
+		if err != nil {
+			return fmt.Errorf("failed to load safesearch catalog: %s", err)
+		}
+		log.Printf("Loaded %d safesearch engines from %s", len(catalog.Engines), p.settings.SafeSearchCatalog)
+	}
+	first, second, conflict := catalog.Conflict(dnsfilter.SafeSearchEnabled(p.settings.SafeSearchEngines))
+	if conflict {
+		return fmt.Errorf("safesearch engines %s and %s can't be enabled at the same time", first, second)
+	}
+
+	p.d.SetSafeSearchCatalog(catalog)
+	p.d.SetSafeSearchEngines(p.settings.SafeSearchEngines)
+	for _, client := range p.clients {
+		client.d.SetSafeSearchCatalog(catalog)
+		client.d.SetSafeSearchEngines(p.settings.SafeSearchEngines)
+	}
+	return nil
+}
+
+// parseClientName reads the client name argument and returns the client declared with it
+func (p *plug) parseClientName(c *caddy.Controller) (*plugClient, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	client := p.findClientByName(c.Val())
+	if client == nil {
+		return nil, c.Errf("client %s must be declared before its settings", c.Val())
+	}
+	return client, nil
+}
+
+func (p *plug) findClientByName(name string) *plugClient {
+	for _, client := range p.clients {
+		if client.Name == name {
+			return client
+		}
+	}
+	return nil
+}
+
+// resolveClientHosts adds the addresses of the client host names to their IPs
+// the names are looked up in the hosts file only, resolving them with DNS could send the requests to ourselves
+func (p *plug) resolveClientHosts(path string) error {
+	hasHosts := false
+	for _, client := range p.clients {
+		hasHosts = hasHosts || len(client.Hosts) != 0
+	}
+	if !hasHosts {
+		return nil
+	}
+
+	hosts, err := readHostsFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve client host names: %s", err)
+	}
+	for _, client := range p.clients {
+		for _, host := range client.Hosts {
+			addrs, ok := hosts[host]
+			if !ok {
+				log.Printf("Client %s: host %s is not found in %s", client.Name, host, path)
+				continue
+			}
+			client.IPs = append(client.IPs, addrs...)
+		}
+	}
+	return nil
+}
+
+// readHostsFile returns the addresses of every host name in the hosts file
+func readHostsFile(path string) (map[string][]net.IP, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hosts := map[string][]net.IP{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.IndexByte(line, '#'); pos >= 0 {
+			line = line[:pos]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr := net.ParseIP(fields[0])
+		if addr == nil {
+			continue
+		}
+		for _, host := range fields[1:] {
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			hosts[host] = append(hosts[host], addr)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// findClient returns the client profile for the specified IP address or nil if there's none
+// exact IP addresses have priority over networks, more specific networks have priority over wider ones
+func (p *plug) findClient(ip string) *plugClient {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+
+	for _, client := range p.clients {
+		for _, clientIP := range client.IPs {
+			if clientIP.Equal(addr) {
+				return client
+			}
+		}
+	}
+
+	var found *plugClient
+	foundOnes := -1
+	for _, client := range p.clients {
+		for _, ipnet := range client.Nets {
+			if !ipnet.Contains(addr) {
+				continue
+			}
+			ones, _ := ipnet.Mask.Size()
+			if ones > foundOnes {
+				found = client
+				foundOnes = ones
+			}
+		}
+	}
+	return found
+}
+
+// loads rules from the specified filters into d
+func loadFilters(d *dnsfilter.Dnsfilter, filters []plugFilter) error {
+	for _, filter := range filters {
+		log.Printf("Loading rules from %s", filter.Path)
+
+		file, err := os.Open(filter.Path)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			text := scanner.Text()
+
+			err = d.AddRule(text, filter.ID)
+			if err == dnsfilter.ErrAlreadyExists || err == dnsfilter.ErrInvalidSyntax {
+				continue
+			}
+			if err != nil {
+				log.Printf("Cannot add rule %s: %s", text, err)
+				// Just ignore invalid rules
+				continue
+			}
+			count++
+		}
+		log.Printf("Added %d rules from filter ID=%d", count, filter.ID)
+
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func setup(c *caddy.Controller) error {
 	p, err := setupPlugin(c)
 	if err != nil {
@@ -225,6 +792,8 @@ func setup(c *caddy.Controller) error {
 		return p
 	})
 
+	c.OnStartup(p.onStartup)
+	c.OnRestartFailed(p.onStartup)
 	c.OnStartup(func() error {
 		m := dnsserver.GetConfig(c).Handler("prometheus")
 		if m == nil {
@@ -236,14 +805,25 @@ func setup(c *caddy.Controller) error {
 			x.MustRegister(filteredLists)
 			x.MustRegister(filteredSafebrowsing)
 			x.MustRegister(filteredParental)
+			x.MustRegister(filteredBlockedIP)
+			x.MustRegister(filteredBlockedServices)
 			x.MustRegister(whitelisted)
 			x.MustRegister(safesearch)
+			x.MustRegister(dnsRewritten)
 			x.MustRegister(errorsTotal)
 			x.MustRegister(elapsedTime)
+			x.MustRegister(responsesTotal)
+			x.MustRegister(checkHostDuration)
 			x.MustRegister(p)
 		}
 		return nil
 	})
+	c.OnStartup(func() error {
+		activePluginLock.Lock()
+		activePlugin = p
+		activePluginLock.Unlock()
+		return nil
+	})
 	c.OnShutdown(p.onShutdown)
 	c.OnFinalShutdown(p.onFinalShutdown)
 
@@ -251,21 +831,38 @@ func setup(c *caddy.Controller) error {
 }
 
 func (p *plug) onShutdown() error {
+	activePluginLock.Lock()
+	if activePlugin == p {
+		activePlugin = nil
+	}
+	activePluginLock.Unlock()
+
 	p.Lock()
 	p.d.Destroy()
 	p.d = nil
+	for _, client := range p.clients {
+		client.d.Destroy()
+		client.d = nil
+	}
+	p.closeLookupDBs()
 	p.Unlock()
 	return nil
 }
 
 func (p *plug) onFinalShutdown() error {
+	stopLookupCacheSave()
+	saveLookupCaches()
+	saveStats()
+
 	logBufferLock.Lock()
-	err := flushToFile(logBuffer)
+	flushBuffer := logBuffer
+	logBuffer = nil
+	logBufferLock.Unlock()
+	err := flushAndWait(flushBuffer)
 	if err != nil {
 		log.Printf("failed to flush to file: %s", err)
 		return err
 	}
-	logBufferLock.Unlock()
 	return nil
 }
 
@@ -278,7 +875,7 @@ func doDesc(ch interface{}, name string, text string, value float64, valueType p
 		log.Printf("Couldn't convert ch to chan<- *prometheus.Desc\n")
 		return
 	}
-	realch <- prometheus.NewDesc(name, text, nil, nil)
+	realch <- statsDesc(name, text)
 }
 
 func doMetric(ch interface{}, name string, text string, value float64, valueType prometheus.ValueType) {
@@ -287,7 +884,7 @@ func doMetric(ch interface{}, name string, text string, value float64, valueType
 		log.Printf("Couldn't convert ch to chan<- prometheus.Metric\n")
 		return
 	}
-	desc := prometheus.NewDesc(name, text, nil, nil)
+	desc := statsDesc(name, text)
 	realch <- prometheus.MustNewConstMetric(desc, valueType, value)
 }
 
@@ -300,6 +897,8 @@ func doStatsLookup(ch interface{}, doFunc statsFunc, name string, lookupstats *d
 	gen(ch, doFunc, fmt.Sprintf("coredns_dnsfilter_%s_cachehits", name), fmt.Sprintf("Number of %s lookups that didn't need HTTP requests", name), float64(lookupstats.CacheHits), prometheus.CounterValue)
 	gen(ch, doFunc, fmt.Sprintf("coredns_dnsfilter_%s_pending", name), fmt.Sprintf("Number of currently pending %s HTTP requests", name), float64(lookupstats.Pending), prometheus.GaugeValue)
 	gen(ch, doFunc, fmt.Sprintf("coredns_dnsfilter_%s_pending_max", name), fmt.Sprintf("Maximum number of pending %s HTTP requests", name), float64(lookupstats.PendingMax), prometheus.GaugeValue)
+	gen(ch, doFunc, fmt.Sprintf("coredns_dnsfilter_%s_timeouts", name), fmt.Sprintf("Number of %s lookups that were given up because of the query deadline", name), float64(lookupstats.Timeouts), prometheus.CounterValue)
+	gen(ch, doFunc, fmt.Sprintf("coredns_dnsfilter_%s_coalesced", name), fmt.Sprintf("Number of %s lookups that shared the result with concurrent lookups of the same host", name), float64(lookupstats.Coalesced), prometheus.CounterValue)
 }
 
 func (p *plug) doStats(ch interface{}, doFunc statsFunc) {
@@ -320,41 +919,85 @@ func (p *plug) Collect(ch chan<- prometheus.Metric) {
 	p.doStats(ch, doMetric)
 }
 
-func (p *plug) replaceHostWithValAndReply(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, host string, val string, question dns.Question) (int, error) {
+// replies with val instead of host, the addresses of val are resolved if it's a host name
+// ttl is the TTL of the address records, the resolved ones are kept no longer than that either
+func (p *plug) replaceHostWithValAndReply(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, host string, val string, question dns.Question, ttl uint32) (int, error) {
 	// check if it's a domain name or IP address
 	addr := net.ParseIP(val)
 	var records []dns.RR
 	// log.Println("Will give", val, "instead of", host) // debug logging
 	if addr != nil {
-		// this is an IP address, return it
-		result, err := dns.NewRR(fmt.Sprintf("%s %d A %s", host, p.settings.BlockedTTL, val))
-		if err != nil {
-			log.Printf("Got error %s\n", err)
-			return dns.RcodeServerFailure, fmt.Errorf("plugin/dnsfilter: %s", err)
+		// this is an IP address, return it if its family matches the question, otherwise reply with no records
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		ip4 := addr.To4()
+		if ip4 != nil && question.Qtype == dns.TypeA {
+			records = append(records, &dns.A{Hdr: header, A: ip4})
+		} else if ip4 == nil && question.Qtype == dns.TypeAAAA {
+			records = append(records, &dns.AAAA{Hdr: header, AAAA: addr})
 		}
-		records = append(records, result)
 	} else {
 		// this is a domain name, need to look it up
-		req := new(dns.Msg)
-		req.SetQuestion(dns.Fqdn(val), question.Qtype)
-		req.RecursionDesired = true
-		reqstate := request.Request{W: w, Req: req, Context: ctx}
-		result, err := p.upstream.Lookup(reqstate, dns.Fqdn(val), reqstate.QType())
+		answers, err := p.lookupUpstream(ctx, w, val, question.Qtype)
 		if err != nil {
 			log.Printf("Got error %s\n", err)
 			return dns.RcodeServerFailure, fmt.Errorf("plugin/dnsfilter: %s", err)
 		}
-		if result != nil {
-			for _, answer := range result.Answer {
-				answer.Header().Name = question.Name
+		for _, answer := range answers {
+			answer.Header().Name = question.Name
+			if answer.Header().Ttl > ttl {
+				answer.Header().Ttl = ttl
 			}
-			records = result.Answer
 		}
+		records = answers
 	}
+	return p.writeAnswer(ctx, w, r, records)
+}
+
+// answers with the addresses of the safe search version of the search engine,
+// its host name is resolved if there are no addresses for the question type
+func (p *plug) replaceHostWithSafeSearch(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, host string, target dnsfilter.SafeSearchTarget, question dns.Question) (int, error) {
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: p.settings.BlockedTTL}
+	var records []dns.RR
+	switch {
+	case question.Qtype == dns.TypeA && len(target.A) != 0:
+		for _, ip := range target.A {
+			records = append(records, &dns.A{Hdr: header, A: ip})
+		}
+	case question.Qtype == dns.TypeAAAA && len(target.AAAA) != 0:
+		for _, ip := range target.AAAA {
+			records = append(records, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	case len(target.CNAME) != 0:
+		return p.replaceHostWithValAndReply(ctx, w, r, host, target.CNAME, question, p.settings.BlockedTTL)
+	}
+	return p.writeAnswer(ctx, w, r, records)
+}
+
+// resolves the specified domain name using upstream
+func (p *plug) lookupUpstream(ctx context.Context, w dns.ResponseWriter, name string, qtype uint16) ([]dns.RR, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.RecursionDesired = true
+	reqstate := request.Request{W: w, Req: req, Context: ctx}
+	result, err := p.upstream.Lookup(reqstate, dns.Fqdn(name), reqstate.QType())
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, nil
+	}
+	return result.Answer, nil
+}
+
+// writes the reply with the specified records, if there are none, SOA is added to make clients cache the empty response
+func (p *plug) writeAnswer(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, records []dns.RR) (int, error) {
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
 	m.Answer = append(m.Answer, records...)
+	if len(records) == 0 {
+		m.Ns = p.genSOA(r, p.settings.BlockedTTL)
+	}
 	state := request.Request{W: w, Req: r, Context: ctx}
 	state.SizeAndDo(m)
 	err := state.W.WriteMsg(m)
@@ -365,11 +1008,52 @@ func (p *plug) replaceHostWithValAndReply(ctx context.Context, w dns.ResponseWri
 	return dns.RcodeSuccess, nil
 }
 
+// replies with the response synthesized by $dnsrewrite rules
+func (p *plug) writeDNSRewrite(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, question dns.Question, rewrite *dnsfilter.DNSRewriteResult) (int, error) {
+	switch rewrite.RCode {
+	case dns.RcodeSuccess:
+		// records are written below
+	case dns.RcodeNameError:
+		return p.writeNXdomain(ctx, w, r)
+	default:
+		state := request.Request{W: w, Req: r, Context: ctx}
+		m := new(dns.Msg)
+		m.SetRcode(r, rewrite.RCode)
+		m.RecursionAvailable = true
+		state.SizeAndDo(m)
+		err := state.W.WriteMsg(m)
+		if err != nil {
+			log.Printf("Got error %s\n", err)
+			return dns.RcodeServerFailure, err
+		}
+		// the response is already written, don't let the callers write an error response instead
+		return dns.RcodeSuccess, nil
+	}
+
+	var records []dns.RR
+	for _, rr := range rewrite.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = p.settings.BlockedTTL
+		records = append(records, rr)
+
+		// resolve the CNAME target unless it's what was asked
+		if cname, ok := rr.(*dns.CNAME); ok && question.Qtype != dns.TypeCNAME {
+			answers, err := p.lookupUpstream(ctx, w, cname.Target, question.Qtype)
+			if err != nil {
+				log.Printf("Got error %s\n", err)
+				return dns.RcodeServerFailure, fmt.Errorf("plugin/dnsfilter: %s", err)
+			}
+			records = append(records, answers...)
+		}
+	}
+	return p.writeAnswer(ctx, w, r, records)
+}
+
 // generate SOA record that makes DNS clients cache NXdomain results
 // the only value that is important is TTL in header, other values like refresh, retry, expire and minttl are irrelevant
-func (p *plug) genSOA(r *dns.Msg) []dns.RR {
+func (p *plug) genSOA(r *dns.Msg, ttl uint32) []dns.RR {
 	zone := r.Question[0].Name
-	header := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Ttl: p.settings.BlockedTTL, Class: dns.ClassINET}
+	header := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Ttl: ttl, Class: dns.ClassINET}
 
 	Mbox := "hostmaster."
 	if zone[0] != '.' {
@@ -390,7 +1074,7 @@ func (p *plug) writeNXdomain(ctx context.Context, w dns.ResponseWriter, r *dns.M
 	m := new(dns.Msg)
 	m.SetRcode(state.Req, dns.RcodeNameError)
 	m.Authoritative, m.RecursionAvailable, m.Compress = true, true, true
-	m.Ns = p.genSOA(r)
+	m.Ns = p.genSOA(r, p.settings.BlockedTTL)
 
 	state.SizeAndDo(m)
 	err := state.W.WriteMsg(m)
@@ -401,7 +1085,29 @@ func (p *plug) writeNXdomain(ctx context.Context, w dns.ResponseWriter, r *dns.M
 	return dns.RcodeNameError, nil
 }
 
-func (p *plug) serveDNSInternal(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, dnsfilter.Result, error) {
+// getDnsfilter returns the filter of the client profile matching ip or the default one
+// and the client description for the rules with $client modifier
+// p must be read-locked
+func (p *plug) getDnsfilter(ip string) (*dnsfilter.Dnsfilter, dnsfilter.ClientInfo) {
+	clientInfo := dnsfilter.ClientInfo{IP: net.ParseIP(ip)}
+	if client := p.findClient(ip); client != nil {
+		clientInfo.Name = client.Name
+		return client.d, clientInfo
+	}
+	return p.d, clientInfo
+}
+
+// checkHost checks the host with the lookup deadline applied, the host isn't filtered by the lookups that miss it
+func (p *plug) checkHost(ctx context.Context, d *dnsfilter.Dnsfilter, host string, qtype uint16, clientInfo dnsfilter.ClientInfo) (dnsfilter.Result, error) {
+	if p.settings.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.settings.LookupTimeout)
+		defer cancel()
+	}
+	return d.CheckRequest(ctx, host, qtype, clientInfo)
+}
+
+func (p *plug) serveDNSInternal(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, ip string) (int, dnsfilter.Result, error) {
 	if len(r.Question) != 1 {
 		// google DNS, bind and others do the same
 		return dns.RcodeFormatError, dnsfilter.Result{}, fmt.Errorf("got a DNS request with more than one Question")
@@ -410,8 +1116,9 @@ func (p *plug) serveDNSInternal(ctx context.Context, w dns.ResponseWriter, r *dn
 		host := strings.ToLower(strings.TrimSuffix(question.Name, "."))
 		// is it a safesearch domain?
 		p.RLock()
-		if val, ok := p.d.SafeSearchDomain(host); ok {
-			rcode, err := p.replaceHostWithValAndReply(ctx, w, r, host, val, question)
+		d, clientInfo := p.getDnsfilter(ip)
+		if target, ok := d.SafeSearchDomain(host); ok {
+			rcode, err := p.replaceHostWithSafeSearch(ctx, w, r, host, target, question)
 			if err != nil {
 				p.RUnlock()
 				return rcode, dnsfilter.Result{}, err
@@ -422,50 +1129,24 @@ func (p *plug) serveDNSInternal(ctx context.Context, w dns.ResponseWriter, r *dn
 		p.RUnlock()
 
 		// needs to be filtered instead
+		// the lock isn't held during the check, safebrowsing and parental lookups can take a while
 		p.RLock()
-		result, err := p.d.CheckHost(host)
+		d, clientInfo = p.getDnsfilter(ip)
+		p.RUnlock()
+		result, err := p.checkHostTimed(ctx, d, host, question.Qtype, clientInfo)
 		if err != nil {
 			log.Printf("plugin/dnsfilter: %s\n", err)
-			p.RUnlock()
 			return dns.RcodeServerFailure, dnsfilter.Result{}, fmt.Errorf("plugin/dnsfilter: %s", err)
 		}
-		p.RUnlock()
 
 		if result.IsFiltered {
 			switch result.Reason {
-			case dnsfilter.FilteredSafeBrowsing:
-				// return cname safebrowsing
-				val := p.settings.SafeBrowsingBlockHost
-				rcode, err := p.replaceHostWithValAndReply(ctx, w, r, host, val, question)
-				if err != nil {
-					return rcode, dnsfilter.Result{}, err
-				}
-				return rcode, result, err
-			case dnsfilter.FilteredParental:
-				// return cname family
-				val := p.settings.ParentalBlockHost
-				rcode, err := p.replaceHostWithValAndReply(ctx, w, r, host, val, question)
+			case dnsfilter.FilteredSafeBrowsing, dnsfilter.FilteredParental, dnsfilter.FilteredBlackList, dnsfilter.FilteredBlockedService:
+				rcode, err := p.writeBlocked(ctx, w, r, host, question, result)
 				if err != nil {
 					return rcode, dnsfilter.Result{}, err
 				}
 				return rcode, result, err
-			case dnsfilter.FilteredBlackList:
-
-				if result.Ip == nil {
-					// return NXDomain
-					rcode, err := p.writeNXdomain(ctx, w, r)
-					if err != nil {
-						return rcode, dnsfilter.Result{}, err
-					}
-					return rcode, result, err
-				} else {
-					// This is a hosts-syntax rule
-					rcode, err := p.replaceHostWithValAndReply(ctx, w, r, host, result.Ip.String(), question)
-					if err != nil {
-						return rcode, dnsfilter.Result{}, err
-					}
-					return rcode, result, err
-				}
 			case dnsfilter.FilteredInvalid:
 				// return NXdomain
 				rcode, err := p.writeNXdomain(ctx, w, r)
@@ -481,6 +1162,12 @@ func (p *plug) serveDNSInternal(ctx context.Context, w dns.ResponseWriter, r *dn
 			case dnsfilter.NotFilteredWhiteList:
 				rcode, err := plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
 				return rcode, result, err
+			case dnsfilter.FilteredDNSRewrite:
+				rcode, err := p.writeDNSRewrite(ctx, w, r, question, result.DNSRewrite)
+				if err != nil {
+					return rcode, dnsfilter.Result{}, err
+				}
+				return rcode, result, err
 			case dnsfilter.NotFilteredNotFound:
 				// do nothing, pass through to lower code
 			default:
@@ -488,8 +1175,121 @@ func (p *plug) serveDNSInternal(ctx context.Context, w dns.ResponseWriter, r *dn
 			}
 		}
 	}
-	rcode, err := plugin.NextOrFailure(p.Name(), p.Next, ctx, w, r)
-	return rcode, dnsfilter.Result{}, err
+	return p.serveUpstream(ctx, w, r, ip)
+}
+
+// serveUpstream passes the request to the next plugin and checks its response
+// CNAME targets and, if enabled, IP addresses are matched against the same rules as the question
+// returns the rcode of the response that was written
+func (p *plug) serveUpstream(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, ip string) (int, dnsfilter.Result, error) {
+	p.RLock()
+	d, _ := p.getDnsfilter(ip)
+	p.RUnlock()
+	capture := &responseCapture{
+		ResponseWriter: w,
+		needsCheck: func(m *dns.Msg) bool {
+			return p.responseNeedsCheck(d, m)
+		},
+	}
+	rcode, err := plugin.NextOrFailure(p.Name(), p.Next, ctx, capture, r)
+	if capture.msg == nil {
+		// nothing was written, the caller will reply with rcode
+		return rcode, dnsfilter.Result{}, err
+	}
+	if !capture.held {
+		// the response didn't need checking and is already sent
+		return capture.msg.Rcode, dnsfilter.Result{}, err
+	}
+
+	question := r.Question[0]
+	result, checkErr := p.checkResponse(ip, question, capture.msg)
+	if checkErr != nil {
+		// don't fail the request because of that, send the response as is
+		log.Printf("plugin/dnsfilter: failed to check the response: %s", checkErr)
+	}
+	if !result.IsFiltered {
+		writeErr := w.WriteMsg(capture.msg)
+		if writeErr != nil {
+			return dns.RcodeServerFailure, dnsfilter.Result{}, writeErr
+		}
+		return capture.msg.Rcode, dnsfilter.Result{}, err
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(question.Name, "."))
+	rcode, err = p.writeBlocked(ctx, w, r, host, question, result)
+	if err != nil {
+		return rcode, dnsfilter.Result{}, err
+	}
+	return rcode, result, err
+}
+
+// responseNeedsCheck tells if the upstream response has records that checkResponse matches against the rules of d
+func (p *plug) responseNeedsCheck(d *dnsfilter.Dnsfilter, m *dns.Msg) bool {
+	checkIPs := p.settings.CheckResponseIPs || d.HasNetworkRules()
+	for _, rr := range m.Answer {
+		switch rr.(type) {
+		case *dns.CNAME:
+			return true
+		case *dns.A, *dns.AAAA:
+			if checkIPs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkResponse matches the records of the upstream response against the rules of the client
+// returns the result of the first blocking rule with the CNAME chain of the response attached,
+// a whitelisted record stops the check, so the records after it aren't blocked
+func (p *plug) checkResponse(ip string, question dns.Question, answer *dns.Msg) (dnsfilter.Result, error) {
+	var chain []string
+	for _, rr := range answer.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			chain = append(chain, strings.ToLower(strings.TrimSuffix(cname.Target, ".")))
+		}
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+	d, clientInfo := p.getDnsfilter(ip)
+	for _, rr := range answer.Answer {
+		var host string
+		var addr net.IP
+		switch v := rr.(type) {
+		case *dns.CNAME:
+			host = strings.ToLower(strings.TrimSuffix(v.Target, "."))
+		case *dns.A:
+			addr = v.A
+		case *dns.AAAA:
+			addr = v.AAAA
+		default:
+			continue
+		}
+
+		if addr != nil {
+			// blocked networks are always checked
+			result := d.CheckResponseIP(addr, question.Qtype, clientInfo)
+			if result.IsFiltered || result.Reason == dnsfilter.NotFilteredWhiteList {
+				result.CNAMEChain = chain
+				return result, nil
+			}
+			if !p.settings.CheckResponseIPs {
+				continue
+			}
+			host = addr.String()
+		}
+
+		result, err := d.CheckHostRules(host, question.Qtype, clientInfo)
+		if err != nil {
+			return dnsfilter.Result{}, err
+		}
+		if result.IsFiltered || result.Reason == dnsfilter.NotFilteredWhiteList {
+			result.CNAMEChain = chain
+			return result, nil
+		}
+	}
+	return dnsfilter.Result{}, nil
 }
 
 // ServeDNS handles the DNS request and refuses if it's in filterlists
@@ -501,9 +1301,10 @@ func (p *plug) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 
 	// capture the written answer
 	rrw := dnstest.NewRecorder(w)
-	rcode, result, err := p.serveDNSInternal(ctx, rrw, r)
-	if rcode > 0 {
-		// actually send the answer if we have one
+	ctx, servedBy := withServedBy(ctx)
+	rcode, result, err := p.serveDNSInternal(ctx, rrw, r, ip)
+	if rcode > 0 && rrw.Len == 0 {
+		// nothing was written, actually send the answer with rcode
 		answer := new(dns.Msg)
 		answer.SetRcode(r, rcode)
 		state.SizeAndDo(answer)
@@ -529,9 +1330,18 @@ func (p *plug) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	case result.Reason == dnsfilter.FilteredInvalid:
 		filtered.Inc()
 		filteredInvalid.Inc()
+	case result.Reason == dnsfilter.FilteredBlockedIP:
+		filtered.Inc()
+		filteredBlockedIP.Inc()
+	case result.Reason == dnsfilter.FilteredBlockedService:
+		filtered.Inc()
+		filteredBlockedServices.Inc()
 	case result.Reason == dnsfilter.FilteredSafeSearch:
 		// the request was passsed through but not filtered, don't increment filtered
 		safesearch.Inc()
+	case result.Reason == dnsfilter.FilteredDNSRewrite:
+		// the response was synthesized but not filtered, don't increment filtered
+		dnsRewritten.Inc()
 	case result.Reason == dnsfilter.NotFilteredWhiteList:
 		whitelisted.Inc()
 	case result.Reason == dnsfilter.NotFilteredNotFound:
@@ -542,12 +1352,22 @@ func (p *plug) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 		err = errors.New(text)
 		rcode = dns.RcodeServerFailure
 	}
+	p.observeResponse(r, rrw.Msg, rcode, result, err, ip, *servedBy)
 
 	// log
 	elapsed := time.Since(start)
 	elapsedTime.Observe(elapsed.Seconds())
-	if p.settings.QueryLogEnabled {
-		logRequest(r, rrw.Msg, result, time.Since(start), ip)
+	if !p.isQueryLogIgnored(ip) {
+		if p.settings.QueryLogEnabled {
+			logRequest(r, rrw.Msg, result, time.Since(start), p.anonymizeIP(ip))
+		} else {
+			// the top is kept even if the requests aren't logged
+			addToRunningTop(r, result, start, p.anonymizeIP(ip))
+		}
+	}
+	if !plugin.ClientWrite(rcode) {
+		// the response is already written, don't let the server write another one
+		return dns.RcodeSuccess, err
 	}
 	return rcode, err
 }
@@ -555,5 +1375,13 @@ func (p *plug) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 // Name returns name of the plugin as seen in Corefile and plugin.cfg
 func (p *plug) Name() string { return "dnsfilter" }
 
+// the hosts file the client host names are looked up in
+var clientHostsFile = "/etc/hosts"
+
 var onceHook sync.Once
 var onceQueryLog sync.Once
+var onceStats sync.Once
+
+// the plugin instance that is serving requests, it's used by the HTTP API
+var activePlugin *plug
+var activePluginLock sync.RWMutex
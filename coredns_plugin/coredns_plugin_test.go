@@ -0,0 +1,56 @@
+package dnsfilter
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestFindClient(t *testing.T) {
+	hostsFile, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(hostsFile.Name())
+	_, err = hostsFile.WriteString("127.0.0.1 localhost\n192.168.1.50 kids-tablet.lan # DHCP\n")
+	hostsFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, wide, _ := net.ParseCIDR("192.168.0.0/16")
+	_, narrow, _ := net.ParseCIDR("192.168.1.0/24")
+	p := &plug{clients: []*plugClient{
+		{Name: "home", Nets: []*net.IPNet{wide}},
+		{Name: "office", Nets: []*net.IPNet{narrow}},
+		{Name: "laptop", IPs: []net.IP{net.ParseIP("192.168.1.10")}},
+		{Name: "tablet", Hosts: []string{"kids-tablet.lan", "unknown.lan"}},
+	}}
+	err = p.resolveClientHosts(hostsFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip     string
+		client string
+	}{
+		{"192.168.1.10", "laptop"},
+		{"192.168.1.50", "tablet"},
+		{"192.168.1.20", "office"},
+		{"192.168.2.20", "home"},
+		{"10.0.0.1", ""},
+		{"not an address", ""},
+	}
+	for _, tc := range tests {
+		client := p.findClient(tc.ip)
+		name := ""
+		if client != nil {
+			name = client.Name
+		}
+		if name != tc.client {
+			t.Errorf("findClient(%s) returned %q, expected %q", tc.ip, name, tc.client)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -13,28 +14,39 @@ import (
 )
 
 var (
-	requests             = newDNSCounter("requests_total", "Count of requests seen by dnsfilter.")
-	filtered             = newDNSCounter("filtered_total", "Count of requests filtered by dnsfilter.")
-	filteredLists        = newDNSCounter("filtered_lists_total", "Count of requests filtered by dnsfilter using lists.")
-	filteredSafebrowsing = newDNSCounter("filtered_safebrowsing_total", "Count of requests filtered by dnsfilter using safebrowsing.")
-	filteredParental     = newDNSCounter("filtered_parental_total", "Count of requests filtered by dnsfilter using parental.")
-	filteredInvalid      = newDNSCounter("filtered_invalid_total", "Count of requests filtered by dnsfilter because they were invalid.")
-	whitelisted          = newDNSCounter("whitelisted_total", "Count of requests not filtered by dnsfilter because they are whitelisted.")
-	safesearch           = newDNSCounter("safesearch_total", "Count of requests replaced by dnsfilter safesearch.")
-	errorsTotal          = newDNSCounter("errors_total", "Count of requests that dnsfilter couldn't process because of transitive errors.")
-	elapsedTime          = newDNSHistogram("request_duration", "Histogram of the time (in seconds) each request took.")
+	requests                = newDNSCounter("requests_total", "Count of requests seen by dnsfilter.")
+	filtered                = newDNSCounter("filtered_total", "Count of requests filtered by dnsfilter.")
+	filteredLists           = newDNSCounter("filtered_lists_total", "Count of requests filtered by dnsfilter using lists.")
+	filteredSafebrowsing    = newDNSCounter("filtered_safebrowsing_total", "Count of requests filtered by dnsfilter using safebrowsing.")
+	filteredParental        = newDNSCounter("filtered_parental_total", "Count of requests filtered by dnsfilter using parental.")
+	filteredInvalid         = newDNSCounter("filtered_invalid_total", "Count of requests filtered by dnsfilter because they were invalid.")
+	filteredBlockedIP       = newDNSCounter("filtered_blocked_ip_total", "Count of requests filtered by dnsfilter because the response contained an IP address from a blocked network.")
+	filteredBlockedServices = newDNSCounter("filtered_blocked_services_total", "Count of requests filtered by dnsfilter because the host belongs to a blocked service.")
+	whitelisted             = newDNSCounter("whitelisted_total", "Count of requests not filtered by dnsfilter because they are whitelisted.")
+	safesearch              = newDNSCounter("safesearch_total", "Count of requests replaced by dnsfilter safesearch.")
+	dnsRewritten            = newDNSCounter("dnsrewrite_total", "Count of requests answered by dnsfilter $dnsrewrite rules.")
+	errorsTotal             = newDNSCounter("errors_total", "Count of requests that dnsfilter couldn't process because of transitive errors.")
+	elapsedTime             = newDNSHistogram("request_duration", "Histogram of the time (in seconds) each request took.")
 )
 
-// entries for single time period (for example all per-second entries)
-type statsEntries map[string][statsHistoryElements]float64
-
-// how far back to keep the stats
-const statsHistoryElements = 60 + 1 // +1 for calculating delta
+// entries for single time period (for example all per-second entries), the current period first
+type statsEntries map[string][]float64
+
+// how far back to keep the stats, +1 for calculating delta
+// the requests are counted per minute, each minute is rolled into its hour and its day when it's over,
+// the per-day stats are kept for the whole retention period, the per-hour ones for a month at most
+const (
+	statsSecondElements   = 60 + 1
+	statsMinuteElements   = 24*60 + 1
+	statsMaxHourElements  = 30*24 + 1 // the per-hour stats are kept for the retention period but no longer than this
+	defaultStatsRetention = 90        // in days
+)
 
 // each periodic stat is a map of arrays
 type periodicStats struct {
 	Entries    statsEntries
 	period     time.Duration // how long one entry lasts
+	size       int           // number of periods in each of the entries
 	LastRotate time.Time     // last time this data was rotated
 
 	sync.RWMutex
@@ -50,10 +62,19 @@ type stats struct {
 // per-second/per-minute/per-hour/per-day stats
 var statistics stats
 
-func initPeriodicStats(periodic *periodicStats, period time.Duration) {
+// how many days the per-day stats are kept
+var (
+	statsRetention     = defaultStatsRetention
+	statsRetentionLock sync.Mutex
+)
+
+func initPeriodicStats(periodic *periodicStats, period time.Duration, size int) {
+	periodic.Lock()
 	periodic.Entries = statsEntries{}
 	periodic.LastRotate = time.Now()
 	periodic.period = period
+	periodic.size = size
+	periodic.Unlock()
 }
 
 func init() {
@@ -61,81 +82,152 @@ func init() {
 }
 
 func purgeStats() {
-	initPeriodicStats(&statistics.PerSecond, time.Second)
-	initPeriodicStats(&statistics.PerMinute, time.Minute)
-	initPeriodicStats(&statistics.PerHour, time.Hour)
-	initPeriodicStats(&statistics.PerDay, time.Hour*24)
+	hours, days := statsRetentionSizes(getStatsRetention())
+	initPeriodicStats(&statistics.PerSecond, time.Second, statsSecondElements)
+	initPeriodicStats(&statistics.PerMinute, time.Minute, statsMinuteElements)
+	initPeriodicStats(&statistics.PerHour, time.Hour, hours)
+	initPeriodicStats(&statistics.PerDay, time.Hour*24, days)
 }
 
-func (p *periodicStats) Inc(name string, when time.Time) {
+// returns the number of the per-hour and the per-day periods kept for the retention in days
+func statsRetentionSizes(days int) (int, int) {
+	hours := days*24 + 1
+	if hours > statsMaxHourElements {
+		hours = statsMaxHourElements
+	}
+	return hours, days + 1
+}
+
+func getStatsRetention() int {
+	statsRetentionLock.Lock()
+	defer statsRetentionLock.Unlock()
+	return statsRetention
+}
+
+// returns how many days the per-hour stats are kept for, the older ones are only per day
+func getHourlyStatsRetention() int {
+	hours, _ := statsRetentionSizes(getStatsRetention())
+	return (hours - 1) / 24
+}
+
+// setStatsRetention changes how many days the stats are kept, the older values are dropped
+func setStatsRetention(days int) {
+	statsRetentionLock.Lock()
+	defer statsRetentionLock.Unlock()
+	if days == statsRetention {
+		return
+	}
+	hours, daySize := statsRetentionSizes(days)
+	log.Printf("Stats are kept for %d days, per hour for the last %d days", days, (hours-1)/24)
+	statsRetention = days
+	statistics.PerHour.resize(hours)
+	statistics.PerDay.resize(daySize)
+}
+
+func (p *periodicStats) resize(size int) {
+	p.Lock()
+	defer p.Unlock()
+	p.size = size
+	for name, values := range p.Entries {
+		p.Entries[name] = resizeStatsValues(values, size)
+	}
+}
+
+func resizeStatsValues(values []float64, size int) []float64 {
+	if len(values) == size {
+		return values
+	}
+	resized := make([]float64, size)
+	copy(resized, values)
+	return resized
+}
+
+// returns the values of the entry, p must be locked
+func (p *periodicStats) values(name string) []float64 {
+	values, ok := p.Entries[name]
+	if !ok {
+		values = make([]float64, p.size)
+		p.Entries[name] = values
+	}
+	return values
+}
+
+// add adds the value to the period the time belongs to, p must be locked
+func (p *periodicStats) add(name string, when time.Time, now time.Time, value float64) {
 	// calculate how many periods ago this happened
-	elapsed := int64(time.Since(when) / p.period)
-	// trace("%s: %v as %v -> [%v]", name, time.Since(when), p.period, elapsed)
-	if elapsed >= statsHistoryElements {
-		return // outside of our timeframe
+	elapsed := int(now.Sub(when) / p.period)
+	if elapsed >= 0 && elapsed < p.size {
+		p.values(name)[elapsed] += value
 	}
+	// otherwise it's outside of our timeframe
+}
+
+func (p *periodicStats) Inc(name string, when time.Time) {
 	p.Lock()
-	currentValues := p.Entries[name]
-	currentValues[elapsed]++
-	p.Entries[name] = currentValues
+	p.add(name, when, time.Now(), 1)
 	p.Unlock()
 }
 
 func (p *periodicStats) Observe(name string, when time.Time, value float64) {
-	// calculate how many periods ago this happened
-	elapsed := int64(time.Since(when) / p.period)
-	// trace("%s: %v as %v -> [%v]", name, time.Since(when), p.period, elapsed)
-	if elapsed >= statsHistoryElements {
-		return // outside of our timeframe
-	}
+	now := time.Now()
 	p.Lock()
-	{
-		countname := name + "_count"
-		currentValues := p.Entries[countname]
-		value := currentValues[elapsed]
-		// trace("Will change p.Entries[%s][%d] from %v to %v", countname, elapsed, value, value+1)
-		value += 1
-		currentValues[elapsed] = value
-		p.Entries[countname] = currentValues
-	}
-	{
-		totalname := name + "_sum"
-		currentValues := p.Entries[totalname]
-		currentValues[elapsed] += value
-		p.Entries[totalname] = currentValues
-	}
+	p.add(name+"_count", when, now, 1)
+	p.add(name+"_sum", when, now, value)
 	p.Unlock()
 }
 
-func (p *periodicStats) statsRotate(now time.Time) {
+// countStats calls f for the per-second and the per-minute stats and, if the minute of the time is over,
+// for the per-hour and the per-day stats, the current minute is rolled into them when it's over
+func countStats(when time.Time, f func(p *periodicStats)) {
+	f(&statistics.PerSecond)
+	f(&statistics.PerMinute)
+	if time.Since(when) < time.Minute {
+		return
+	}
+	// e.g. the entries of the query log that are replayed at startup
+	f(&statistics.PerHour)
+	f(&statistics.PerDay)
+}
+
+// statsRotate shifts the values to make room for the new periods
+// the values of the period that is over are added to the coarser stats, i.e. downsampled
+func (p *periodicStats) statsRotate(now time.Time, coarser ...*periodicStats) {
 	p.Lock()
-	rotations := int64(now.Sub(p.LastRotate) / p.period)
-	if rotations > statsHistoryElements {
-		rotations = statsHistoryElements
-	}
-	// calculate how many times we should rotate
-	for r := int64(0); r < rotations; r++ {
-		for key, values := range p.Entries {
-			newValues := [statsHistoryElements]float64{}
-			for i := 1; i < len(values); i++ {
-				newValues[i] = values[i-1]
+	defer p.Unlock()
+	rotations := int(now.Sub(p.LastRotate) / p.period)
+	if rotations > p.size {
+		rotations = p.size
+	}
+	if rotations <= 0 {
+		return
+	}
+
+	// only the current period can have the values that aren't rolled yet
+	for _, c := range coarser {
+		c.Lock()
+		for name, values := range p.Entries {
+			if values[0] != 0 {
+				c.add(name, p.LastRotate, now, values[0])
 			}
-			p.Entries[key] = newValues
 		}
+		c.Unlock()
 	}
-	if rotations > 0 {
-		p.LastRotate = now
+	for _, values := range p.Entries {
+		copy(values[rotations:], values)
+		for i := 0; i < rotations; i++ {
+			values[i] = 0
+		}
 	}
-	p.Unlock()
+	p.LastRotate = now
 }
 
 func statsRotator() {
 	for range time.Tick(time.Second) {
 		now := time.Now()
 		statistics.PerSecond.statsRotate(now)
-		statistics.PerMinute.statsRotate(now)
 		statistics.PerHour.statsRotate(now)
 		statistics.PerDay.statsRotate(now)
+		statistics.PerMinute.statsRotate(now, &statistics.PerHour, &statistics.PerDay)
 	}
 }
 
@@ -161,10 +253,9 @@ func newDNSCounter(name string, help string) *counter {
 }
 
 func (c *counter) IncWithTime(when time.Time) {
-	statistics.PerSecond.Inc(c.name, when)
-	statistics.PerMinute.Inc(c.name, when)
-	statistics.PerHour.Inc(c.name, when)
-	statistics.PerDay.Inc(c.name, when)
+	countStats(when, func(p *periodicStats) {
+		p.Inc(c.name, when)
+	})
 	c.value++
 	c.prom.Inc()
 }
@@ -203,10 +294,9 @@ func newDNSHistogram(name string, help string) *histogram {
 }
 
 func (h *histogram) ObserveWithTime(value float64, when time.Time) {
-	statistics.PerSecond.Observe(h.name, when, value)
-	statistics.PerMinute.Observe(h.name, when, value)
-	statistics.PerHour.Observe(h.name, when, value)
-	statistics.PerDay.Observe(h.name, when, value)
+	countStats(when, func(p *periodicStats) {
+		p.Observe(h.name, when, value)
+	})
 	h.count++
 	h.total += value
 	h.prom.Observe(value)
@@ -227,9 +317,99 @@ func (h *histogram) Collect(ch chan<- prometheus.Metric) {
 // -----
 // stats
 // -----
+
+// statsUnit is a granularity of the stats history
+type statsUnit struct {
+	name   string
+	period time.Duration
+	stats  *periodicStats
+}
+
+// from the finest to the coarsest
+var statsUnits = []statsUnit{
+	{"seconds", time.Second, &statistics.PerSecond},
+	{"minutes", time.Minute, &statistics.PerMinute},
+	{"hours", time.Hour, &statistics.PerHour},
+	{"days", time.Hour * 24, &statistics.PerDay},
+}
+
+const statsUnitHours = 2 // index of the per-hour stats in statsUnits
+
+// findStatsUnit returns the finest unit, starting from statsUnits[from], that still has the stats since the time
+func findStatsUnit(from int, since, now time.Time) (statsUnit, bool) {
+	for _, unit := range statsUnits[from:] {
+		unit.stats.RLock()
+		size := unit.stats.size
+		unit.stats.RUnlock()
+		if int(now.Sub(since)/unit.period) < size {
+			return unit, true
+		}
+	}
+	return statsUnit{}, false
+}
+
+type statsPeriod struct {
+	duration time.Duration
+	text     string
+}
+
+// the periods of /control/stats
+var statsPeriods = map[string]statsPeriod{
+	"24h": {time.Hour * 24, "24 hours"},
+	"7d":  {time.Hour * 24 * 7, "7 days"},
+	"30d": {time.Hour * 24 * 30, "30 days"},
+}
+
+// parseStatsPeriod returns the period with the name, 24h if it's empty
+func parseStatsPeriod(name string) (statsPeriod, error) {
+	if len(name) == 0 {
+		name = "24h"
+	}
+	period, ok := statsPeriods[name]
+	if !ok {
+		return period, fmt.Errorf("period must be one of 24h, 7d or 30d")
+	}
+	return period, nil
+}
+
+// sumPeriodicStats sums up the last n periods of the entries whose names start with the prefix, keyed by the rest of the name
+func sumPeriodicStats(stats *periodicStats, prefix string, n int) map[string]int {
+	stats.RLock()
+	defer stats.RUnlock()
+	n = clamp(n, 0, stats.size)
+	sum := map[string]int{}
+	for name, values := range stats.Entries {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		value := 0.0
+		for _, v := range values[:n] {
+			value += v
+		}
+		if value != 0 {
+			sum[name[len(prefix):]] = int(value)
+		}
+	}
+	return sum
+}
+
 func HandleStats(w http.ResponseWriter, r *http.Request) {
-	const numHours = 24
-	histrical := generateMapFromStats(&statistics.PerHour, 0, numHours)
+	period, err := parseStatsPeriod(r.URL.Query().Get("period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the per-hour stats are used while they're kept, they are more precise
+	now := time.Now()
+	unit, ok := findStatsUnit(statsUnitHours, now.Add(-period.duration), now)
+	if !ok {
+		errortext := fmt.Sprintf("Stats are kept only for %d days", getStatsRetention())
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusBadRequest)
+		return
+	}
+	numElements := int(period.duration / unit.period)
+	histrical := generateMapFromStats(unit.stats, 0, numElements)
 	// sum them up
 	summed := map[string]interface{}{}
 	for key, values := range histrical {
@@ -246,12 +426,14 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 	// don't forget to divide by number of elements in returned slice
 	if val, ok := summed["avg_processing_time"]; ok {
 		if flval, flok := val.(float64); flok {
-			flval /= numHours
+			flval /= float64(numElements)
 			summed["avg_processing_time"] = flval
 		}
 	}
 
-	summed["stats_period"] = "24 hours"
+	summed["stats_period"] = period.text
+	summed["stats_retention_days"] = getStatsRetention()
+	summed["hourly_stats_retention_days"] = getHourlyStatsRetention()
 
 	json, err := json.Marshal(summed)
 	if err != nil {
@@ -271,9 +453,12 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func generateMapFromStats(stats *periodicStats, start int, end int) map[string]interface{} {
+	stats.RLock()
+	defer stats.RUnlock()
+
 	// clamp
-	start = clamp(start, 0, statsHistoryElements)
-	end = clamp(end, 0, statsHistoryElements)
+	start = clamp(start, 0, stats.size-1)
+	end = clamp(end, 0, stats.size-1)
 
 	avgProcessingTime := make([]float64, 0)
 
@@ -294,33 +479,32 @@ func generateMapFromStats(stats *periodicStats, start int, end int) map[string]i
 		"replaced_safebrowsing": getReversedSlice(stats.Entries[filteredSafebrowsing.name], start, end),
 		"replaced_safesearch":   getReversedSlice(stats.Entries[safesearch.name], start, end),
 		"replaced_parental":     getReversedSlice(stats.Entries[filteredParental.name], start, end),
+		"blocked_ip":            getReversedSlice(stats.Entries[filteredBlockedIP.name], start, end),
+		"blocked_services":      getReversedSlice(stats.Entries[filteredBlockedServices.name], start, end),
 		"avg_processing_time":   avgProcessingTime,
 	}
 	return result
 }
 
+// HandleStatsHistory returns the stats between start_time and end_time
+// time_unit is optional, if it's missing or if the stats of that unit aren't kept for so long,
+// the finest unit that has them is used, it's returned in time_unit of the response
 func HandleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	// handle time unit and prepare our time window size
 	now := time.Now()
 	timeUnitString := r.URL.Query().Get("time_unit")
-	var stats *periodicStats
-	var timeUnit time.Duration
-	switch timeUnitString {
-	case "seconds":
-		timeUnit = time.Second
-		stats = &statistics.PerSecond
-	case "minutes":
-		timeUnit = time.Minute
-		stats = &statistics.PerMinute
-	case "hours":
-		timeUnit = time.Hour
-		stats = &statistics.PerHour
-	case "days":
-		timeUnit = time.Hour * 24
-		stats = &statistics.PerDay
-	default:
-		http.Error(w, "Must specify valid time_unit parameter", 400)
-		return
+	from := 0
+	if len(timeUnitString) != 0 {
+		from = -1
+		for i, unit := range statsUnits {
+			if unit.name == timeUnitString {
+				from = i
+			}
+		}
+		if from < 0 {
+			http.Error(w, "Must specify valid time_unit parameter", 400)
+			return
+		}
 	}
 
 	// parse start and end time
@@ -340,15 +524,16 @@ func HandleStatsHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check if start and time times are within supported time range
-	timeRange := timeUnit * statsHistoryElements
-	if startTime.Add(timeRange).Before(now) {
-		http.Error(w, "start_time parameter is outside of supported range", 501)
-		return
+	oldest := startTime
+	if endTime.Before(oldest) {
+		oldest = endTime
 	}
-	if endTime.Add(timeRange).Before(now) {
-		http.Error(w, "end_time parameter is outside of supported range", 501)
+	unit, ok := findStatsUnit(from, oldest, now)
+	if !ok {
+		http.Error(w, "start_time parameter is outside of supported range", 501)
 		return
 	}
+	timeUnit := unit.period
 
 	// calculate start and end of our array
 	// basically it's how many hours/minutes/etc have passed since now
@@ -360,7 +545,10 @@ func HandleStatsHistory(w http.ResponseWriter, r *http.Request) {
 		start, end = end, start
 	}
 
-	data := generateMapFromStats(stats, start, end)
+	data := generateMapFromStats(unit.stats, start, end)
+	data["time_unit"] = unit.name
+	data["stats_retention_days"] = getStatsRetention()
+	data["hourly_stats_retention_days"] = getHourlyStatsRetention()
 	json, err := json.Marshal(data)
 	if err != nil {
 		errortext := fmt.Sprintf("Unable to marshal status json: %s", err)
@@ -380,6 +568,8 @@ func HandleStatsHistory(w http.ResponseWriter, r *http.Request) {
 
 func HandleStatsReset(w http.ResponseWriter, r *http.Request) {
 	purgeStats()
+	// otherwise the old stats would come back after a restart
+	saveStats()
 	_, err := fmt.Fprintf(w, "OK\n")
 	if err != nil {
 		errortext := fmt.Sprintf("Couldn't write body: %s", err)
@@ -401,10 +591,15 @@ func clamp(value, low, high int) int {
 // --------------------------
 // helper functions for stats
 // --------------------------
-func getReversedSlice(input [statsHistoryElements]float64, start int, end int) []float64 {
-	output := make([]float64, 0)
-	for i := start; i <= end; i++ {
-		output = append([]float64{input[i]}, output...)
+func getReversedSlice(input []float64, start int, end int) []float64 {
+	output := make([]float64, 0, end-start+1)
+	for i := end; i >= start; i-- {
+		// the entry can be missing if nothing was counted yet
+		value := 0.0
+		if i < len(input) {
+			value = input[i]
+		}
+		output = append(output, value)
 	}
 	return output
 }
@@ -0,0 +1,78 @@
+package dnsfilter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatsDownsampling(t *testing.T) {
+	minutes, hours, days := &periodicStats{}, &periodicStats{}, &periodicStats{}
+	initPeriodicStats(minutes, time.Minute, statsMinuteElements)
+	initPeriodicStats(hours, time.Hour, statsMaxHourElements)
+	initPeriodicStats(days, time.Hour*24, defaultStatsRetention+1)
+	start := minutes.LastRotate
+	hours.LastRotate, days.LastRotate = start, start
+
+	minutes.Inc("requests", start)
+	minutes.Inc("requests", start)
+	if hours.values("requests")[0] != 0 {
+		t.Fatal("the current minute must not be in the hour yet")
+	}
+
+	// the minute is rolled into its hour and day once it's over, and only once
+	for i := 1; i <= 2; i++ {
+		minutes.statsRotate(start.Add(time.Duration(i)*time.Minute), hours, days)
+	}
+	if got := minutes.values("requests")[2]; got != 2 {
+		t.Errorf("expected 2 requests two minutes ago, got %v", got)
+	}
+	if got := hours.values("requests")[0]; got != 2 {
+		t.Errorf("expected 2 requests in the hour, got %v", got)
+	}
+	if got := days.values("requests")[0]; got != 2 {
+		t.Errorf("expected 2 requests in the day, got %v", got)
+	}
+}
+
+func TestStatsPastRequests(t *testing.T) {
+	defer purgeStats()
+	purgeStats()
+
+	// the requests from the past minutes won't be rolled, they go straight into the hours and days
+	c := &counter{name: "test_requests", prom: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_requests"})}
+	c.IncWithTime(time.Now().Add(-2*time.Hour - time.Minute))
+	if got := statistics.PerMinute.values(c.name)[121]; got != 1 {
+		t.Errorf("expected the request in the minutes, got %v", got)
+	}
+	if got := statistics.PerHour.values(c.name)[2]; got != 1 {
+		t.Errorf("expected the request in the hours, got %v", got)
+	}
+	if got := statistics.PerDay.values(c.name)[0]; got != 1 {
+		t.Errorf("expected the request in the days, got %v", got)
+	}
+}
+
+func TestStatsRetention(t *testing.T) {
+	defer setStatsRetention(defaultStatsRetention)
+
+	tests := []struct {
+		days       int
+		hourlyDays int
+	}{
+		{7, 7},
+		{30, 30},
+		{365, 30},
+	}
+	for _, tc := range tests {
+		setStatsRetention(tc.days)
+		if got := getHourlyStatsRetention(); got != tc.hourlyDays {
+			t.Errorf("%d days: expected hourly stats for %d days, got %d", tc.days, tc.hourlyDays, got)
+		}
+		hours, days := statsRetentionSizes(tc.days)
+		if statistics.PerHour.size != hours || statistics.PerDay.size != days {
+			t.Errorf("%d days: expected %d hours and %d days, got %d and %d", tc.days, hours, days, statistics.PerHour.size, statistics.PerDay.size)
+		}
+	}
+}
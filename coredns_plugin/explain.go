@@ -0,0 +1,71 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// ExplainHost explains how the running plugin handles the request for host from the specified client
+// client is either an IP address or a name of a client profile, empty client means the default profile
+// returns the name of the client profile that was used, empty for the default one
+func ExplainHost(ctx context.Context, host string, qtype uint16, client string) (dnsfilter.Explanation, string, error) {
+	p, d, clientInfo, err := getActiveDnsfilter(client)
+	if err != nil {
+		return dnsfilter.Explanation{}, "", err
+	}
+
+	if p.settings.LookupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.settings.LookupTimeout)
+		defer cancel()
+	}
+	explanation, err := d.Explain(ctx, strings.TrimSuffix(host, "."), qtype, clientInfo)
+	return explanation, clientInfo.Name, err
+}
+
+// CheckHost checks the host the same way the running plugin checks the request from the specified client,
+// the first matching rule or lookup decides, unlike ExplainHost the rest of them aren't checked
+// client is either an IP address or a name of a client profile, empty client means the default profile
+func CheckHost(ctx context.Context, host string, qtype uint16, client string) (dnsfilter.Result, error) {
+	p, d, clientInfo, err := getActiveDnsfilter(client)
+	if err != nil {
+		return dnsfilter.Result{}, err
+	}
+	return p.checkHost(ctx, d, strings.TrimSuffix(host, "."), qtype, clientInfo)
+}
+
+// getActiveDnsfilter returns the running plugin and the filter of the client
+// the lock of the plugin isn't held after it returns, safebrowsing and parental lookups can take a while
+func getActiveDnsfilter(client string) (*plug, *dnsfilter.Dnsfilter, dnsfilter.ClientInfo, error) {
+	activePluginLock.RLock()
+	p := activePlugin
+	activePluginLock.RUnlock()
+	if p == nil {
+		return nil, nil, dnsfilter.ClientInfo{}, fmt.Errorf("DNS server is not running")
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+	if p.d == nil {
+		return nil, nil, dnsfilter.ClientInfo{}, fmt.Errorf("DNS server is shutting down")
+	}
+	d := p.d
+	clientInfo := dnsfilter.ClientInfo{}
+	if len(client) != 0 {
+		if net.ParseIP(client) != nil {
+			d, clientInfo = p.getDnsfilter(client)
+		} else {
+			profile := p.findClientByName(client)
+			if profile == nil {
+				return nil, nil, dnsfilter.ClientInfo{}, fmt.Errorf("client %s is neither an IP address nor a known client name", client)
+			}
+			d = profile.d
+			clientInfo.Name = profile.Name
+		}
+	}
+	return p, d, clientInfo, nil
+}
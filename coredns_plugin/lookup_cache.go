@@ -0,0 +1,81 @@
+package dnsfilter
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+const lookupCacheSavePeriod = time.Minute * 10 // save the caches periodically in case the process is killed
+
+var (
+	lookupCacheFile     string        // where safebrowsing and parental caches are saved, empty if they aren't saved
+	lookupCacheSaveStop chan struct{} // stops the periodic saving, nil if it isn't running
+	lookupCacheFileLock sync.Mutex
+	onceLookupCache     sync.Once
+)
+
+// setupLookupCaches applies the cache parameters of the plugin
+// on the first call it also loads the caches saved by the previous process and starts saving them periodically
+func setupLookupCaches(settings plugSettings) {
+	dnsfilter.SetLookupCacheParameters(settings.LookupCacheSize, settings.LookupCacheTTL)
+
+	lookupCacheFileLock.Lock()
+	lookupCacheFile = settings.LookupCacheFile
+	lookupCacheFileLock.Unlock()
+	if len(settings.LookupCacheFile) == 0 {
+		return
+	}
+
+	onceLookupCache.Do(func() {
+		err := dnsfilter.LoadLookupCaches(settings.LookupCacheFile)
+		if err != nil {
+			// not fatal, the caches will be filled again
+			log.Printf("Failed to load safebrowsing and parental caches: %s", err)
+		}
+	})
+
+	lookupCacheFileLock.Lock()
+	if lookupCacheSaveStop == nil {
+		lookupCacheSaveStop = make(chan struct{})
+		go periodicLookupCacheSave(lookupCacheSaveStop)
+	}
+	lookupCacheFileLock.Unlock()
+}
+
+// stopLookupCacheSave stops saving the caches periodically, it's called on the final shutdown
+func stopLookupCacheSave() {
+	lookupCacheFileLock.Lock()
+	if lookupCacheSaveStop != nil {
+		close(lookupCacheSaveStop)
+		lookupCacheSaveStop = nil
+	}
+	lookupCacheFileLock.Unlock()
+}
+
+func saveLookupCaches() {
+	lookupCacheFileLock.Lock()
+	defer lookupCacheFileLock.Unlock()
+	if len(lookupCacheFile) == 0 {
+		return
+	}
+	err := dnsfilter.SaveLookupCaches(lookupCacheFile)
+	if err != nil {
+		log.Printf("Failed to save safebrowsing and parental caches: %s", err)
+	}
+}
+
+func periodicLookupCacheSave(stop chan struct{}) {
+	ticker := time.NewTicker(lookupCacheSavePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			saveLookupCaches()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package dnsfilter
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/whitehat/whitehat/dnsfilter"
+	whitehatupstream "github.com/whitehat/whitehat/upstream"
+	"golang.org/x/net/context"
+)
+
+var (
+	// the client label is empty unless it's enabled with metrics_client_label, every client adds its own series
+	responsesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "dnsfilter",
+		Name:      "responses_total",
+		Help:      "Count of responses by the filtering reason, filter ID, query type, response code, client and upstream.",
+	}, []string{"reason", "filter_id", "qtype", "rcode", "client", "upstream"})
+
+	checkHostDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "dnsfilter",
+		Name:      "check_host_duration_seconds",
+		Help:      "Histogram of the time (in seconds) the filtering of a host took, by the safebrowsing and parental network lookups that weren't cached.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 10),
+	}, []string{"lookup"})
+)
+
+// descriptions of the stats that are collected on every scrape, they don't change so they're created once
+var (
+	statsDescs     = map[string]*prometheus.Desc{}
+	statsDescsLock sync.Mutex
+)
+
+func statsDesc(name string, text string) *prometheus.Desc {
+	statsDescsLock.Lock()
+	defer statsDescsLock.Unlock()
+	desc, ok := statsDescs[name]
+	if !ok {
+		desc = prometheus.NewDesc(name, text, nil, nil)
+		statsDescs[name] = desc
+	}
+	return desc
+}
+
+// withServedBy returns the context in which the upstream plugin records the upstream that answered the request
+func withServedBy(ctx context.Context) (context.Context, *string) {
+	return whitehatupstream.WithServedBy(ctx)
+}
+
+// checkHostTimed is checkHost that also observes how long the check took
+func (p *plug) checkHostTimed(ctx context.Context, d *dnsfilter.Dnsfilter, host string, qtype uint16, clientInfo dnsfilter.ClientInfo) (dnsfilter.Result, error) {
+	trace := &dnsfilter.LookupTrace{}
+	start := time.Now()
+	result, err := p.checkHost(dnsfilter.WithLookupTrace(ctx, trace), d, host, qtype, clientInfo)
+	checkHostDuration.WithLabelValues(lookupLabel(trace)).Observe(time.Since(start).Seconds())
+	return result, err
+}
+
+func lookupLabel(trace *dnsfilter.LookupTrace) string {
+	switch {
+	case trace.Safebrowsing && trace.Parental:
+		return "safebrowsing_parental"
+	case trace.Safebrowsing:
+		return "safebrowsing"
+	case trace.Parental:
+		return "parental"
+	}
+	return "none"
+}
+
+// observeResponse counts the response in responsesTotal
+// answer is the response written by the plugins, it's nil if the response was written by ServeDNS with rcode
+func (p *plug) observeResponse(r *dns.Msg, answer *dns.Msg, rcode int, result dnsfilter.Result, err error, ip string, servedBy string) {
+	reason := result.Reason.String()
+	if err != nil {
+		reason = dnsfilter.NotFilteredError.String()
+	}
+	filterID := ""
+	if isRuleResult(result) {
+		filterID = strconv.FormatInt(result.FilterID, 10)
+	}
+	qtype := "other"
+	if len(r.Question) == 1 {
+		if name, ok := dns.TypeToString[r.Question[0].Qtype]; ok {
+			qtype = name
+		}
+	}
+	if answer != nil {
+		rcode = answer.Rcode
+	}
+	rcodeName, ok := dns.RcodeToString[rcode]
+	if !ok {
+		rcodeName = strconv.Itoa(rcode)
+	}
+	client := ""
+	if p.settings.MetricsClientLabel {
+		client = p.anonymizeIP(ip)
+	}
+	responsesTotal.WithLabelValues(reason, filterID, qtype, rcodeName, client, servedBy).Inc()
+}
@@ -0,0 +1,96 @@
+package dnsfilter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// responsesCount returns the value of responsesTotal with the labels
+func responsesCount(t *testing.T, labels ...string) float64 {
+	counter, err := responsesTotal.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &dto.Metric{}
+	err = counter.Write(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestObserveResponse(t *testing.T) {
+	// the address of test.ResponseWriter
+	const clientIP = "10.240.0.1"
+	blocked := dnsfilter.FilteredBlackList.String()
+	passed := dnsfilter.NotFilteredNotFound.String()
+	tests := []struct {
+		name        string
+		host        string
+		clientLabel bool
+		labels      []string // reason, filter_id, qtype, rcode, client, upstream
+	}{
+		{"filtered", "ads.example.org", false, []string{blocked, "1", "A", "NXDOMAIN", "", ""}},
+		{"unfiltered", "example.org", false, []string{passed, "", "A", "NOERROR", "", ""}},
+		{"filtered with client", "ads.example.org", true, []string{blocked, "1", "A", "NXDOMAIN", clientIP, ""}},
+		{"unfiltered with client", "example.org", true, []string{passed, "", "A", "NOERROR", clientIP, ""}},
+	}
+	for _, tc := range tests {
+		p := &plug{settings: defaultPluginSettings, d: dnsfilter.New()}
+		p.settings.MetricsClientLabel = tc.clientLabel
+		err := p.d.AddRule("||ads.example.org^", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			return dns.RcodeSuccess, w.WriteMsg(m)
+		})
+
+		// the client label is the other one's, so that the test sees if it's set when it mustn't be
+		other := append([]string(nil), tc.labels...)
+		if tc.clientLabel {
+			other[4] = ""
+		} else {
+			other[4] = clientIP
+		}
+		before, otherBefore := responsesCount(t, tc.labels...), responsesCount(t, other...)
+
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(tc.host), dns.TypeA)
+		_, err = p.ServeDNS(context.Background(), &test.ResponseWriter{}, r)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if got := responsesCount(t, tc.labels...) - before; got != 1 {
+			t.Errorf("%s: expected the response counted with %v, got %v", tc.name, tc.labels, got)
+		}
+		if got := responsesCount(t, other...) - otherBefore; got != 0 {
+			t.Errorf("%s: expected no response counted with %v, got %v", tc.name, other, got)
+		}
+	}
+}
+
+func TestLookupLabel(t *testing.T) {
+	tests := []struct {
+		trace dnsfilter.LookupTrace
+		label string
+	}{
+		{dnsfilter.LookupTrace{}, "none"},
+		{dnsfilter.LookupTrace{Safebrowsing: true}, "safebrowsing"},
+		{dnsfilter.LookupTrace{Parental: true}, "parental"},
+		{dnsfilter.LookupTrace{Safebrowsing: true, Parental: true}, "safebrowsing_parental"},
+	}
+	for _, tc := range tests {
+		if got := lookupLabel(&tc.trace); got != tc.label {
+			t.Errorf("%+v: expected %s, got %s", tc.trace, tc.label, got)
+		}
+	}
+}
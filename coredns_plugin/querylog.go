@@ -21,10 +21,10 @@ import (
 const (
 	logBufferCap           = 5000            // maximum capacity of logBuffer before it's flushed to disk
 	queryLogTimeLimit      = time.Hour * 24  // how far in the past we care about querylogs
-	queryLogRotationPeriod = time.Hour * 24  // rotate the log every 24 hours
-	queryLogFileName       = "querylog.json" // .gz added during compression
+	queryLogFileName       = "querylog.json" // older versions kept the log in it, it's imported into the store
 	queryLogSize           = 5000            // maximum API response for /querylog
 	queryLogTopSize        = 500             // Keep in memory only top N values
+	queryLogClientTopSize  = 200             // Keep in memory only top N values of each client
 )
 
 var (
@@ -64,6 +64,13 @@ func logRequest(question *dns.Msg, answer *dns.Msg, result dnsfilter.Result, ela
 		}
 	}
 
+	if result.DNSRewrite != nil {
+		// the synthesized records are already in the answer
+		rewrite := *result.DNSRewrite
+		rewrite.Answer = nil
+		result.DNSRewrite = &rewrite
+	}
+
 	now := time.Now()
 	entry := logEntry{
 		Question: q,
@@ -90,6 +97,9 @@ func logRequest(question *dns.Msg, answer *dns.Msg, result dnsfilter.Result, ela
 	}
 	queryLogLock.Unlock()
 
+	// pass it to the live streams, it never waits for them
+	publishLogEntry(&entry)
+
 	// add it to running top
 	err = runningTop.addEntry(&entry, question, now)
 	if err != nil {
@@ -99,14 +109,18 @@ func logRequest(question *dns.Msg, answer *dns.Msg, result dnsfilter.Result, ela
 
 	// if buffer needs to be flushed to disk, do it now
 	if len(flushBuffer) > 0 {
-		// write to file
-		// do it in separate goroutine -- we are stalling DNS response this whole time
-		go flushToFile(flushBuffer)
+		// the writer goroutine does it -- we are stalling DNS response this whole time
+		queueFlush(flushBuffer)
 	}
 }
 
-//noinspection GoUnusedParameter
+// HandleQueryLog returns the recent entries, or searches all of the query log if any of the search parameters is set
 func HandleQueryLog(w http.ResponseWriter, r *http.Request) {
+	if isQueryLogSearch(r.URL.Query()) {
+		handleQueryLogSearch(w, r)
+		return
+	}
+
 	queryLogLock.RLock()
 	values := make([]*logEntry, len(queryLogCache))
 	copy(values, queryLogCache)
@@ -119,93 +133,7 @@ func HandleQueryLog(w http.ResponseWriter, r *http.Request) {
 
 	var data = []map[string]interface{}{}
 	for _, entry := range values {
-		var q *dns.Msg
-		var a *dns.Msg
-
-		if len(entry.Question) > 0 {
-			q = new(dns.Msg)
-			if err := q.Unpack(entry.Question); err != nil {
-				// ignore, log and move on
-				log.Printf("Failed to unpack dns message question: %s", err)
-				q = nil
-			}
-		}
-		if len(entry.Answer) > 0 {
-			a = new(dns.Msg)
-			if err := a.Unpack(entry.Answer); err != nil {
-				// ignore, log and move on
-				log.Printf("Failed to unpack dns message question: %s", err)
-				a = nil
-			}
-		}
-
-		jsonEntry := map[string]interface{}{
-			"reason":     entry.Result.Reason.String(),
-			"elapsedMs": strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
-			"time":       entry.Time.Format(time.RFC3339),
-			"client":     entry.IP,
-		}
-		if q != nil {
-			jsonEntry["question"] = map[string]interface{}{
-				"host":  strings.ToLower(strings.TrimSuffix(q.Question[0].Name, ".")),
-				"type":  dns.Type(q.Question[0].Qtype).String(),
-				"class": dns.Class(q.Question[0].Qclass).String(),
-			}
-		}
-
-		if a != nil {
-			status, _ := response.Typify(a, time.Now().UTC())
-			jsonEntry["status"] = status.String()
-		}
-		if len(entry.Result.Rule) > 0 {
-			jsonEntry["rule"] = entry.Result.Rule
-			jsonEntry["filterId"] = entry.Result.FilterID
-		}
-
-		if a != nil && len(a.Answer) > 0 {
-			var answers = []map[string]interface{}{}
-			for _, k := range a.Answer {
-				header := k.Header()
-				answer := map[string]interface{}{
-					"type": dns.TypeToString[header.Rrtype],
-					"ttl":  header.Ttl,
-				}
-				// try most common record types
-				switch v := k.(type) {
-				case *dns.A:
-					answer["value"] = v.A
-				case *dns.AAAA:
-					answer["value"] = v.AAAA
-				case *dns.MX:
-					answer["value"] = fmt.Sprintf("%v %v", v.Preference, v.Mx)
-				case *dns.CNAME:
-					answer["value"] = v.Target
-				case *dns.NS:
-					answer["value"] = v.Ns
-				case *dns.SPF:
-					answer["value"] = v.Txt
-				case *dns.TXT:
-					answer["value"] = v.Txt
-				case *dns.PTR:
-					answer["value"] = v.Ptr
-				case *dns.SOA:
-					answer["value"] = fmt.Sprintf("%v %v %v %v %v %v %v", v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl)
-				case *dns.CAA:
-					answer["value"] = fmt.Sprintf("%v %v \"%v\"", v.Flag, v.Tag, v.Value)
-				case *dns.HINFO:
-					answer["value"] = fmt.Sprintf("\"%v\" \"%v\"", v.Cpu, v.Os)
-				case *dns.RRSIG:
-					answer["value"] = fmt.Sprintf("%v %v %v %v %v %v %v %v %v", dns.TypeToString[v.TypeCovered], v.Algorithm, v.Labels, v.OrigTtl, v.Expiration, v.Inception, v.KeyTag, v.SignerName, v.Signature)
-				default:
-					// type unknown, marshall it as-is
-					answer["value"] = v
-				}
-				answers = append(answers, answer)
-			}
-			jsonEntry["answer"] = answers
-		}
-
-		data = append(data, jsonEntry)
+		data = append(data, logEntryToJSON(entry))
 	}
 
 	jsonVal, err := json.Marshal(data)
@@ -225,6 +153,108 @@ func HandleQueryLog(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// logEntryToJSON converts the entry to the JSON-friendly map the web interface expects
+func logEntryToJSON(entry *logEntry) map[string]interface{} {
+	var q *dns.Msg
+	var a *dns.Msg
+
+	if len(entry.Question) > 0 {
+		q = new(dns.Msg)
+		if err := q.Unpack(entry.Question); err != nil {
+			// ignore, log and move on
+			log.Printf("Failed to unpack dns message question: %s", err)
+			q = nil
+		}
+	}
+	if len(entry.Answer) > 0 {
+		a = new(dns.Msg)
+		if err := a.Unpack(entry.Answer); err != nil {
+			// ignore, log and move on
+			log.Printf("Failed to unpack dns message question: %s", err)
+			a = nil
+		}
+	}
+
+	jsonEntry := map[string]interface{}{
+		"reason":     entry.Result.Reason.String(),
+		"elapsedMs": strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
+		"time":       entry.Time.Format(time.RFC3339),
+		"client":     entry.IP,
+	}
+	if q != nil {
+		host := strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+		jsonEntry["question"] = map[string]interface{}{
+			"host":  host,
+			"type":  dns.Type(q.Question[0].Qtype).String(),
+			"class": dns.Class(q.Question[0].Qclass).String(),
+		}
+		if t := findTracker(host); t != nil {
+			jsonEntry["tracker"] = t
+		}
+	}
+
+	if a != nil {
+		status, _ := response.Typify(a, time.Now().UTC())
+		jsonEntry["status"] = status.String()
+	}
+	if len(entry.Result.Rule) > 0 {
+		jsonEntry["rule"] = entry.Result.Rule
+		jsonEntry["filterId"] = entry.Result.FilterID
+	}
+	if len(entry.Result.CNAMEChain) > 0 {
+		jsonEntry["cnameChain"] = entry.Result.CNAMEChain
+	}
+	if len(entry.Result.ServiceID) > 0 {
+		jsonEntry["serviceId"] = entry.Result.ServiceID
+		jsonEntry["serviceName"] = getBlockedServiceName(entry.Result.ServiceID)
+	}
+
+	if a != nil && len(a.Answer) > 0 {
+		var answers = []map[string]interface{}{}
+		for _, k := range a.Answer {
+			header := k.Header()
+			answer := map[string]interface{}{
+				"type": dns.TypeToString[header.Rrtype],
+				"ttl":  header.Ttl,
+			}
+			// try most common record types
+			switch v := k.(type) {
+			case *dns.A:
+				answer["value"] = v.A
+			case *dns.AAAA:
+				answer["value"] = v.AAAA
+			case *dns.MX:
+				answer["value"] = fmt.Sprintf("%v %v", v.Preference, v.Mx)
+			case *dns.CNAME:
+				answer["value"] = v.Target
+			case *dns.NS:
+				answer["value"] = v.Ns
+			case *dns.SPF:
+				answer["value"] = v.Txt
+			case *dns.TXT:
+				answer["value"] = v.Txt
+			case *dns.PTR:
+				answer["value"] = v.Ptr
+			case *dns.SOA:
+				answer["value"] = fmt.Sprintf("%v %v %v %v %v %v %v", v.Ns, v.Mbox, v.Serial, v.Refresh, v.Retry, v.Expire, v.Minttl)
+			case *dns.CAA:
+				answer["value"] = fmt.Sprintf("%v %v \"%v\"", v.Flag, v.Tag, v.Value)
+			case *dns.HINFO:
+				answer["value"] = fmt.Sprintf("\"%v\" \"%v\"", v.Cpu, v.Os)
+			case *dns.RRSIG:
+				answer["value"] = fmt.Sprintf("%v %v %v %v %v %v %v %v %v", dns.TypeToString[v.TypeCovered], v.Algorithm, v.Labels, v.OrigTtl, v.Expiration, v.Inception, v.KeyTag, v.SignerName, v.Signature)
+			default:
+				// type unknown, marshall it as-is
+				answer["value"] = v
+			}
+			answers = append(answers, answer)
+		}
+		jsonEntry["answer"] = answers
+	}
+
+	return jsonEntry
+}
+
 func trace(format string, args ...interface{}) {
 	pc := make([]uintptr, 10) // at least 1 entry needed
 	runtime.Callers(2, pc)
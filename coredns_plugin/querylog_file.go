@@ -1,257 +1,534 @@
 package dnsfilter
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
-
-	"github.com/go-test/deep"
 )
 
-var (
-	fileWriteLock sync.Mutex
+// The query log is kept in segments, one file for each hour, named like querylog-2019-01-31T15.json(.gz)
+// Next to each segment there's its index with the times of the first and the last entries and the clients,
+// so that the segments that can't have the entries being looked for aren't read at all
+const (
+	queryLogSegmentPeriod     = time.Hour
+	queryLogSegmentPrefix     = "querylog-"
+	queryLogSegmentTimeFormat = "2006-01-02T15"
+	queryLogSegmentExt        = ".json"
+	queryLogGzipExt           = ".gz" // appended to compressed segments, each flush adds a gzip member
+	queryLogIndexExt          = ".idx"
+	queryLogCleanupPeriod     = time.Hour // how often old segments are removed if nothing is written
+	queryLogMaxLineSize       = 1 << 20   // longer lines are broken, packed messages are at most 64KB
 )
 
-const enableGzip = false
+// queryLogSegment is the index of a segment file
+type queryLogSegment struct {
+	name    string
+	Start   time.Time      `json:"start"` // the beginning of the hour the segment is for
+	First   time.Time      `json:"first"`
+	Last    time.Time      `json:"last"`
+	Count   int            `json:"count"`
+	Size    int64          `json:"size"`    // of the segment file, the index is rebuilt if it doesn't match
+	Clients map[string]int `json:"clients"` // number of entries by client IP
+}
 
-func flushToFile(buffer []*logEntry) error {
-	if len(buffer) == 0 {
-		return nil
-	}
-	start := time.Now()
+// queryLogStore is the directory with the segments
+type queryLogStore struct {
+	sync.Mutex
+	dir       string
+	compress  bool
+	retention time.Duration // segments older than it are removed, 0 means no limit
+	maxSize   int64         // oldest segments are removed when the total size exceeds it, 0 means no limit
+	opened    bool
+	segments  []*queryLogSegment // oldest first
+}
 
-	var b bytes.Buffer
-	e := json.NewEncoder(&b)
-	for _, entry := range buffer {
-		err := e.Encode(entry)
-		if err != nil {
-			log.Printf("Failed to marshal entry: %s", err)
-			return err
-		}
+var queryLogFiles = &queryLogStore{}
+
+// setupQueryLogStore applies the query log settings of the plugin, the segments are scanned on the first use
+func setupQueryLogStore(settings plugSettings) {
+	queryLogFiles.Lock()
+	defer queryLogFiles.Unlock()
+	if queryLogFiles.dir != settings.QueryLogDir {
+		queryLogFiles.dir = settings.QueryLogDir
+		queryLogFiles.opened = false
+		queryLogFiles.segments = nil
 	}
+	queryLogFiles.compress = settings.QueryLogCompress
+	queryLogFiles.retention = settings.QueryLogRetention
+	queryLogFiles.maxSize = settings.QueryLogMaxSize
+}
 
-	elapsed := time.Since(start)
-	log.Printf("%d elements serialized via json in %v: %d kB, %v/entry, %v/entry", len(buffer), elapsed, b.Len()/1024, float64(b.Len())/float64(len(buffer)), elapsed/time.Duration(len(buffer)))
+func (s *queryLogStore) segmentPath(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+// open scans the directory and imports the query log files of the older versions, s must be locked
+func (s *queryLogStore) open() {
+	if s.opened {
+		return
+	}
+	s.opened = true
+	s.segments = nil
 
-	err := checkBuffer(buffer, b)
+	err := os.MkdirAll(s.dir, 0755)
 	if err != nil {
-		log.Printf("failed to check buffer: %s", err)
-		return err
+		log.Printf("Failed to create query log directory %s: %s", s.dir, err)
+		return
 	}
 
-	var zb bytes.Buffer
-	filename := queryLogFileName
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Failed to read query log directory %s: %s", s.dir, err)
+		return
+	}
+	for _, file := range files {
+		start, ok := parseQueryLogSegmentName(file.Name())
+		if !ok {
+			continue
+		}
+		seg := s.loadIndex(file.Name(), file.Size())
+		if seg == nil {
+			seg = s.rebuildIndex(file.Name(), start)
+		}
+		s.segments = append(s.segments, seg)
+	}
+	s.sortSegments()
 
-	// gzip enabled?
-	if enableGzip {
-		filename += ".gz"
+	s.importLegacyFiles()
+	s.cleanup(time.Now())
+}
 
-		zw := gzip.NewWriter(&zb)
-		zw.Name = queryLogFileName
-		zw.ModTime = time.Now()
+// returns the hour of the segment, ok is false if it's not a segment file
+func parseQueryLogSegmentName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, queryLogSegmentPrefix) {
+		return time.Time{}, false
+	}
+	name = strings.TrimPrefix(name, queryLogSegmentPrefix)
+	name = strings.TrimSuffix(name, queryLogGzipExt)
+	if !strings.HasSuffix(name, queryLogSegmentExt) {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(queryLogSegmentTimeFormat, strings.TrimSuffix(name, queryLogSegmentExt))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return start, true
+}
 
-		_, err = zw.Write(b.Bytes())
-		if err != nil {
-			log.Printf("Couldn't compress to gzip: %s", err)
-			zw.Close()
-			return err
+func (s *queryLogStore) sortSegments() {
+	sort.Slice(s.segments, func(i, j int) bool {
+		if s.segments[i].Start.Equal(s.segments[j].Start) {
+			return s.segments[i].name < s.segments[j].name
 		}
+		return s.segments[i].Start.Before(s.segments[j].Start)
+	})
+}
 
-		if err = zw.Close(); err != nil {
-			log.Printf("Couldn't close gzip writer: %s", err)
-			return err
-		}
-	} else {
-		zb = b
+// loads the index of the segment, returns nil if there's none or if it's out of date
+func (s *queryLogStore) loadIndex(name string, size int64) *queryLogSegment {
+	body, err := ioutil.ReadFile(s.segmentPath(name + queryLogIndexExt))
+	if err != nil {
+		return nil
 	}
+	seg := &queryLogSegment{}
+	err = json.Unmarshal(body, seg)
+	if err != nil || seg.Size != size {
+		return nil
+	}
+	seg.name = name
+	if seg.Clients == nil {
+		seg.Clients = map[string]int{}
+	}
+	return seg
+}
 
-	fileWriteLock.Lock()
-	defer fileWriteLock.Unlock()
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+// rebuildIndex reads the whole segment to index it, e.g. if the process was killed before the index was saved
+func (s *queryLogStore) rebuildIndex(name string, start time.Time) *queryLogSegment {
+	seg := &queryLogSegment{name: name, Start: start, Clients: map[string]int{}}
+	err := readQueryLogFile(s.segmentPath(name), func(entry *logEntry) error {
+		seg.add(entry)
+		return nil
+	})
 	if err != nil {
-		log.Printf("failed to create file \"%s\": %s", filename, err)
-		return err
+		log.Printf("Failed to read query log segment %s: %s", name, err)
 	}
-	defer f.Close()
+	if info, err := os.Stat(s.segmentPath(name)); err == nil {
+		seg.Size = info.Size()
+	}
+	s.saveIndex(seg)
+	return seg
+}
 
-	n, err := f.Write(zb.Bytes())
+func (s *queryLogStore) saveIndex(seg *queryLogSegment) {
+	body, err := json.Marshal(seg)
 	if err != nil {
-		log.Printf("Couldn't write to file: %s", err)
-		return err
+		log.Printf("Failed to marshal query log index: %s", err)
+		return
+	}
+	path := s.segmentPath(seg.name + queryLogIndexExt)
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, body, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		log.Printf("Failed to save query log index %s: %s", path, err)
 	}
-
-	log.Printf("ok \"%s\": %v bytes written", filename, n)
-
-	return nil
 }
 
-func checkBuffer(buffer []*logEntry, b bytes.Buffer) error {
-	l := len(buffer)
-	d := json.NewDecoder(&b)
+func (seg *queryLogSegment) add(entry *logEntry) {
+	if seg.Count == 0 || entry.Time.Before(seg.First) {
+		seg.First = entry.Time
+	}
+	if seg.Count == 0 || entry.Time.After(seg.Last) {
+		seg.Last = entry.Time
+	}
+	seg.Count++
+	seg.Clients[entry.IP]++
+}
 
-	i := 0
-	for d.More() {
-		entry := &logEntry{}
-		err := d.Decode(entry)
+// imports querylog.json and querylog.json.1 that older versions kept in the working directory
+func (s *queryLogStore) importLegacyFiles() {
+	for _, name := range []string{queryLogFileName + ".1", queryLogFileName, queryLogFileName + ".gz.1", queryLogFileName + ".gz"} {
+		if _, err := os.Stat(name); err != nil {
+			continue
+		}
+		var entries []*logEntry
+		err := readQueryLogFile(name, func(entry *logEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
 		if err != nil {
-			log.Printf("Failed to decode: %s", err)
-			return err
+			log.Printf("Failed to read old query log %s: %s", name, err)
 		}
-		if diff := deep.Equal(entry, buffer[i]); diff != nil {
-			log.Printf("decoded buffer differs: %s", diff)
-			return fmt.Errorf("decoded buffer differs: %s", diff)
+		err = s.write(entries)
+		if err != nil {
+			log.Printf("Failed to import old query log %s: %s", name, err)
+			continue
 		}
-		i++
-	}
-	if i != l {
-		err := fmt.Errorf("check fail: %d vs %d entries", l, i)
-		log.Print(err)
-		return err
+		err = os.Remove(name)
+		if err != nil {
+			log.Printf("Failed to remove old query log %s: %s", name, err)
+			continue
+		}
+		log.Printf("Imported %d entries from old query log %s", len(entries), name)
 	}
-	log.Printf("check ok: %d entries", i)
+}
 
-	return nil
+// queryLogFlush is a buffer of entries queued for writing, done receives the result if it's not nil
+type queryLogFlush struct {
+	entries []*logEntry
+	done    chan error
 }
 
-func rotateQueryLog() error {
-	from := queryLogFileName
-	to := queryLogFileName + ".1"
+const queryLogFlushQueueSize = 16 // buffers waiting to be written, the newer ones are dropped if the disk is that slow
 
-	if enableGzip {
-		from = queryLogFileName + ".gz"
-		to = queryLogFileName + ".gz.1"
+var (
+	queryLogFlushes    = make(chan queryLogFlush, queryLogFlushQueueSize)
+	onceQueryLogWriter sync.Once
+)
+
+// queueFlush passes the entries to the writer and returns right away, the DNS response mustn't wait for the disk
+func queueFlush(buffer []*logEntry) {
+	onceQueryLogWriter.Do(func() {
+		go queryLogWriter()
+	})
+	select {
+	case queryLogFlushes <- queryLogFlush{entries: buffer}:
+	default:
+		log.Printf("Query log writer is too slow, dropped %d entries", len(buffer))
 	}
+}
 
-	if _, err := os.Stat(from); os.IsNotExist(err) {
-		// do nothing, file doesn't exist
-		return nil
+// flushAndWait passes the entries to the writer and waits until they're written with the ones queued before them
+func flushAndWait(buffer []*logEntry) error {
+	onceQueryLogWriter.Do(func() {
+		go queryLogWriter()
+	})
+	done := make(chan error, 1)
+	queryLogFlushes <- queryLogFlush{entries: buffer, done: done}
+	return <-done
+}
+
+// queryLogWriter writes the queued buffers one by one, so that they're written in the order they were flushed
+func queryLogWriter() {
+	for flush := range queryLogFlushes {
+		err := flushToStore(flush.entries)
+		if flush.done != nil {
+			flush.done <- err
+		}
 	}
+}
 
-	err := os.Rename(from, to)
+// flushToStore writes the entries to their segments and removes the segments that are too old
+func flushToStore(buffer []*logEntry) error {
+	if len(buffer) == 0 {
+		return nil
+	}
+	start := time.Now()
+	queryLogFiles.Lock()
+	defer queryLogFiles.Unlock()
+	queryLogFiles.open()
+	err := queryLogFiles.write(buffer)
 	if err != nil {
-		log.Printf("Failed to rename querylog: %s", err)
+		log.Printf("Failed to write query log: %s", err)
 		return err
 	}
-
-	log.Printf("Rotated from %s to %s successfully", from, to)
-
+	queryLogFiles.cleanup(time.Now())
+	log.Printf("%d query log entries written in %v", len(buffer), time.Since(start))
 	return nil
 }
 
-func periodicQueryLogRotate() {
-	for range time.Tick(queryLogRotationPeriod) {
-		err := rotateQueryLog()
+// write appends the entries to the segments of their hours, s must be locked
+func (s *queryLogStore) write(entries []*logEntry) error {
+	// entries are usually in order, but the buffer can span an hour boundary
+	groups := map[time.Time][]*logEntry{}
+	starts := []time.Time{}
+	for _, entry := range entries {
+		start := entry.Time.UTC().Truncate(queryLogSegmentPeriod)
+		if _, ok := groups[start]; !ok {
+			starts = append(starts, start)
+		}
+		groups[start] = append(groups[start], entry)
+	}
+
+	for _, start := range starts {
+		name := queryLogSegmentPrefix + start.Format(queryLogSegmentTimeFormat) + queryLogSegmentExt
+		if s.compress {
+			name += queryLogGzipExt
+		}
+		seg := s.findSegment(name)
+		if seg == nil {
+			seg = &queryLogSegment{name: name, Start: start, Clients: map[string]int{}}
+			s.segments = append(s.segments, seg)
+			s.sortSegments()
+		}
+
+		data, err := encodeQueryLogEntries(groups[start], s.compress)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(s.segmentPath(name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			log.Printf("Failed to rotate querylog: %s", err)
-			// do nothing, continue rotating
+			return err
+		}
+		n, err := f.Write(data)
+		f.Close()
+		seg.Size += int64(n)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range groups[start] {
+			seg.add(entry)
 		}
+		s.saveIndex(seg)
 	}
+	return nil
 }
 
-func genericLoader(onEntry func(entry *logEntry) error, needMore func() bool, timeWindow time.Duration) error {
-	now := time.Now()
-	// read from querylog files, try newest file first
-	files := []string{}
+func (s *queryLogStore) findSegment(name string) *queryLogSegment {
+	for _, seg := range s.segments {
+		if seg.name == name {
+			return seg
+		}
+	}
+	return nil
+}
 
-	if enableGzip {
-		files = []string{
-			queryLogFileName + ".gz",
-			queryLogFileName + ".gz.1",
+// encodes the entries as newline-delimited JSON, compressed into a single gzip member if needed
+func encodeQueryLogEntries(entries []*logEntry, compress bool) ([]byte, error) {
+	var b bytes.Buffer
+	var w io.Writer = &b
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(&b)
+		w = zw
+	}
+	e := json.NewEncoder(w)
+	for _, entry := range entries {
+		err := e.Encode(entry)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		files = []string{
-			queryLogFileName,
-			queryLogFileName + ".1",
+	}
+	if zw != nil {
+		err := zw.Close()
+		if err != nil {
+			return nil, err
 		}
 	}
+	return b.Bytes(), nil
+}
 
-	// read from all files
-	for _, file := range files {
-		if !needMore() {
+// cleanup removes the segments that are out of the retention period, then the oldest ones
+// until the total size is within the limit, s must be locked
+func (s *queryLogStore) cleanup(now time.Time) {
+	var size int64
+	for _, seg := range s.segments {
+		size += seg.Size
+	}
+	for len(s.segments) != 0 {
+		seg := s.segments[0]
+		tooOld := s.retention != 0 && now.Sub(seg.Start.Add(queryLogSegmentPeriod)) > s.retention
+		// the newest segment is always kept, otherwise a single big hour would remove itself
+		tooBig := s.maxSize != 0 && size > s.maxSize && len(s.segments) > 1
+		if !tooOld && !tooBig {
 			break
 		}
-		if _, err := os.Stat(file); os.IsNotExist(err) {
-			// do nothing, file doesn't exist
+		err := os.Remove(s.segmentPath(seg.name))
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove query log segment %s: %s", seg.name, err)
+			break
+		}
+		os.Remove(s.segmentPath(seg.name + queryLogIndexExt))
+		size -= seg.Size
+		s.segments = s.segments[1:]
+		log.Printf("Removed query log segment %s", seg.name)
+	}
+}
+
+// find returns the copies of the indexes of the segments that can have the entries
+// from the specified time range and client, zero times and empty client mean no limits
+func (s *queryLogStore) find(since, until time.Time, client string) []queryLogSegment {
+	s.Lock()
+	defer s.Unlock()
+	s.open()
+	found := []queryLogSegment{}
+	for _, seg := range s.segments {
+		if seg.Count == 0 {
+			continue
+		}
+		if !since.IsZero() && seg.Last.Before(since) {
+			continue
+		}
+		if !until.IsZero() && !seg.First.Before(until) {
+			continue
+		}
+		if len(client) != 0 && seg.Clients[client] == 0 {
 			continue
 		}
+		found = append(found, *seg)
+	}
+	return found
+}
+
+// read calls onEntry for each entry of the segment, oldest first
+func (s *queryLogStore) read(seg queryLogSegment, onEntry func(entry *logEntry) error) error {
+	s.Lock()
+	path := s.segmentPath(seg.name)
+	s.Unlock()
+	return readQueryLogFile(path, onEntry)
+}
+
+func readQueryLogFile(path string, onEntry func(entry *logEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	// querylog.json.gz.1 of the older versions is compressed too
+	if strings.Contains(filepath.Base(path), queryLogGzipExt) {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
 
-		f, err := os.Open(file)
+	// the entries are newline-delimited, so a broken one, e.g. from an interrupted flush, is skipped
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), queryLogMaxLineSize)
+	skipped := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		entry := &logEntry{}
+		err = json.Unmarshal(line, entry)
 		if err != nil {
-			log.Printf("Failed to open file \"%s\": %s", file, err)
-			// try next file
+			skipped++
 			continue
 		}
-		defer f.Close()
+		err = onEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+	if skipped != 0 {
+		log.Printf("Skipped %d query log entries of %s that couldn't be decoded", skipped, path)
+	}
+	err = scanner.Err()
+	if err != nil {
+		// e.g. a compressed segment is truncated, the entries before that are read already
+		log.Printf("Failed to read query log %s: %s", path, err)
+	}
+	return nil
+}
 
-		var d *json.Decoder
+func periodicQueryLogCleanup() {
+	for range time.Tick(queryLogCleanupPeriod) {
+		queryLogFiles.Lock()
+		queryLogFiles.open()
+		queryLogFiles.cleanup(time.Now())
+		queryLogFiles.Unlock()
+	}
+}
 
-		if enableGzip {
-			trace("Creating gzip reader")
-			zr, err := gzip.NewReader(f)
-			if err != nil {
-				log.Printf("Failed to create gzip reader: %s", err)
-				continue
-			}
-			defer zr.Close()
+// genericLoader calls onEntry for the entries of the last timeWindow, oldest first
+func genericLoader(onEntry func(entry *logEntry) error, needMore func() bool, timeWindow time.Duration) error {
+	now := time.Now()
+	since := now.Add(-timeWindow)
+	segments := queryLogFiles.find(since, time.Time{}, "")
 
-			trace("Creating json decoder")
-			d = json.NewDecoder(zr)
-		} else {
-			d = json.NewDecoder(f)
+	i := 0
+	for _, seg := range segments {
+		if !needMore() {
+			break
 		}
-
-		i := 0
-		over := 0
-		max := 10000 * time.Second
-		var sum time.Duration
-		// entries on file are in oldest->newest order
-		// we want maxLen newest
-		for d.More() {
+		err := queryLogFiles.read(seg, func(entry *logEntry) error {
 			if !needMore() {
-				break
-			}
-			var entry logEntry
-			err := d.Decode(&entry)
-			if err != nil {
-				log.Printf("Failed to decode: %s", err)
-				// next entry can be fine, try more
-				continue
-			}
-
-			if now.Sub(entry.Time) > timeWindow {
-				// trace("skipping entry") // debug logging
-				continue
+				return errStopReading
 			}
-
-			if entry.Elapsed > max {
-				over++
-			} else {
-				sum += entry.Elapsed
+			if entry.Time.Before(since) {
+				return nil
 			}
-
 			i++
-			err = onEntry(&entry)
-			if err != nil {
-				return err
-			}
+			return onEntry(entry)
+		})
+		if err == errStopReading {
+			break
 		}
-		elapsed := time.Since(now)
-		var perunit time.Duration
-		var avg time.Duration
-		if i > 0 {
-			perunit = elapsed / time.Duration(i)
-			avg = sum / time.Duration(i)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed by the cleanup in the meantime
+				continue
+			}
+			return err
 		}
-		log.Printf("file \"%s\": read %d entries in %v, %v/entry, %v over %v, %v avg", file, i, elapsed, perunit, over, max, avg)
 	}
+	log.Printf("query log: read %d entries from %d segments in %v", i, len(segments), time.Since(now))
 	return nil
 }
 
+// errStopReading stops reading the segments when no more entries are needed
+var errStopReading = errors.New("stop reading")
+
 func appendFromLogFile(values []*logEntry, maxLen int, timeWindow time.Duration) []*logEntry {
 	a := []*logEntry{}
 
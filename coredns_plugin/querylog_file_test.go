@@ -0,0 +1,63 @@
+package dnsfilter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadQueryLogFileSkipsBrokenLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	first, err := encodeQueryLogEntries([]*logEntry{newTestLogEntry(t, "a.example.org", "192.168.1.10", false, now)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encodeQueryLogEntries([]*logEntry{newTestLogEntry(t, "b.example.org", "192.168.1.10", false, now)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(first, []byte("{\"Question\":\"broken\n\n")...)
+	data = append(data, second...)
+	path := filepath.Join(dir, "querylog.json")
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	err = readQueryLogFile(path, func(entry *logEntry) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 entries around the broken line, got %d", count)
+	}
+}
+
+func TestFlushAndWait(t *testing.T) {
+	defer setupTestQueryLogStore(t)()
+
+	start := time.Now().UTC().Truncate(time.Hour)
+	queueFlush([]*logEntry{newTestLogEntry(t, "a.example.org", "192.168.1.10", false, start)})
+	err := flushAndWait([]*logEntry{newTestLogEntry(t, "b.example.org", "192.168.1.10", false, start.Add(time.Second))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the writer handles the flushes in order, so the queued one is written by then too
+	hosts := searchTestQueryLog(t, "limit=10")
+	if len(hosts) != 2 || hosts[0] != "b.example.org" || hosts[1] != "a.example.org" {
+		t.Fatalf("expected both flushes to be written, got %v", hosts)
+	}
+}
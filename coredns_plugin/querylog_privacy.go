@@ -0,0 +1,121 @@
+package dnsfilter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// how client addresses are written to the query log and to the top clients
+const (
+	anonymizeNone     = "none"
+	anonymizeTruncate = "truncate" // keep only the /24 network of IPv4 and the /48 network of IPv6 addresses
+	anonymizeHash     = "hash"     // replace the address with its keyed hash, so that the same client can still be followed
+)
+
+const anonymizedHashLength = 16 // hex digits of the hash that are kept
+
+// parseAnonymizeMode parses the mode followed by the key for the hash mode
+func parseAnonymizeMode(args []string) (string, []byte, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("anonymization mode is missing")
+	}
+	switch args[0] {
+	case anonymizeNone, anonymizeTruncate:
+		if len(args) != 1 {
+			return "", nil, fmt.Errorf("anonymization mode %s doesn't take a key", args[0])
+		}
+		return args[0], nil, nil
+	case anonymizeHash:
+		if len(args) != 2 || len(args[1]) == 0 {
+			return "", nil, fmt.Errorf("anonymization mode %s needs a key", args[0])
+		}
+		return args[0], []byte(args[1]), nil
+	default:
+		return "", nil, fmt.Errorf("unknown anonymization mode %s", args[0])
+	}
+}
+
+// anonymizeIP returns the client address as it should be logged
+func (p *plug) anonymizeIP(ip string) string {
+	switch p.settings.QueryLogAnonymize {
+	case anonymizeTruncate:
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return ip
+		}
+		if addr4 := addr.To4(); addr4 != nil {
+			return addr4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return addr.Mask(net.CIDRMask(48, 128)).String()
+	case anonymizeHash:
+		mac := hmac.New(sha256.New, p.settings.QueryLogAnonymizeKey)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil))[:anonymizedHashLength]
+	default:
+		return ip
+	}
+}
+
+// clientList is a list of clients specified by IP addresses, networks or client profile names
+type clientList struct {
+	ips   []net.IP
+	nets  []*net.IPNet
+	names map[string]bool
+}
+
+func (l *clientList) add(id string) {
+	if ip := net.ParseIP(id); ip != nil {
+		l.ips = append(l.ips, ip)
+		return
+	}
+	if _, ipnet, err := net.ParseCIDR(id); err == nil {
+		l.nets = append(l.nets, ipnet)
+		return
+	}
+	if l.names == nil {
+		l.names = map[string]bool{}
+	}
+	l.names[id] = true
+}
+
+func (l *clientList) isEmpty() bool {
+	return len(l.ips) == 0 && len(l.nets) == 0 && len(l.names) == 0
+}
+
+// contains checks the client address and the name of its client profile, name is empty if there's no profile
+func (l *clientList) contains(ip net.IP, name string) bool {
+	if len(name) != 0 && l.names[name] {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, listed := range l.ips {
+		if listed.Equal(ip) {
+			return true
+		}
+	}
+	for _, ipnet := range l.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isQueryLogIgnored checks if the requests of the client must not be logged
+func (p *plug) isQueryLogIgnored(ip string) bool {
+	if p.settings.QueryLogIgnored.isEmpty() {
+		return false
+	}
+	name := ""
+	p.RLock()
+	if client := p.findClient(ip); client != nil {
+		name = client.Name
+	}
+	p.RUnlock()
+	return p.settings.QueryLogIgnored.contains(net.ParseIP(ip), name)
+}
@@ -0,0 +1,108 @@
+package dnsfilter
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		mode     string
+		ip       string
+		expected string
+	}{
+		{anonymizeNone, "192.168.1.10", "192.168.1.10"},
+		{anonymizeTruncate, "192.168.1.10", "192.168.1.0"},
+		{anonymizeTruncate, "2001:db8:1234:5678::1", "2001:db8:1234::"},
+		{anonymizeTruncate, "::ffff:192.168.1.10", "192.168.1.0"},
+		{anonymizeTruncate, "not an address", "not an address"},
+	}
+	for _, tc := range tests {
+		p := &plug{settings: defaultPluginSettings}
+		p.settings.QueryLogAnonymize = tc.mode
+		if got := p.anonymizeIP(tc.ip); got != tc.expected {
+			t.Errorf("%s %s: expected %s, got %s", tc.mode, tc.ip, tc.expected, got)
+		}
+	}
+}
+
+func TestAnonymizeIPHash(t *testing.T) {
+	hash := func(key string, ip string) string {
+		p := &plug{settings: defaultPluginSettings}
+		p.settings.QueryLogAnonymize = anonymizeHash
+		p.settings.QueryLogAnonymizeKey = []byte(key)
+		return p.anonymizeIP(ip)
+	}
+
+	first := hash("key1", "192.168.1.10")
+	if len(first) != anonymizedHashLength {
+		t.Errorf("expected %d hex digits, got %s", anonymizedHashLength, first)
+	}
+	tests := []struct {
+		key   string
+		ip    string
+		equal bool
+	}{
+		{"key1", "192.168.1.10", true},
+		{"key2", "192.168.1.10", false},
+		{"key1", "192.168.1.11", false},
+	}
+	for _, tc := range tests {
+		if got := hash(tc.key, tc.ip); (got == first) != tc.equal {
+			t.Errorf("%s %s: expected equal=%v to %s, got %s", tc.key, tc.ip, tc.equal, first, got)
+		}
+	}
+	// an unparsable address is hashed too, it isn't logged as is
+	if got := hash("key1", "not an address"); got == "not an address" || len(got) != anonymizedHashLength {
+		t.Errorf("expected the unparsable address to be hashed, got %s", got)
+	}
+}
+
+func TestClientListContains(t *testing.T) {
+	list := clientList{}
+	for _, id := range []string{"192.168.1.10", "10.0.0.0/8", "kids"} {
+		list.add(id)
+	}
+	tests := []struct {
+		ip       string
+		name     string
+		contains bool
+	}{
+		{"192.168.1.10", "", true},
+		{"192.168.1.11", "", false},
+		{"10.1.2.3", "", true},
+		{"192.168.1.11", "kids", true},
+		{"192.168.1.11", "adults", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		if got := list.contains(net.ParseIP(tc.ip), tc.name); got != tc.contains {
+			t.Errorf("%s %s: expected %v, got %v", tc.ip, tc.name, tc.contains, got)
+		}
+	}
+}
+
+func TestIsQueryLogIgnored(t *testing.T) {
+	p := &plug{settings: defaultPluginSettings}
+	p.clients = []*plugClient{{Name: "kids", IPs: []net.IP{net.ParseIP("192.168.1.20")}}}
+	if p.isQueryLogIgnored("192.168.1.20") {
+		t.Error("expected nothing to be ignored with an empty list")
+	}
+
+	p.settings.QueryLogIgnored.add("kids")
+	p.settings.QueryLogIgnored.add("192.168.1.30")
+	tests := []struct {
+		ip      string
+		ignored bool
+	}{
+		{"192.168.1.20", true},
+		{"192.168.1.30", true},
+		{"192.168.1.40", false},
+		{"not an address", false},
+	}
+	for _, tc := range tests {
+		if got := p.isQueryLogIgnored(tc.ip); got != tc.ignored {
+			t.Errorf("%s: expected ignored=%v", tc.ip, tc.ignored)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package dnsfilter
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/response"
+	"github.com/miekg/dns"
+)
+
+const (
+	queryLogSearchLimit   = 500            // default number of entries in a page of search results
+	queryLogStatusBlocked = "filtered"     // status filter value matching the blocked requests
+	queryLogStatusAllowed = "not_filtered" // status filter value matching the requests that weren't blocked
+)
+
+// queryLogSearch is a query log search request, empty fields match any entry
+type queryLogSearch struct {
+	olderThan time.Time // the cursor, only entries older than it are returned
+	offset    int       // the number of the entries with the olderThan time that were returned already
+	limit     int
+	search    string // a part of the host name or of the rule
+	client    string
+	reason    string
+	qtype     uint16
+	status    string // filtered, not_filtered or a response status like NOERROR or NXDOMAIN
+}
+
+// the parameters that make /control/querylog search instead of returning the recent entries
+var queryLogSearchParams = []string{"older_than", "offset", "limit", "search", "client", "reason", "qtype", "status"}
+
+func isQueryLogSearch(q url.Values) bool {
+	for _, param := range queryLogSearchParams {
+		if _, ok := q[param]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseQueryLogSearch(q url.Values) (queryLogSearch, error) {
+	s := queryLogSearch{
+		limit:  queryLogSearchLimit,
+		search: strings.ToLower(strings.TrimSpace(q.Get("search"))),
+		client: strings.TrimSpace(q.Get("client")),
+		reason: strings.TrimSpace(q.Get("reason")),
+		status: strings.TrimSpace(q.Get("status")),
+	}
+
+	if value := q.Get("older_than"); len(value) != 0 {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return s, fmt.Errorf("older_than must be RFC3339 time: %s", err)
+		}
+		s.olderThan = t
+	}
+	if value := q.Get("offset"); len(value) != 0 {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 || s.olderThan.IsZero() {
+			return s, fmt.Errorf("offset must be a non-negative number passed with older_than")
+		}
+		s.offset = offset
+	}
+	if value := q.Get("limit"); len(value) != 0 {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > queryLogSize {
+			return s, fmt.Errorf("limit must be a number from 1 to %d", queryLogSize)
+		}
+		s.limit = limit
+	}
+	if value := q.Get("qtype"); len(value) != 0 {
+		qtype, ok := dns.StringToType[strings.ToUpper(value)]
+		if !ok {
+			return s, fmt.Errorf("unknown qtype %s", value)
+		}
+		s.qtype = qtype
+	}
+	return s, nil
+}
+
+// match checks if the entry satisfies all the conditions of the search
+// the entries with the cursor time match too, it's up to run to skip the ones that were returned already
+func (s *queryLogSearch) match(entry *logEntry) bool {
+	if !s.olderThan.IsZero() && entry.Time.After(s.olderThan) {
+		return false
+	}
+	if len(s.client) != 0 && entry.IP != s.client {
+		return false
+	}
+	if len(s.reason) != 0 && !strings.EqualFold(entry.Result.Reason.String(), s.reason) {
+		return false
+	}
+	if !s.matchStatus(entry) {
+		return false
+	}
+	if len(s.search) == 0 && s.qtype == 0 {
+		return true
+	}
+
+	q := new(dns.Msg)
+	if len(entry.Question) == 0 || q.Unpack(entry.Question) != nil || len(q.Question) == 0 {
+		return false
+	}
+	if s.qtype != 0 && q.Question[0].Qtype != s.qtype {
+		return false
+	}
+	if len(s.search) != 0 {
+		host := strings.ToLower(strings.TrimSuffix(q.Question[0].Name, "."))
+		if !strings.Contains(host, s.search) && !strings.Contains(strings.ToLower(entry.Result.Rule), s.search) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *queryLogSearch) matchStatus(entry *logEntry) bool {
+	switch {
+	case len(s.status) == 0:
+		return true
+	case strings.EqualFold(s.status, queryLogStatusBlocked):
+		return entry.Result.IsFiltered
+	case strings.EqualFold(s.status, queryLogStatusAllowed):
+		return !entry.Result.IsFiltered
+	}
+	a := new(dns.Msg)
+	if len(entry.Answer) == 0 || a.Unpack(entry.Answer) != nil {
+		return false
+	}
+	status, _ := response.Typify(a, time.Now().UTC())
+	return strings.EqualFold(status.String(), s.status)
+}
+
+// foundEntry is a search result, seq is the order in which it was read
+// the entries with the same time are in the same segment or in the buffer, so seq orders them as they were logged
+type foundEntry struct {
+	*logEntry
+	seq int
+}
+
+// newer tells if the entry goes before the other one in the results
+func (e foundEntry) newer(other foundEntry) bool {
+	if e.Time.Equal(other.Time) {
+		return e.seq > other.seq
+	}
+	return e.Time.After(other.Time)
+}
+
+// logEntryHeap keeps the newest entries, the oldest one is on top so that it's replaced first
+type logEntryHeap []foundEntry
+
+func (h logEntryHeap) Len() int            { return len(h) }
+func (h logEntryHeap) Less(i, j int) bool  { return h[j].newer(h[i]) }
+func (h logEntryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *logEntryHeap) Push(x interface{}) { *h = append(*h, x.(foundEntry)) }
+func (h *logEntryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// run returns the newest matching entries from the store and from the buffer that isn't flushed yet, newest first
+// the entries with the same time are returned in the reverse order of logging, so the cursor can skip the returned ones
+func (s *queryLogSearch) run() ([]*logEntry, error) {
+	found := &logEntryHeap{}
+	push := func(entry foundEntry) {
+		if found.Len() < s.limit {
+			heap.Push(found, entry)
+		} else if entry.newer((*found)[0]) {
+			(*found)[0] = entry
+			heap.Fix(found, 0)
+		}
+	}
+	seq := 0
+	cursorEntries := []foundEntry{} // the entries with the cursor time, the last offset of them were returned already
+	add := func(entry *logEntry) {
+		if !s.match(entry) {
+			return
+		}
+		seq++
+		if !s.olderThan.IsZero() && entry.Time.Equal(s.olderThan) {
+			cursorEntries = append(cursorEntries, foundEntry{entry, seq})
+			return
+		}
+		push(foundEntry{entry, seq})
+	}
+
+	// the segments are hours, so the newer ones have only newer entries
+	until := time.Time{}
+	if !s.olderThan.IsZero() {
+		// the segment starting at the cursor time can have the entries that weren't returned yet
+		until = s.olderThan.Add(time.Nanosecond)
+	}
+	segments := queryLogFiles.find(time.Time{}, until, s.client)
+	for i := len(segments) - 1; i >= 0; i-- {
+		seg := segments[i]
+		if found.Len() == s.limit && seg.Last.Before((*found)[0].Time) {
+			break
+		}
+		err := queryLogFiles.read(seg, func(entry *logEntry) error {
+			add(entry)
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	logBufferLock.RLock()
+	for _, entry := range logBuffer {
+		add(entry)
+	}
+	logBufferLock.RUnlock()
+
+	if s.offset < len(cursorEntries) {
+		for _, entry := range cursorEntries[:len(cursorEntries)-s.offset] {
+			push(entry)
+		}
+	}
+
+	entries := make([]*logEntry, found.Len())
+	for i := len(entries) - 1; i >= 0; i-- {
+		entries[i] = heap.Pop(found).(foundEntry).logEntry
+	}
+	return entries, nil
+}
+
+// handleQueryLogSearch returns a page of the entries matching the search, the time of the last one and the number
+// of the returned entries with that time are the cursor to be passed in older_than and offset to get the next page
+func handleQueryLogSearch(w http.ResponseWriter, r *http.Request) {
+	search, err := parseQueryLogSearch(r.URL.Query())
+	if err != nil {
+		errorText := fmt.Sprintf("Invalid query log search: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusBadRequest)
+		return
+	}
+
+	entries, err := search.run()
+	if err != nil {
+		errorText := fmt.Sprintf("Couldn't search query log: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+		return
+	}
+
+	data := []map[string]interface{}{}
+	for _, entry := range entries {
+		data = append(data, logEntryToJSON(entry))
+	}
+	result := map[string]interface{}{
+		"data": data,
+	}
+	if len(entries) == search.limit {
+		// there can be more entries, an empty cursor means that this is the last page
+		oldest := entries[len(entries)-1].Time
+		offset := 0
+		if oldest.Equal(search.olderThan) {
+			offset = search.offset
+		}
+		for _, entry := range entries {
+			if entry.Time.Equal(oldest) {
+				offset++
+			}
+		}
+		result["oldest"] = oldest.Format(time.RFC3339Nano)
+		result["offset"] = offset
+	}
+
+	jsonVal, err := json.Marshal(result)
+	if err != nil {
+		errorText := fmt.Sprintf("Couldn't marshal data into json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,119 @@
+package dnsfilter
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// newTestLogEntry creates the query log entry of the A request for host
+func newTestLogEntry(t *testing.T, host string, ip string, filtered bool, at time.Time) *logEntry {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	packed, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := dnsfilter.Result{}
+	if filtered {
+		result = dnsfilter.Result{IsFiltered: true, Reason: dnsfilter.FilteredBlackList, Rule: "||" + host + "^"}
+	}
+	return &logEntry{Question: packed, Result: result, Time: at, IP: ip}
+}
+
+// setupTestQueryLogStore makes the query log store use a temporary directory until the returned function is called
+func setupTestQueryLogStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := queryLogFiles
+	queryLogFiles = &queryLogStore{}
+	setupQueryLogStore(plugSettings{QueryLogDir: dir})
+	return func() {
+		queryLogFiles = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueryLogSearch(t *testing.T) {
+	defer setupTestQueryLogStore(t)()
+
+	// two hours of entries, the last two have the same time
+	start := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	entries := []*logEntry{
+		newTestLogEntry(t, "a.example.org", "192.168.1.10", false, start.Add(time.Minute)),
+		newTestLogEntry(t, "ads.example.org", "192.168.1.10", true, start.Add(2*time.Minute)),
+		newTestLogEntry(t, "b.example.org", "192.168.1.20", false, start.Add(61*time.Minute)),
+		newTestLogEntry(t, "ads.example.net", "192.168.1.20", true, start.Add(62*time.Minute)),
+		newTestLogEntry(t, "c.example.org", "192.168.1.10", false, start.Add(62*time.Minute)),
+	}
+	err := flushToStore(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		hosts []string
+	}{
+		{"limit=10", []string{"c.example.org", "ads.example.net", "b.example.org", "ads.example.org", "a.example.org"}},
+		{"client=192.168.1.10", []string{"c.example.org", "ads.example.org", "a.example.org"}},
+		{"status=filtered", []string{"ads.example.net", "ads.example.org"}},
+		{"search=example.org&status=not_filtered", []string{"c.example.org", "b.example.org", "a.example.org"}},
+		{"reason=FilteredBlackList&client=192.168.1.20", []string{"ads.example.net"}},
+		{"qtype=AAAA", nil},
+	}
+	for _, tc := range tests {
+		hosts := searchTestQueryLog(t, tc.query)
+		if len(hosts) != len(tc.hosts) {
+			t.Errorf("%s: expected %v, got %v", tc.query, tc.hosts, hosts)
+			continue
+		}
+		for i := range hosts {
+			if hosts[i] != tc.hosts[i] {
+				t.Errorf("%s: expected %v, got %v", tc.query, tc.hosts, hosts)
+				break
+			}
+		}
+	}
+
+	// the pages follow each other even if the cursor is in the middle of the entries with the same time
+	cursor := entries[3].Time.Format(time.RFC3339Nano)
+	hosts := searchTestQueryLog(t, "limit=1")
+	next := searchTestQueryLog(t, "limit=2&older_than="+url.QueryEscape(cursor)+"&offset=1")
+	if len(hosts) != 1 || hosts[0] != "c.example.org" || len(next) != 2 || next[0] != "ads.example.net" || next[1] != "b.example.org" {
+		t.Errorf("pages don't follow each other: %v then %v", hosts, next)
+	}
+}
+
+// searchTestQueryLog runs the search and returns the host names of the found entries
+func searchTestQueryLog(t *testing.T, query string) []string {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	search, err := parseQueryLogSearch(q)
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	found, err := search.run()
+	if err != nil {
+		t.Fatalf("%s: %s", query, err)
+	}
+	hosts := []string{}
+	for _, entry := range found {
+		m := new(dns.Msg)
+		err = m.Unpack(entry.Question)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts = append(hosts, m.Question[0].Name[:len(m.Question[0].Name)-1])
+	}
+	return hosts
+}
@@ -0,0 +1,219 @@
+package dnsfilter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	queryLogStreamBuffer    = 1000             // entries queued for a subscriber, newer ones are dropped when it's full
+	queryLogStreamMax       = 16               // maximum number of simultaneous subscribers
+	queryLogStreamKeepalive = time.Second * 15 // how often an idle stream is pinged to keep proxies from closing it
+)
+
+// queryLogSubscriber receives the entries as they are logged
+// logRequest never waits for it, the entries that don't fit into its queue are counted and dropped
+type queryLogSubscriber struct {
+	entries chan *logEntry
+	dropped uint64 // accessed atomically
+}
+
+var queryLogStreams = struct {
+	sync.RWMutex
+	count       int32 // accessed atomically, so that logRequest doesn't lock anything when there are no subscribers
+	subscribers map[*queryLogSubscriber]bool
+}{subscribers: map[*queryLogSubscriber]bool{}}
+
+func subscribeQueryLog() (*queryLogSubscriber, error) {
+	queryLogStreams.Lock()
+	defer queryLogStreams.Unlock()
+	if len(queryLogStreams.subscribers) >= queryLogStreamMax {
+		return nil, fmt.Errorf("too many query log streams, at most %d are allowed", queryLogStreamMax)
+	}
+	sub := &queryLogSubscriber{entries: make(chan *logEntry, queryLogStreamBuffer)}
+	queryLogStreams.subscribers[sub] = true
+	atomic.AddInt32(&queryLogStreams.count, 1)
+	return sub, nil
+}
+
+func (sub *queryLogSubscriber) unsubscribe() {
+	queryLogStreams.Lock()
+	defer queryLogStreams.Unlock()
+	if queryLogStreams.subscribers[sub] {
+		delete(queryLogStreams.subscribers, sub)
+		atomic.AddInt32(&queryLogStreams.count, -1)
+	}
+}
+
+// publishLogEntry passes the entry to the subscribers without blocking
+func publishLogEntry(entry *logEntry) {
+	if atomic.LoadInt32(&queryLogStreams.count) == 0 {
+		return
+	}
+	queryLogStreams.RLock()
+	for sub := range queryLogStreams.subscribers {
+		select {
+		case sub.entries <- entry:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+	queryLogStreams.RUnlock()
+}
+
+// parseQueryLogStreamFilter parses the filters of the stream, they are the same as the search ones except paging
+func parseQueryLogStreamFilter(q url.Values) (queryLogSearch, error) {
+	if len(q.Get("older_than")) != 0 || len(q.Get("offset")) != 0 || len(q.Get("limit")) != 0 {
+		return queryLogSearch{}, fmt.Errorf("older_than, offset and limit can't be used with the stream")
+	}
+	return parseQueryLogSearch(q)
+}
+
+// streamQueryLog sends the matching entries until the context is done or sending fails
+// send is called with the event name, "entry" for entries and "dropped" for the number of entries
+// that were dropped because the client didn't read them fast enough
+func streamQueryLog(ctx context.Context, filter queryLogSearch, send func(event string, data []byte) error) error {
+	sub, err := subscribeQueryLog()
+	if err != nil {
+		return err
+	}
+	defer sub.unsubscribe()
+
+	keepalive := time.NewTicker(queryLogStreamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepalive.C:
+			err = send("", nil)
+		case entry := <-sub.entries:
+			if dropped := atomic.SwapUint64(&sub.dropped, 0); dropped != 0 {
+				err = send("dropped", []byte(fmt.Sprintf(`{"dropped":%d}`, dropped)))
+				if err != nil {
+					return err
+				}
+			}
+			if !filter.match(entry) {
+				continue
+			}
+			var data []byte
+			data, err = json.Marshal(logEntryToJSON(entry))
+			if err != nil {
+				return err
+			}
+			err = send("entry", data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// HandleQueryLogStream streams the new query log entries as Server-Sent Events
+func HandleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseQueryLogStreamFilter(r.URL.Query())
+	if err != nil {
+		errorText := fmt.Sprintf("Invalid query log stream filter: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	send := func(event string, data []byte) error {
+		var err error
+		if len(event) == 0 {
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		} else {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		}
+		flusher.Flush()
+		return err
+	}
+	// let the client know that the stream has started before the first entry comes
+	err = send("", nil)
+	if err != nil {
+		return
+	}
+
+	err = streamQueryLog(r.Context(), filter, send)
+	if err != nil {
+		// the headers are already sent, so the error can only be logged
+		log.Printf("Query log stream to %s stopped: %s", r.RemoteAddr, err)
+	}
+}
+
+// HandleQueryLogWebSocket streams the new query log entries over WebSocket, each message is
+// a JSON object with the event name and its data
+func HandleQueryLogWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseQueryLogStreamFilter(r.URL.Query())
+	if err != nil {
+		errorText := fmt.Sprintf("Invalid query log stream filter: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusBadRequest)
+		return
+	}
+
+	server := websocket.Server{
+		// web pages of other sites must not read the log using the browser's credentials
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			origin := r.Header.Get("Origin")
+			if len(origin) == 0 {
+				return nil
+			}
+			u, err := url.Parse(origin)
+			if err != nil || u.Host != r.Host {
+				return fmt.Errorf("origin %s is not allowed", origin)
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				// the client isn't expected to send anything, reading only detects that it's gone
+				var msg []byte
+				for websocket.Message.Receive(ws, &msg) == nil {
+				}
+				cancel()
+			}()
+
+			send := func(event string, data []byte) error {
+				if len(event) == 0 {
+					event = "keepalive"
+				}
+				msg, err := json.Marshal(map[string]interface{}{
+					"event": event,
+					"data":  json.RawMessage(data),
+				})
+				if err != nil {
+					return err
+				}
+				return websocket.Message.Send(ws, string(msg))
+			}
+			err := streamQueryLog(ctx, filter, send)
+			if err != nil {
+				log.Printf("Query log stream to %s stopped: %s", r.RemoteAddr, err)
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
@@ -0,0 +1,123 @@
+package dnsfilter
+
+import (
+	"context"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublishLogEntryDrops(t *testing.T) {
+	sub, err := subscribeQueryLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.unsubscribe()
+
+	// nobody reads the queue, publishing must not wait for it
+	entry := newTestLogEntry(t, "example.org", "192.168.1.10", false, time.Now())
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < queryLogStreamBuffer+5; i++ {
+			publishLogEntry(entry)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing is blocked by the full queue")
+	}
+	if len(sub.entries) != queryLogStreamBuffer {
+		t.Errorf("expected %d queued entries, got %d", queryLogStreamBuffer, len(sub.entries))
+	}
+	if dropped := atomic.LoadUint64(&sub.dropped); dropped != 5 {
+		t.Errorf("expected 5 dropped entries, got %d", dropped)
+	}
+}
+
+func TestStreamQueryLogDropped(t *testing.T) {
+	filter, err := parseQueryLogStreamFilter(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type event struct {
+		name string
+		data string
+	}
+	events := make(chan event, queryLogStreamBuffer+10)
+	release := make(chan struct{})
+	first := true
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() {
+		stopped <- streamQueryLog(ctx, filter, func(name string, data []byte) error {
+			events <- event{name, string(data)}
+			if first && name == "entry" {
+				// the client is slow, the entries published meanwhile don't fit into the queue
+				first = false
+				<-release
+			}
+			return nil
+		})
+	}()
+	for atomic.LoadInt32(&queryLogStreams.count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	entry := newTestLogEntry(t, "example.org", "192.168.1.10", false, time.Now())
+	publishLogEntry(entry)
+	if e := <-events; e.name != "entry" {
+		t.Fatalf("expected the first entry, got %+v", e)
+	}
+	for i := 0; i < queryLogStreamBuffer+3; i++ {
+		publishLogEntry(entry)
+	}
+	close(release)
+
+	// the client learns about the dropped entries before it gets the next one
+	if e := <-events; e.name != "dropped" || e.data != `{"dropped":3}` {
+		t.Errorf("expected 3 dropped entries, got %+v", e)
+	}
+	if e := <-events; e.name != "entry" {
+		t.Errorf("expected the entry after the dropped event, got %+v", e)
+	}
+	cancel()
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryLogStreamMax(t *testing.T) {
+	subs := []*queryLogSubscriber{}
+	defer func() {
+		for _, sub := range subs {
+			sub.unsubscribe()
+		}
+	}()
+	for i := 0; i < queryLogStreamMax; i++ {
+		sub, err := subscribeQueryLog()
+		if err != nil {
+			t.Fatalf("subscriber %d: %s", i, err)
+		}
+		subs = append(subs, sub)
+	}
+
+	_, err := subscribeQueryLog()
+	if err == nil {
+		t.Error("expected the subscriber over the limit to be refused")
+	}
+	err = streamQueryLog(context.Background(), queryLogSearch{}, func(string, []byte) error { return nil })
+	if err == nil {
+		t.Error("expected the stream over the limit to be refused")
+	}
+
+	// the place is freed when a subscriber leaves
+	subs[0].unsubscribe()
+	sub, err := subscribeQueryLog()
+	if err != nil {
+		t.Fatalf("expected the freed place to be taken: %s", err)
+	}
+	subs[0] = sub
+}
@@ -19,10 +19,23 @@ import (
 	"github.com/miekg/dns"
 )
 
+// clientTop keeps a small top of each client, so that the busy clients don't push the others out of it
+// keyed by client IP, only the clients in the top of clients are kept
+type clientTop map[string]gcache.Cache
+
 type hourTop struct {
-	domains gcache.Cache
-	blocked gcache.Cache
-	clients gcache.Cache
+	domains  gcache.Cache
+	blocked  gcache.Cache
+	clients  gcache.Cache
+	trackers clientTop // keyed by tracker source and ID, see tracker.key()
+
+	clientsBlocked gcache.Cache
+	clientDomains  clientTop // keyed by host
+	clientBlocked  clientTop // keyed by host
+
+	// not limited in size, so that the rules that never match can be found
+	filters map[string]int // keyed by filter ID
+	rules   map[string]int // keyed by filter ID and rule separated by space
 
 	mutex sync.RWMutex
 }
@@ -30,7 +43,19 @@ type hourTop struct {
 func (top *hourTop) init() {
 	top.domains = gcache.New(queryLogTopSize).LRU().Build()
 	top.blocked = gcache.New(queryLogTopSize).LRU().Build()
-	top.clients = gcache.New(queryLogTopSize).LRU().Build()
+	// the tops of the client are dropped with it, it's called with the top locked
+	top.clients = gcache.New(queryLogTopSize).LRU().EvictedFunc(func(key, value interface{}) {
+		client, _ := key.(string)
+		delete(top.trackers, client)
+		delete(top.clientDomains, client)
+		delete(top.clientBlocked, client)
+	}).Build()
+	top.trackers = clientTop{}
+	top.clientsBlocked = gcache.New(queryLogTopSize).LRU().Build()
+	top.clientDomains = clientTop{}
+	top.clientBlocked = clientTop{}
+	top.filters = map[string]int{}
+	top.rules = map[string]int{}
 }
 
 type dayTop struct {
@@ -116,6 +141,28 @@ func (top *hourTop) incrementClients(key string) error {
 	return top.incrementValue(key, top.clients)
 }
 
+// incrementClientValue increments the value in the top of the client, creating the top if there's none yet
+func (top *hourTop) incrementClientValue(client string, key string, tops clientTop) error {
+	return top.incrementValue(key, top.clientCache(client, tops))
+}
+
+func (top *hourTop) clientCache(client string, tops clientTop) gcache.Cache {
+	top.Lock()
+	defer top.Unlock()
+	cache, ok := tops[client]
+	if !ok {
+		cache = gcache.New(queryLogClientTopSize).LRU().Build()
+		tops[client] = cache
+	}
+	return cache
+}
+
+func (top *hourTop) incrementCount(key string, counts map[string]int) {
+	top.Lock()
+	counts[key]++
+	top.Unlock()
+}
+
 // if does not exist -- return 0
 func (top *hourTop) lockedGetValue(key string, cache gcache.Cache) (int, error) {
 	ivalue, err := cache.Get(key)
@@ -183,12 +230,60 @@ func (r *dayTop) addEntry(entry *logEntry, q *dns.Msg, now time.Time) error {
 			log.Printf("Failed to increment value: %s", err)
 			return err
 		}
+		err = runningTop.hours[hour].incrementClientValue(entry.IP, hostname, runningTop.hours[hour].clientDomains)
+		if err != nil {
+			log.Printf("Failed to increment value: %s", err)
+			return err
+		}
+		if entry.Result.IsFiltered {
+			err = runningTop.hours[hour].incrementValue(entry.IP, runningTop.hours[hour].clientsBlocked)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+			err = runningTop.hours[hour].incrementClientValue(entry.IP, hostname, runningTop.hours[hour].clientBlocked)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
+	}
+
+	if isRuleResult(entry.Result) {
+		filterID := strconv.FormatInt(entry.Result.FilterID, 10)
+		runningTop.hours[hour].incrementCount(filterID, runningTop.hours[hour].filters)
+		runningTop.hours[hour].incrementCount(filterID+" "+entry.Result.Rule, runningTop.hours[hour].rules)
+	}
+
+	if t := findTracker(hostname); t != nil {
+		countTracker(t, entry.Time)
+		if len(entry.IP) > 0 {
+			err := runningTop.hours[hour].incrementClientValue(entry.IP, t.key(), runningTop.hours[hour].trackers)
+			if err != nil {
+				log.Printf("Failed to increment value: %s", err)
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
-func fillStatsFromQueryLog() error {
+// addToRunningTop counts the request in the top when it isn't written to the query log
+func addToRunningTop(q *dns.Msg, result dnsfilter.Result, when time.Time, ip string) {
+	if len(q.Question) != 1 {
+		return
+	}
+	entry := logEntry{Result: result, Time: when, IP: ip}
+	err := runningTop.addEntry(&entry, q, time.Now())
+	if err != nil {
+		log.Printf("Failed to add entry to running top: %s", err)
+	}
+}
+
+// fillStatsFromQueryLog loads the recent entries of the query log into memory
+// the stats and the top are rebuilt from them too if countStats is set, i.e. if they weren't saved to a file
+func fillStatsFromQueryLog(countStats bool) error {
 	now := time.Now()
 	runningTop.loadedWriteLock()
 	defer runningTop.loadedWriteUnlock()
@@ -217,12 +312,6 @@ func fillStatsFromQueryLog() error {
 			return nil
 		}
 
-		err := runningTop.addEntry(entry, q, now)
-		if err != nil {
-			log.Printf("Failed to add entry to running top: %s", err)
-			return err
-		}
-
 		queryLogLock.Lock()
 		queryLogCache = append(queryLogCache, entry)
 		if len(queryLogCache) > queryLogSize {
@@ -231,6 +320,16 @@ func fillStatsFromQueryLog() error {
 		}
 		queryLogLock.Unlock()
 
+		if !countStats {
+			return nil
+		}
+
+		err := runningTop.addEntry(entry, q, now)
+		if err != nil {
+			log.Printf("Failed to add entry to running top: %s", err)
+			return err
+		}
+
 		requests.IncWithTime(entry.Time)
 		if entry.Result.IsFiltered {
 			filtered.IncWithTime(entry.Time)
@@ -248,8 +347,14 @@ func fillStatsFromQueryLog() error {
 			filteredParental.IncWithTime(entry.Time)
 		case dnsfilter.FilteredInvalid:
 			// do nothing
+		case dnsfilter.FilteredBlockedIP:
+			filteredBlockedIP.IncWithTime(entry.Time)
+		case dnsfilter.FilteredBlockedService:
+			filteredBlockedServices.IncWithTime(entry.Time)
 		case dnsfilter.FilteredSafeSearch:
 			safesearch.IncWithTime(entry.Time)
+		case dnsfilter.FilteredDNSRewrite:
+			dnsRewritten.IncWithTime(entry.Time)
 		}
 		elapsedTime.ObserveWithTime(entry.Elapsed.Seconds(), entry.Time)
 
@@ -306,11 +411,7 @@ func HandleStatsTop(w http.ResponseWriter, r *http.Request) {
 		json.WriteString("  ")
 		json.WriteString(fmt.Sprintf("%q", name))
 		json.WriteString(": {\n")
-		sorted := sortByValue(top)
-		// no more than 50 entries
-		if len(sorted) > 50 {
-			sorted = sorted[:50]
-		}
+		sorted := topKeys(top)
 		for i, key := range sorted {
 			json.WriteString("    ")
 			json.WriteString(fmt.Sprintf("%q", key))
@@ -330,11 +431,23 @@ func HandleStatsTop(w http.ResponseWriter, r *http.Request) {
 	gen(&json, "top_queried_domains", domains, true)
 	gen(&json, "top_blocked_domains", blocked, true)
 	gen(&json, "top_clients", clients, true)
+
+	// trackers of the listed domains
+	trackersJSON, err := marshalTopTrackers(topKeys(domains), topKeys(blocked))
+	if err != nil {
+		errortext := fmt.Sprintf("Unable to marshal trackers json: %s", err)
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusInternalServerError)
+		return
+	}
+	json.WriteString("  \"trackers\": ")
+	json.Write(trackersJSON)
+	json.WriteString(",\n")
 	json.WriteString("  \"stats_period\": \"24 hours\"\n")
 	json.WriteString("}\n")
 
 	w.Header().Set("Content-Type", "application/json")
-	_, err := w.Write(json.Bytes())
+	_, err = w.Write(json.Bytes())
 	if err != nil {
 		errortext := fmt.Sprintf("Couldn't write body: %s", err)
 		log.Println(errortext)
@@ -342,6 +455,15 @@ func HandleStatsTop(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// returns no more than 50 keys with the largest values
+func topKeys(top map[string]int) []string {
+	sorted := sortByValue(top)
+	if len(sorted) > 50 {
+		sorted = sorted[:50]
+	}
+	return sorted
+}
+
 // helper function for querylog API
 func sortByValue(m map[string]int) []string {
 	type kv struct {
@@ -0,0 +1,56 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHourTopPerClient(t *testing.T) {
+	top := &hourTop{}
+	top.init()
+	count := func(client string, host string) {
+		err := top.incrementClients(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = top.incrementClientValue(client, host, top.clientDomains)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a busy client doesn't push the domains of the others out of the top
+	count("192.168.1.10", "example.org")
+	for i := 0; i < queryLogClientTopSize*2; i++ {
+		count("192.168.1.20", fmt.Sprintf("host%d.example.net", i))
+	}
+	if value, _ := top.lockedGetValue("example.org", top.clientDomains["192.168.1.10"]); value != 1 {
+		t.Errorf("expected 1 request of the quiet client, got %d", value)
+	}
+	if size := top.clientDomains["192.168.1.20"].Len(); size != queryLogClientTopSize {
+		t.Errorf("expected the top of the busy client to be limited to %d, got %d", queryLogClientTopSize, size)
+	}
+
+	// the top is saved and loaded with the keys prefixed by the client
+	saved := clientTopToMap(top.clientDomains)
+	if saved["192.168.1.10 example.org"] != 1 {
+		t.Errorf("expected the saved value of the quiet client, got %v", saved["192.168.1.10 example.org"])
+	}
+	loaded := &hourTop{}
+	loaded.init()
+	fillClientTop(loaded, loaded.clientDomains, saved)
+	if value, _ := loaded.lockedGetValue("example.org", loaded.clientDomains["192.168.1.10"]); value != 1 {
+		t.Errorf("expected the loaded value of the quiet client, got %d", value)
+	}
+
+	// the tops of the clients that are out of the top of clients are dropped
+	for i := 0; i < queryLogTopSize; i++ {
+		count(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "example.com")
+	}
+	if _, ok := top.clientDomains["192.168.1.10"]; ok {
+		t.Error("expected the top of the evicted client to be dropped")
+	}
+	if len(top.clientDomains) > queryLogTopSize {
+		t.Errorf("expected no more than %d client tops, got %d", queryLogTopSize, len(top.clientDomains))
+	}
+}
@@ -1,12 +1,20 @@
 package dnsfilter
 
 import (
-	"log"
+	"errors"
+	"sync"
 
 	"github.com/mholt/caddy"
 )
 
-var Reload = make(chan bool)
+// ErrNotStarted is returned by Restart if the DNS server hasn't started yet, it'll use the Corefile on disk when it starts
+var ErrNotStarted = errors.New("the DNS server hasn't started yet")
+
+var (
+	instance     *caddy.Instance // the running instance
+	instanceLock sync.Mutex
+	restartLock  sync.Mutex // restarts run one at a time
+)
 
 func hook(event caddy.EventName, info interface{}) error {
 	if event != caddy.InstanceStartupEvent {
@@ -14,23 +22,36 @@ func hook(event caddy.EventName, info interface{}) error {
 	}
 
 	// this should be an instance. ok to panic if not
-	instance := info.(*caddy.Instance)
-
-	go func() {
-		for range Reload {
-			corefile, err := caddy.LoadCaddyfile(instance.Caddyfile().ServerType())
-			if err != nil {
-				continue
-			}
-			_, err = instance.Restart(corefile)
-			if err != nil {
-				log.Printf("Corefile changed but reload failed: %s", err)
-				continue
-			}
-			// hook will be called again from new instance
-			return
-		}
-	}()
+	instanceLock.Lock()
+	instance = info.(*caddy.Instance)
+	instanceLock.Unlock()
+	return nil
+}
+
+// Restart replaces the running instance with the one started from the Corefile on disk
+// if the new instance fails to start, the running one is kept and the error is returned
+func Restart() error {
+	restartLock.Lock()
+	defer restartLock.Unlock()
 
+	instanceLock.Lock()
+	running := instance
+	instanceLock.Unlock()
+	if running == nil {
+		return ErrNotStarted
+	}
+
+	corefile, err := caddy.LoadCaddyfile(running.Caddyfile().ServerType())
+	if err != nil {
+		return err
+	}
+	// hook is called from the new instance too, but it isn't guaranteed to be called before Restart returns
+	newInstance, err := running.Restart(corefile)
+	if err != nil {
+		return err
+	}
+	instanceLock.Lock()
+	instance = newInstance
+	instanceLock.Unlock()
 	return nil
 }
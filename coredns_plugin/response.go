@@ -0,0 +1,41 @@
+package dnsfilter
+
+import (
+	"github.com/miekg/dns"
+)
+
+// responseCapture is a dns.ResponseWriter that keeps the response of the next plugin instead of sending it,
+// so that the response can be checked before it's sent to the client
+// the responses that don't need checking are sent right away
+type responseCapture struct {
+	dns.ResponseWriter
+	needsCheck func(m *dns.Msg) bool
+
+	msg  *dns.Msg // the response of the next plugin, nil if nothing was written
+	held bool     // the response isn't sent yet
+}
+
+// WriteMsg saves the response, or sends it if it doesn't need checking
+func (c *responseCapture) WriteMsg(m *dns.Msg) error {
+	c.msg = m
+	if !c.needsCheck(m) {
+		return c.ResponseWriter.WriteMsg(m)
+	}
+	c.held = true
+	return nil
+}
+
+// Write saves the packed response, or sends it if it doesn't need checking
+func (c *responseCapture) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	err := m.Unpack(buf)
+	if err != nil {
+		return 0, err
+	}
+	c.msg = m
+	if !c.needsCheck(m) {
+		return c.ResponseWriter.Write(buf)
+	}
+	c.held = true
+	return len(buf), nil
+}
@@ -0,0 +1,76 @@
+package dnsfilter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+func TestServeUpstream(t *testing.T) {
+	cname := []string{"example.org. 300 IN CNAME tracker.example.net.", "tracker.example.net. 300 IN A 1.2.3.4"}
+	chain := []string{"example.org. 300 IN CNAME cdn.example.com.", "cdn.example.com. 300 IN CNAME tracker.example.net.", "tracker.example.net. 300 IN A 1.2.3.4"}
+	tests := []struct {
+		name     string
+		rcode    int
+		records  []string
+		rules    []string
+		held     bool
+		filtered bool
+	}{
+		{"nxdomain", dns.RcodeNameError, nil, nil, false, false},
+		{"address", dns.RcodeSuccess, []string{"example.org. 300 IN A 1.2.3.4"}, nil, false, false},
+		{"address with network rules", dns.RcodeSuccess, []string{"example.org. 300 IN A 1.2.3.4"}, []string{"||1.2.3.0/24^"}, true, true},
+		{"cname", dns.RcodeSuccess, cname, nil, true, false},
+		{"blocked cname", dns.RcodeSuccess, cname, []string{"||tracker.example.net^"}, true, true},
+		{"whitelisted cname before blocked", dns.RcodeSuccess, chain, []string{"@@||cdn.example.com^", "||tracker.example.net^"}, true, false},
+	}
+	for _, tc := range tests {
+		p := &plug{settings: defaultPluginSettings, d: dnsfilter.New()}
+		for _, text := range tc.rules {
+			err := p.d.AddRule(text, 1)
+			if err != nil {
+				t.Fatalf("couldn't add rule %s: %s", text, err)
+			}
+		}
+		held := false
+		p.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+			m := new(dns.Msg)
+			m.SetRcode(r, tc.rcode)
+			for _, s := range tc.records {
+				rr, err := dns.NewRR(s)
+				if err != nil {
+					return dns.RcodeServerFailure, err
+				}
+				m.Answer = append(m.Answer, rr)
+			}
+			err := w.WriteMsg(m)
+			held = w.(*responseCapture).held
+			return tc.rcode, err
+		})
+
+		r := new(dns.Msg)
+		r.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, result, err := p.serveUpstream(context.Background(), rec, r, "192.168.1.1")
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if rec.Msg == nil {
+			t.Fatalf("%s: nothing was written", tc.name)
+		}
+		if rcode != rec.Msg.Rcode {
+			t.Errorf("%s: returned rcode %s, but written %s", tc.name, dns.RcodeToString[rcode], dns.RcodeToString[rec.Msg.Rcode])
+		}
+		if held != tc.held {
+			t.Errorf("%s: expected the response to be held=%v", tc.name, tc.held)
+		}
+		if result.IsFiltered != tc.filtered {
+			t.Errorf("%s: expected filtered=%v, got %+v", tc.name, tc.filtered, result)
+		}
+	}
+}
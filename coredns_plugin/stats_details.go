@@ -0,0 +1,383 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+const (
+	statsTopDefaultLimit = 50   // default number of entries in the tops of /control/stats/*
+	statsTopMaxLimit     = 1000 // maximum number of entries in the tops of /control/stats/*
+)
+
+// statsTopParams are the parameters of /control/stats/* requests
+type statsTopParams struct {
+	limit int // number of entries in the tops
+	hours int // how many last hours are summed up, at most 24
+}
+
+// parseStatsTopParams parses limit and period, period is a duration in whole hours like 6h
+func parseStatsTopParams(q url.Values) (statsTopParams, error) {
+	params := statsTopParams{limit: statsTopDefaultLimit, hours: 24}
+	if value := q.Get("limit"); len(value) != 0 {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > statsTopMaxLimit {
+			return params, fmt.Errorf("limit must be a number from 1 to %d", statsTopMaxLimit)
+		}
+		params.limit = limit
+	}
+	if value := q.Get("period"); len(value) != 0 {
+		period, err := time.ParseDuration(value)
+		if err != nil || period%time.Hour != 0 || period < time.Hour || period > time.Hour*24 {
+			return params, fmt.Errorf("period must be a number of hours from 1h to 24h")
+		}
+		params.hours = int(period / time.Hour)
+	}
+	return params, nil
+}
+
+func (params statsTopParams) periodText() string {
+	if params.hours == 1 {
+		return "1 hour"
+	}
+	return fmt.Sprintf("%d hours", params.hours)
+}
+
+// isRuleResult checks if the result comes from a rule of a filter and not from safebrowsing, parental or safesearch
+func isRuleResult(result dnsfilter.Result) bool {
+	if len(result.Rule) == 0 {
+		return false
+	}
+	switch result.Reason {
+	case dnsfilter.FilteredBlackList, dnsfilter.NotFilteredWhiteList, dnsfilter.FilteredDNSRewrite,
+		dnsfilter.FilteredBlockedIP, dnsfilter.FilteredBlockedService:
+		return true
+	}
+	return false
+}
+
+// sumTopCaches sums up the values of the caches of the last hours
+// the keys are passed through filterKey, the ones it doesn't accept are skipped
+func sumTopCaches(hours int, getCache func(top *hourTop) gcache.Cache, filterKey func(key string) (string, bool)) map[string]int {
+	sum := map[string]int{}
+	runningTop.hoursReadLock()
+	for hour := 0; hour < hours; hour++ {
+		top := runningTop.hours[hour]
+		top.RLock()
+		cache := getCache(top)
+		if cache == nil {
+			top.RUnlock()
+			continue
+		}
+		for _, ikey := range cache.Keys() {
+			key, ok := ikey.(string)
+			if !ok {
+				continue
+			}
+			resultKey, ok := filterKey(key)
+			if !ok {
+				continue
+			}
+			value, err := top.lockedGetValue(key, cache)
+			if err != nil {
+				log.Printf("Failed to get top value for %v: %s", key, err)
+				break
+			}
+			sum[resultKey] += value
+		}
+		top.RUnlock()
+	}
+	runningTop.hoursReadUnlock()
+	return sum
+}
+
+// sumTopCounts is sumTopCaches for the counts that aren't limited in size
+func sumTopCounts(hours int, getCounts func(top *hourTop) map[string]int, filterKey func(key string) (string, bool)) map[string]int {
+	sum := map[string]int{}
+	runningTop.hoursReadLock()
+	for hour := 0; hour < hours; hour++ {
+		top := runningTop.hours[hour]
+		top.RLock()
+		for key, value := range getCounts(top) {
+			if resultKey, ok := filterKey(key); ok {
+				sum[resultKey] += value
+			}
+		}
+		top.RUnlock()
+	}
+	runningTop.hoursReadUnlock()
+	return sum
+}
+
+func anyKey(key string) (string, bool) {
+	return key, true
+}
+
+// prefixedKey returns a filterKey function that accepts the keys starting with the prefix and a space,
+// like the keys of the client or of the filter, and strips the prefix from them
+func prefixedKey(prefix string) func(key string) (string, bool) {
+	prefix += " "
+	return func(key string) (string, bool) {
+		if !strings.HasPrefix(key, prefix) {
+			return "", false
+		}
+		return key[len(prefix):], true
+	}
+}
+
+// topCounts returns no more than limit keys with the largest values
+func topCounts(counts map[string]int, limit int) []string {
+	sorted := sortByValue(counts)
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	return sorted
+}
+
+func writeStatsJSON(w http.ResponseWriter, data interface{}) {
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		errortext := fmt.Sprintf("Unable to marshal stats json: %s", err)
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errortext := fmt.Sprintf("Couldn't write body: %s", err)
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusInternalServerError)
+	}
+}
+
+func parseStatsTopRequest(w http.ResponseWriter, r *http.Request) (statsTopParams, bool) {
+	params, err := parseStatsTopParams(r.URL.Query())
+	if err != nil {
+		errortext := fmt.Sprintf("Invalid stats request: %s", err)
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusBadRequest)
+		return params, false
+	}
+	return params, true
+}
+
+// HandleStatsFilters returns the number of requests matched by the rules of each filter
+func HandleStatsFilters(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseStatsTopRequest(w, r)
+	if !ok {
+		return
+	}
+	counts := sumTopCounts(params.hours, func(top *hourTop) map[string]int { return top.filters }, anyKey)
+
+	type filterJSON struct {
+		ID    int64 `json:"id"`
+		Count int   `json:"count"`
+	}
+	filters := []filterJSON{}
+	for _, key := range topCounts(counts, params.limit) {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			continue
+		}
+		filters = append(filters, filterJSON{ID: id, Count: counts[key]})
+	}
+	writeStatsJSON(w, map[string]interface{}{
+		"filters":      filters,
+		"stats_period": params.periodText(),
+	})
+}
+
+// HandleStatsRules returns the rules that matched the most requests, of the filter specified by filter_id if it's set
+// with unmatched=true it returns the rules of the filter that haven't matched any request instead
+func HandleStatsRules(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseStatsTopRequest(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	filterID := q.Get("filter_id")
+	if len(filterID) != 0 {
+		if _, err := strconv.ParseInt(filterID, 10, 64); err != nil {
+			http.Error(w, "filter_id must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	unmatched := q.Get("unmatched") == "true"
+	if unmatched && len(filterID) == 0 {
+		http.Error(w, "unmatched requires filter_id", http.StatusBadRequest)
+		return
+	}
+
+	filterKey := anyKey
+	if len(filterID) != 0 {
+		filterKey = prefixedKey(filterID)
+	}
+	counts := sumTopCounts(params.hours, func(top *hourTop) map[string]int { return top.rules }, filterKey)
+
+	data := map[string]interface{}{
+		"stats_period": params.periodText(),
+	}
+	if unmatched {
+		id, _ := strconv.ParseInt(filterID, 10, 64)
+		rules, total, err := findUnmatchedRules(id, counts, params.limit)
+		if err != nil {
+			errortext := fmt.Sprintf("Couldn't read rules of filter %d: %s", id, err)
+			log.Println(errortext)
+			http.Error(w, errortext, http.StatusNotFound)
+			return
+		}
+		data["filter_id"] = id
+		data["unmatched"] = rules
+		data["unmatched_count"] = total
+		writeStatsJSON(w, data)
+		return
+	}
+
+	type ruleJSON struct {
+		FilterID int64  `json:"filter_id"`
+		Rule     string `json:"rule"`
+		Count    int    `json:"count"`
+	}
+	rules := []ruleJSON{}
+	for _, key := range topCounts(counts, params.limit) {
+		rule := ruleJSON{Rule: key, Count: counts[key]}
+		if len(filterID) != 0 {
+			rule.FilterID, _ = strconv.ParseInt(filterID, 10, 64)
+		} else {
+			pos := strings.IndexByte(key, ' ')
+			if pos < 0 {
+				continue
+			}
+			rule.FilterID, _ = strconv.ParseInt(key[:pos], 10, 64)
+			rule.Rule = key[pos+1:]
+		}
+		rules = append(rules, rule)
+	}
+	data["rules"] = rules
+	writeStatsJSON(w, data)
+}
+
+// findUnmatchedRules reads the rules of the filter and returns no more than limit of them
+// that have no matches in counts, and the number of all such rules
+func findUnmatchedRules(filterID int64, counts map[string]int, limit int) ([]string, int, error) {
+	path := ""
+	findPath := func(filters []plugFilter) {
+		for _, filter := range filters {
+			if filter.ID == filterID {
+				path = filter.Path
+			}
+		}
+	}
+	activePluginLock.RLock()
+	if activePlugin != nil {
+		activePlugin.RLock()
+		findPath(activePlugin.settings.Filters)
+		for _, client := range activePlugin.clients {
+			findPath(client.Filters)
+		}
+		activePlugin.RUnlock()
+	}
+	activePluginLock.RUnlock()
+	if len(path) == 0 {
+		return nil, 0, fmt.Errorf("filter isn't loaded")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	rules := []string{}
+	total := 0
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule := strings.TrimSpace(scanner.Text())
+		if !dnsfilter.IsValidRule(rule) || seen[rule] || counts[rule] != 0 {
+			continue
+		}
+		seen[rule] = true
+		total++
+		if len(rules) < limit {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, total, scanner.Err()
+}
+
+// HandleStatsClients returns the clients with the most requests, with the number of their requests and blocked requests
+func HandleStatsClients(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseStatsTopRequest(w, r)
+	if !ok {
+		return
+	}
+	queries := sumTopCaches(params.hours, func(top *hourTop) gcache.Cache { return top.clients }, anyKey)
+	blocked := sumTopCaches(params.hours, func(top *hourTop) gcache.Cache { return top.clientsBlocked }, anyKey)
+
+	type clientJSON struct {
+		Client  string `json:"client"`
+		Queries int    `json:"queries"`
+		Blocked int    `json:"blocked"`
+	}
+	clients := []clientJSON{}
+	for _, client := range topCounts(queries, params.limit) {
+		clients = append(clients, clientJSON{Client: client, Queries: queries[client], Blocked: blocked[client]})
+	}
+	writeStatsJSON(w, map[string]interface{}{
+		"clients":      clients,
+		"stats_period": params.periodText(),
+	})
+}
+
+// HandleStatsClient returns the number of requests and blocked requests of the client and its top domains
+func HandleStatsClient(w http.ResponseWriter, r *http.Request) {
+	params, ok := parseStatsTopRequest(w, r)
+	if !ok {
+		return
+	}
+	client := strings.TrimSpace(r.URL.Query().Get("client"))
+	if len(client) == 0 {
+		http.Error(w, "client is required", http.StatusBadRequest)
+		return
+	}
+	onlyClient := func(key string) (string, bool) {
+		return key, key == client
+	}
+	queries := sumTopCaches(params.hours, func(top *hourTop) gcache.Cache { return top.clients }, onlyClient)
+	blocked := sumTopCaches(params.hours, func(top *hourTop) gcache.Cache { return top.clientsBlocked }, onlyClient)
+	domains := sumTopCaches(params.hours, func(top *hourTop) gcache.Cache { return top.clientDomains[client] }, anyKey)
+	blockedDomains := sumTopCaches(params.hours, func(top *hourTop) gcache.Cache { return top.clientBlocked[client] }, anyKey)
+
+	type domainJSON struct {
+		Domain string `json:"domain"`
+		Count  int    `json:"count"`
+	}
+	topDomains := func(counts map[string]int) []domainJSON {
+		top := []domainJSON{}
+		for _, domain := range topCounts(counts, params.limit) {
+			top = append(top, domainJSON{Domain: domain, Count: counts[domain]})
+		}
+		return top
+	}
+	writeStatsJSON(w, map[string]interface{}{
+		"client":              client,
+		"queries":             queries[client],
+		"blocked":             blocked[client],
+		"top_queried_domains": topDomains(domains),
+		"top_blocked_domains": topDomains(blockedDomains),
+		"stats_period":        params.periodText(),
+	})
+}
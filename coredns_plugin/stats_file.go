@@ -0,0 +1,269 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+)
+
+const statsSavePeriod = time.Minute * 5 // save the stats periodically in case the process is killed
+
+var (
+	statsFile     string // where the stats and the top are saved, empty if they aren't saved
+	statsFileLock sync.Mutex
+	onceStatsFile sync.Once
+	statsLoaded   bool // the stats were loaded from the file, so they don't need to be rebuilt from the query log
+)
+
+// statsSnapshot is the content of the stats file
+type statsSnapshot struct {
+	Time      time.Time             `json:"time"`
+	PerSecond periodicStatsSnapshot `json:"per_second"`
+	PerMinute periodicStatsSnapshot `json:"per_minute"`
+	PerHour   periodicStatsSnapshot `json:"per_hour"`
+	PerDay    periodicStatsSnapshot `json:"per_day"`
+	Top       []hourTopSnapshot     `json:"top"` // the current hour first
+}
+
+type periodicStatsSnapshot struct {
+	Entries    statsEntries `json:"entries"`
+	LastRotate time.Time    `json:"last_rotate"`
+}
+
+type hourTopSnapshot struct {
+	Domains        map[string]int `json:"domains"`
+	Blocked        map[string]int `json:"blocked"`
+	Clients        map[string]int `json:"clients"`
+	Trackers       map[string]int `json:"trackers"`
+	ClientsBlocked map[string]int `json:"clients_blocked"`
+	ClientDomains  map[string]int `json:"client_domains"`
+	ClientBlocked  map[string]int `json:"client_blocked"`
+	Filters        map[string]int `json:"filters"`
+	Rules          map[string]int `json:"rules"`
+}
+
+// setupStatsFile applies the stats file of the plugin
+// on the first call it also loads the stats saved by the previous process and starts saving them periodically
+// returns true if the stats were loaded from the file
+func setupStatsFile(settings plugSettings) bool {
+	statsFileLock.Lock()
+	statsFile = settings.StatsFile
+	statsFileLock.Unlock()
+	if len(settings.StatsFile) == 0 {
+		return statsLoaded
+	}
+
+	onceStatsFile.Do(func() {
+		err := loadStats(settings.StatsFile)
+		if err == nil {
+			statsLoaded = true
+			log.Printf("Loaded stats from %s", settings.StatsFile)
+		} else if !os.IsNotExist(err) {
+			// not fatal, the stats will be rebuilt from the query log
+			log.Printf("Failed to load stats from %s: %s", settings.StatsFile, err)
+		}
+		go periodicStatsSave()
+	})
+	return statsLoaded
+}
+
+func saveStats() {
+	statsFileLock.Lock()
+	defer statsFileLock.Unlock()
+	if len(statsFile) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(takeStatsSnapshot())
+	if err != nil {
+		log.Printf("Failed to marshal stats: %s", err)
+		return
+	}
+	tmpPath := statsFile + ".tmp"
+	err = ioutil.WriteFile(tmpPath, body, 0644)
+	if err == nil {
+		err = os.Rename(tmpPath, statsFile)
+	}
+	if err != nil {
+		log.Printf("Failed to save stats to %s: %s", statsFile, err)
+	}
+}
+
+func periodicStatsSave() {
+	for range time.Tick(statsSavePeriod) {
+		saveStats()
+	}
+}
+
+func takeStatsSnapshot() statsSnapshot {
+	snapshot := statsSnapshot{
+		Time:      time.Now(),
+		PerSecond: statistics.PerSecond.snapshot(),
+		PerMinute: statistics.PerMinute.snapshot(),
+		PerHour:   statistics.PerHour.snapshot(),
+		PerDay:    statistics.PerDay.snapshot(),
+	}
+
+	runningTop.hoursReadLock()
+	for _, hour := range runningTop.hours {
+		hour.RLock()
+		snapshot.Top = append(snapshot.Top, hourTopSnapshot{
+			Domains:        topCacheToMap(hour.domains),
+			Blocked:        topCacheToMap(hour.blocked),
+			Clients:        topCacheToMap(hour.clients),
+			Trackers:       clientTopToMap(hour.trackers),
+			ClientsBlocked: topCacheToMap(hour.clientsBlocked),
+			ClientDomains:  clientTopToMap(hour.clientDomains),
+			ClientBlocked:  clientTopToMap(hour.clientBlocked),
+			Filters:        copyCounts(hour.filters),
+			Rules:          copyCounts(hour.rules),
+		})
+		hour.RUnlock()
+	}
+	runningTop.hoursReadUnlock()
+	return snapshot
+}
+
+func (p *periodicStats) snapshot() periodicStatsSnapshot {
+	p.RLock()
+	defer p.RUnlock()
+	entries := statsEntries{}
+	for name, values := range p.Entries {
+		entries[name] = append([]float64(nil), values...)
+	}
+	return periodicStatsSnapshot{Entries: entries, LastRotate: p.LastRotate}
+}
+
+func topCacheToMap(cache gcache.Cache) map[string]int {
+	m := map[string]int{}
+	for ikey, ivalue := range cache.GetALL() {
+		key, ok := ikey.(string)
+		if !ok {
+			continue
+		}
+		value, ok := ivalue.(int)
+		if !ok {
+			continue
+		}
+		m[key] = value
+	}
+	return m
+}
+
+// clientTopToMap merges the tops of the clients, the keys are prefixed with the client IP and a space
+func clientTopToMap(tops clientTop) map[string]int {
+	m := map[string]int{}
+	for client, cache := range tops {
+		for key, value := range topCacheToMap(cache) {
+			m[client+" "+key] = value
+		}
+	}
+	return m
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	m := map[string]int{}
+	for key, value := range counts {
+		m[key] = value
+	}
+	return m
+}
+
+// loadStats replaces the stats and the top with the saved ones
+func loadStats(path string) error {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	snapshot := statsSnapshot{}
+	err = json.Unmarshal(body, &snapshot)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	statistics.PerSecond.restore(snapshot.PerSecond)
+	statistics.PerMinute.restore(snapshot.PerMinute)
+	statistics.PerHour.restore(snapshot.PerHour)
+	statistics.PerDay.restore(snapshot.PerDay)
+	// shift the values by the time the process wasn't running, the unfinished minute is rolled into its hour and day
+	statistics.PerSecond.statsRotate(now)
+	statistics.PerHour.statsRotate(now)
+	statistics.PerDay.statsRotate(now)
+	statistics.PerMinute.statsRotate(now, &statistics.PerHour, &statistics.PerDay)
+
+	// the hours of the top are shifted the same way
+	shift := 0
+	if now.After(snapshot.Time) {
+		shift = int(now.Sub(snapshot.Time) / time.Hour)
+	}
+	runningTop.hoursWriteLock()
+	for i := range runningTop.hours {
+		hour := &hourTop{}
+		hour.init()
+		if i >= shift && i-shift < len(snapshot.Top) {
+			saved := snapshot.Top[i-shift]
+			fillTopCache(hour.domains, saved.Domains)
+			fillTopCache(hour.blocked, saved.Blocked)
+			fillTopCache(hour.clients, saved.Clients)
+			fillClientTop(hour, hour.trackers, saved.Trackers)
+			fillTopCache(hour.clientsBlocked, saved.ClientsBlocked)
+			fillClientTop(hour, hour.clientDomains, saved.ClientDomains)
+			fillClientTop(hour, hour.clientBlocked, saved.ClientBlocked)
+			for key, value := range saved.Filters {
+				hour.filters[key] = value
+			}
+			for key, value := range saved.Rules {
+				hour.rules[key] = value
+			}
+		}
+		runningTop.hours[i] = hour
+	}
+	runningTop.hoursWriteUnlock()
+	return nil
+}
+
+func (p *periodicStats) restore(snapshot periodicStatsSnapshot) {
+	p.Lock()
+	defer p.Unlock()
+	if snapshot.Entries == nil || snapshot.LastRotate.IsZero() {
+		return
+	}
+	p.Entries = statsEntries{}
+	for name, values := range snapshot.Entries {
+		// the retention could be changed since the stats were saved
+		p.Entries[name] = resizeStatsValues(values, p.size)
+	}
+	p.LastRotate = snapshot.LastRotate
+}
+
+func fillTopCache(cache gcache.Cache, values map[string]int) {
+	for key, value := range values {
+		err := cache.Set(key, value)
+		if err != nil {
+			log.Printf("Failed to set hourly top value: %s", err)
+			return
+		}
+	}
+}
+
+// fillClientTop splits the values saved by clientTopToMap into the tops of the clients
+func fillClientTop(hour *hourTop, tops clientTop, values map[string]int) {
+	for key, value := range values {
+		pos := strings.IndexByte(key, ' ')
+		if pos < 0 {
+			continue
+		}
+		err := hour.clientCache(key[:pos], tops).Set(key[pos+1:], value)
+		if err != nil {
+			log.Printf("Failed to set hourly top value: %s", err)
+			return
+		}
+	}
+}
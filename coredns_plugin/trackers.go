@@ -0,0 +1,259 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/packr"
+)
+
+// the same databases the web interface uses, whitehat.json has priority over whotracksme.json
+var trackerDBFiles = []struct {
+	name   string
+	source string
+}{
+	{"whitehat.json", "WhiteHat"},
+	{"whotracksme.json", "Whotracks.me"},
+}
+
+type trackerDB struct {
+	Categories map[string]string `json:"categories"` // category ID -> name
+	Trackers   map[string]struct {
+		Name       string `json:"name"`
+		CategoryID int    `json:"categoryId"`
+		URL        string `json:"url"`
+	} `json:"trackers"`
+	TrackerDomains map[string]string `json:"trackerDomains"` // domain -> tracker ID
+
+	source string
+}
+
+// tracker describes the company that a domain belongs to
+type tracker struct {
+	ID       string `json:"id"`
+	Company  string `json:"company"`
+	Category string `json:"category"`
+	URL      string `json:"url"`
+	Source   string `json:"source"`
+}
+
+var (
+	trackerDBs     []*trackerDB
+	trackerDBsOnce sync.Once
+)
+
+func loadTrackerDBs() {
+	box := packr.NewBox("../client/src/helpers/trackers")
+	for _, file := range trackerDBFiles {
+		body, err := box.Find(file.name)
+		if err != nil {
+			log.Printf("Couldn't load trackers database %s: %s", file.name, err)
+			continue
+		}
+		db := &trackerDB{source: file.source}
+		err = json.Unmarshal(body, db)
+		if err != nil {
+			log.Printf("Couldn't parse trackers database %s: %s", file.name, err)
+			continue
+		}
+		trackerDBs = append(trackerDBs, db)
+	}
+}
+
+// get returns the tracker with the specified ID, or nil if it's not in the database
+func (db *trackerDB) get(id string) *tracker {
+	data, ok := db.Trackers[id]
+	if !ok {
+		return nil
+	}
+	return &tracker{
+		ID:       id,
+		Company:  data.Name,
+		Category: db.Categories[strconv.Itoa(data.CategoryID)],
+		URL:      data.URL,
+		Source:   db.source,
+	}
+}
+
+// key identifies the tracker across the databases, the IDs of different databases may be the same
+func (t *tracker) key() string {
+	return t.Source + "/" + t.ID
+}
+
+// find checks the host and its parent domains, starting with the top-level one like the web interface does
+func (db *trackerDB) find(host string) *tracker {
+	pos := len(host)
+	for pos >= 0 {
+		pos = strings.LastIndexByte(host[:pos], '.')
+		if id, ok := db.TrackerDomains[host[pos+1:]]; ok {
+			return db.get(id)
+		}
+	}
+	return nil
+}
+
+// findTracker returns the tracker the host belongs to, or nil if it's not a known tracker
+func findTracker(host string) *tracker {
+	trackerDBsOnce.Do(loadTrackerDBs)
+	if len(host) == 0 {
+		return nil
+	}
+	for _, db := range trackerDBs {
+		t := db.find(host)
+		if t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// findTrackerByKey returns the tracker with the key returned by tracker.key(), or nil if it's not in the databases
+func findTrackerByKey(key string) *tracker {
+	trackerDBsOnce.Do(loadTrackerDBs)
+	pos := strings.IndexByte(key, '/')
+	if pos < 0 {
+		return nil
+	}
+	for _, db := range trackerDBs {
+		if db.source == key[:pos] {
+			return db.get(key[pos+1:])
+		}
+	}
+	return nil
+}
+
+// marshalTopTrackers returns JSON with the trackers of the hosts listed in the tops, keyed by host
+func marshalTopTrackers(tops ...[]string) ([]byte, error) {
+	trackers := map[string]*tracker{}
+	for _, top := range tops {
+		for _, host := range top {
+			if t := findTracker(host); t != nil {
+				trackers[host] = t
+			}
+		}
+	}
+	return json.Marshal(trackers)
+}
+
+// trackerStatsPrefix starts the names of the periodic stats of the trackers, it's followed by tracker.key()
+const trackerStatsPrefix = "tracker:"
+
+// countTracker counts the request to the tracker of all clients in the periodic stats, so it's kept for the stats retention
+func countTracker(t *tracker, when time.Time) {
+	name := trackerStatsPrefix + t.key()
+	countStats(when, func(p *periodicStats) {
+		p.Inc(name, when)
+	})
+}
+
+// getTrackerTotals sums up the tracker requests of all clients for the period, keyed by tracker.key()
+func getTrackerTotals(period time.Duration) (map[string]int, bool) {
+	// the per-hour stats are used while they're kept, they are more precise
+	now := time.Now()
+	unit, ok := findStatsUnit(statsUnitHours, now.Add(-period), now)
+	if !ok {
+		return nil, false
+	}
+	return sumPeriodicStats(unit.stats, trackerStatsPrefix, int(period/unit.period)), true
+}
+
+// getClientTrackersTop sums up the tracker requests of the client for the last 24 hours, keyed by tracker.key()
+// the per-client counts are limited in size and kept only in the top of the last 24 hours
+func getClientTrackersTop(client string) map[string]int {
+	top := map[string]int{}
+	runningTop.hoursReadLock()
+	for hour := 0; hour < 24; hour++ {
+		h := runningTop.hours[hour]
+		h.RLock()
+		if cache, ok := h.trackers[client]; ok {
+			for _, ikey := range cache.Keys() {
+				key, ok := ikey.(string)
+				if !ok {
+					continue
+				}
+				value, err := h.lockedGetValue(key, cache)
+				if err != nil {
+					log.Printf("Failed to get top trackers value for %v: %s", key, err)
+					break
+				}
+				top[key] += value
+			}
+		}
+		h.RUnlock()
+	}
+	runningTop.hoursReadUnlock()
+	return top
+}
+
+// HandleStatsTrackers returns the number of requests to trackers by company and by category
+// period is 24h, 7d or 30d like in /control/stats, the trackers of a client are counted for 24 hours at most
+func HandleStatsTrackers(w http.ResponseWriter, r *http.Request) {
+	client := r.URL.Query().Get("client")
+	period, err := parseStatsPeriod(r.URL.Query().Get("period"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var top map[string]int
+	if len(client) == 0 {
+		var ok bool
+		top, ok = getTrackerTotals(period.duration)
+		if !ok {
+			http.Error(w, fmt.Sprintf("Stats are kept only for %d days", getStatsRetention()), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if period.duration > queryLogTimeLimit {
+			period = statsPeriods["24h"]
+		}
+		top = getClientTrackersTop(client)
+	}
+
+	type companyJSON struct {
+		tracker
+		Count int `json:"count"`
+	}
+	companies := []companyJSON{}
+	categories := map[string]int{}
+	for key, count := range top {
+		t := findTrackerByKey(key)
+		if t == nil {
+			continue
+		}
+		companies = append(companies, companyJSON{tracker: *t, Count: count})
+		categories[t.Category] += count
+	}
+	sort.Slice(companies, func(l, r int) bool {
+		return companies[l].Count > companies[r].Count
+	})
+
+	data := map[string]interface{}{
+		"companies":    companies,
+		"categories":   categories,
+		"stats_period": period.text,
+	}
+	if len(client) != 0 {
+		data["client"] = client
+	}
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		errortext := fmt.Sprintf("Unable to marshal trackers json: %s", err)
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errortext := fmt.Sprintf("Couldn't write body: %s", err)
+		log.Println(errortext)
+		http.Error(w, errortext, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,89 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTrackerKey(t *testing.T) {
+	// both databases have the adocean ID, each for its own domain and company
+	tests := []struct {
+		host   string
+		source string
+	}{
+		{"ads.adocean.cz", "WhiteHat"},
+		{"ads.adocean.pl", "Whotracks.me"},
+	}
+	for _, tc := range tests {
+		found := findTracker(tc.host)
+		if found == nil {
+			t.Fatalf("%s: expected a tracker", tc.host)
+		}
+		if found.Source != tc.source {
+			t.Errorf("%s: expected the tracker from %s, got %+v", tc.host, tc.source, found)
+		}
+		byKey := findTrackerByKey(found.key())
+		if byKey == nil || *byKey != *found {
+			t.Errorf("%s: expected %+v by key %s, got %+v", tc.host, found, found.key(), byKey)
+		}
+	}
+}
+
+func TestHandleStatsTrackers(t *testing.T) {
+	defer purgeStats()
+	purgeStats()
+
+	tracker := findTracker("ads.adocean.pl")
+	if tracker == nil {
+		t.Fatal("expected a tracker")
+	}
+	now := time.Now()
+	countTracker(tracker, now.Add(-time.Hour))
+	countTracker(tracker, now.Add(-3*24*time.Hour))
+
+	tests := []struct {
+		query  string
+		code   int
+		count  int
+		period string
+	}{
+		{"", http.StatusOK, 1, "24 hours"},
+		{"?period=7d", http.StatusOK, 2, "7 days"},
+		{"?period=30d", http.StatusOK, 2, "30 days"},
+		// the trackers of a client are counted for 24 hours at most
+		{"?period=7d&client=192.168.1.10", http.StatusOK, 0, "24 hours"},
+		{"?period=1y", http.StatusBadRequest, 0, ""},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		HandleStatsTrackers(w, httptest.NewRequest(http.MethodGet, "/control/stats/trackers"+tc.query, nil))
+		if w.Code != tc.code {
+			t.Errorf("%s: expected %d, got %d %s", tc.query, tc.code, w.Code, w.Body.String())
+			continue
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		data := struct {
+			Companies []struct {
+				Source string `json:"source"`
+				Count  int    `json:"count"`
+			} `json:"companies"`
+			Period string `json:"stats_period"`
+		}{}
+		err := json.Unmarshal(w.Body.Bytes(), &data)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.query, err)
+		}
+		count := 0
+		for _, c := range data.Companies {
+			count += c.Count
+		}
+		if count != tc.count || data.Period != tc.period {
+			t.Errorf("%s: expected %d requests for %s, got %d for %s", tc.query, tc.count, tc.period, count, data.Period)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// BlockedService is a service like a social network or a game platform that is blocked as a whole
+type BlockedService struct {
+	ID    string   `json:"id"`    // used in the settings and in the rules, lowercase letters, digits and underscores only
+	Name  string   `json:"name"`  // shown to the user
+	Rules []string `json:"rules"` // rules blocking the service domains, e.g. "||tiktok.com^"
+}
+
+// FilterRules returns the rules of the service marked with $blocked_service modifier,
+// so that the requests they block are reported with FilteredBlockedService reason
+func (s *BlockedService) FilterRules() []string {
+	rules := []string{}
+	for _, text := range s.Rules {
+		text = strings.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+		separator := "$"
+		if strings.Contains(text, "$") {
+			separator = ","
+		}
+		rules = append(rules, text+separator+"blocked_service="+s.ID)
+	}
+	return rules
+}
+
+// checks if the text can be used as a service ID
+func isValidServiceID(id string) bool {
+	if len(id) == 0 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func checkBlockedServices(services []BlockedService) error {
+	ids := map[string]bool{}
+	for i, service := range services {
+		if !isValidServiceID(service.ID) {
+			return fmt.Errorf("blocked service #%d has invalid id %q", i+1, service.ID)
+		}
+		if ids[service.ID] {
+			return fmt.Errorf("blocked service %s is specified more than once", service.ID)
+		}
+		ids[service.ID] = true
+		if len(service.Name) == 0 {
+			return fmt.Errorf("blocked service %s has no name", service.ID)
+		}
+		if len(service.Rules) == 0 {
+			return fmt.Errorf("blocked service %s has no rules", service.ID)
+		}
+	}
+	return nil
+}
+
+// LoadBlockedServices reads the list of services from a JSON file, e.g.
+// {"services": [{"id": "tiktok", "name": "TikTok", "rules": ["||tiktok.com^", "||tiktokv.com^"]}]}
+func LoadBlockedServices(path string) ([]BlockedService, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := struct {
+		Services []BlockedService `json:"services"`
+	}{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %s", path, err)
+	}
+	err = checkBlockedServices(data.Services)
+	if err != nil {
+		return nil, err
+	}
+	return data.Services, nil
+}
+
+// DefaultBlockedServices returns the built-in list of services, it must not be modified
+func DefaultBlockedServices() []BlockedService {
+	return defaultBlockedServices
+}
+
+var defaultBlockedServices = []BlockedService{
+	{"facebook", "Facebook", []string{"||facebook.com^", "||facebook.net^", "||fbcdn.net^", "||fb.com^", "||fb.me^", "||fbsbx.com^", "||messenger.com^"}},
+	{"instagram", "Instagram", []string{"||instagram.com^", "||cdninstagram.com^", "||instagr.am^"}},
+	{"whatsapp", "WhatsApp", []string{"||whatsapp.com^", "||whatsapp.net^", "||wa.me^"}},
+	{"twitter", "Twitter", []string{"||twitter.com^", "||twimg.com^", "||t.co^", "||x.com^"}},
+	{"youtube", "YouTube", []string{"||youtube.com^", "||ytimg.com^", "||youtu.be^", "||googlevideo.com^", "||youtubei.googleapis.com^", "||youtube-nocookie.com^"}},
+	{"tiktok", "TikTok", []string{"||tiktok.com^", "||tiktokv.com^", "||tiktokcdn.com^", "||musical.ly^", "||byteoversea.com^", "||ibytedtos.com^", "||muscdn.com^"}},
+	{"snapchat", "Snapchat", []string{"||snapchat.com^", "||snap.com^", "||snapkit.com^", "||sc-cdn.net^", "||sc-static.net^"}},
+	{"reddit", "Reddit", []string{"||reddit.com^", "||redd.it^", "||redditmedia.com^", "||redditstatic.com^"}},
+	{"pinterest", "Pinterest", []string{"||pinterest.com^", "||pinimg.com^"}},
+	{"vk", "VK", []string{"||vk.com^", "||vk.me^", "||vkuser.net^", "||userapi.com^"}},
+	{"ok", "OK.ru", []string{"||ok.ru^", "||odnoklassniki.ru^", "||mycdn.me^"}},
+	{"telegram", "Telegram", []string{"||telegram.org^", "||telegram.me^", "||t.me^", "||telegra.ph^"}},
+	{"discord", "Discord", []string{"||discord.com^", "||discord.gg^", "||discordapp.com^", "||discordapp.net^"}},
+	{"skype", "Skype", []string{"||skype.com^", "||skypeassets.com^"}},
+	{"tinder", "Tinder", []string{"||tinder.com^", "||gotinder.com^"}},
+	{"netflix", "Netflix", []string{"||netflix.com^", "||netflix.net^", "||nflxext.com^", "||nflximg.com^", "||nflximg.net^", "||nflxso.net^", "||nflxvideo.net^"}},
+	{"twitch", "Twitch", []string{"||twitch.tv^", "||ttvnw.net^", "||jtvnw.net^", "||twitchcdn.net^"}},
+	{"steam", "Steam", []string{"||steampowered.com^", "||steamcommunity.com^", "||steamstatic.com^", "||steamcontent.com^", "||steamgames.com^", "||steamusercontent.com^"}},
+	{"epic_games", "Epic Games", []string{"||epicgames.com^", "||unrealengine.com^", "||fortnite.com^"}},
+	{"origin", "Origin", []string{"||origin.com^", "||signin.ea.com^", "||accounts.ea.com^"}},
+	{"roblox", "Roblox", []string{"||roblox.com^", "||rbxcdn.com^", "||rbx.com^"}},
+	{"ebay", "eBay", []string{"||ebay.com^", "||ebayimg.com^", "||ebaystatic.com^"}},
+	{"amazon", "Amazon", []string{"||amazon.com^", "||media-amazon.com^", "||primevideo.com^", "||amazonvideo.com^"}},
+}
@@ -3,11 +3,11 @@ package dnsfilter
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
@@ -19,6 +19,7 @@ import (
 
 	"github.com/bluele/gcache"
 	"golang.org/x/net/publicsuffix"
+	"golang.org/x/sync/singleflight"
 )
 
 const defaultCacheSize = 64 * 1024 // in number of elements
@@ -38,6 +39,10 @@ var ErrInvalidSyntax = errors.New("dnsfilter: invalid rule syntax")
 // ErrInvalidSyntax is returned by AddRule when the rule was already added to the filter
 var ErrAlreadyExists = errors.New("dnsfilter: rule was already added")
 
+// ErrNotCached is returned by the safebrowsing and parental checks when they are made with the context
+// from WithCachedLookupsOnly and the result of the network lookup isn't cached
+var ErrNotCached = errors.New("dnsfilter: lookup result is not cached")
+
 // ErrInvalidParental is returned by EnableParental when sensitivity is not a valid value
 var ErrInvalidParental = errors.New("dnsfilter: invalid parental sensitivity, must be either 3, 10, 13 or 17")
 
@@ -46,28 +51,39 @@ const shortcutLength = 6 // used for rule search optimization, 6 hits the sweet
 const enableFastLookup = true         // flag for debugging, must be true in production for faster performance
 const enableDelayedCompilation = true // flag for debugging, must be true in production for faster performance
 
+// flag for debugging and benchmarks, set to false to match ||example.org^ rules by shortcuts instead
+// it's read when the rules are added
+var enableTrieLookup = true
+
 type config struct {
 	parentalServer      string
 	parentalSensitivity int // must be either 3, 10, 13 or 17
 	parentalEnabled     bool
 	safeSearchEnabled   bool
+	safeSearchCatalog   *SafeSearchCatalog
+	safeSearchEngines   map[string]bool // engines enabled or disabled explicitly, others use the catalog default
 	safeBrowsingEnabled bool
 	safeBrowsingServer  string
 }
 
 type rule struct {
-	text         string // text without @@ decorators or $ options
-	shortcut     string // for speeding up lookup
-	originalText string // original text for reporting back to applications
-	ip           net.IP // IP address (for the case when we're matching a hosts file)
+	text         string     // text without @@ decorators or $ options
+	shortcut     string     // for speeding up lookup
+	originalText string     // original text for reporting back to applications
+	ip           net.IP     // IP address (for the case when we're matching a hosts file)
+	ipNet        *net.IPNet // blocked network (for the case when we're matching IP addresses in responses)
 
 	// options
 	options []string // optional options after $
 
 	// parsed options
-	apps        []string
-	isWhitelist bool
-	isImportant bool
+	apps           []string
+	clients        []ruleClient  // $client modifier, rule applies only to these clients
+	dnsTypes       []ruleDNSType // $dnstype modifier, rule applies only to these query types
+	dnsRewrite     *ruleDNSRewrite
+	blockedService string // $blocked_service modifier, ID of the service the rule blocks
+	isWhitelist    bool
+	isImportant    bool
 
 	// user-supplied data
 	listID int64
@@ -88,6 +104,8 @@ type LookupStats struct {
 	CacheHits  uint64 // number of lookups that didn't need HTTP requests
 	Pending    int64  // number of currently pending HTTP requests
 	PendingMax int64  // maximum number of pending HTTP requests
+	Timeouts   uint64 // number of lookups that were given up because the query deadline passed
+	Coalesced  uint64 // number of lookups that shared the result with concurrent lookups of the same host
 }
 
 // Stats store LookupStats for both safebrowsing and parental
@@ -96,6 +114,45 @@ type Stats struct {
 	Parental     LookupStats
 }
 
+// LookupTrace records which network lookups CheckRequest had to wait for because they weren't cached
+type LookupTrace struct {
+	Safebrowsing bool
+	Parental     bool
+}
+
+type lookupTraceKey struct{}
+
+// WithLookupTrace returns the context that makes CheckRequest record its network lookups in trace
+func WithLookupTrace(ctx context.Context, trace *LookupTrace) context.Context {
+	return context.WithValue(ctx, lookupTraceKey{}, trace)
+}
+
+type cachedLookupsOnlyKey struct{}
+
+// WithCachedLookupsOnly returns the context that makes the checks use the cached safebrowsing and parental results
+// instead of the network lookups, the hosts that aren't cached fail the checks with ErrNotCached
+func WithCachedLookupsOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cachedLookupsOnlyKey{}, true)
+}
+
+func cachedLookupsOnly(ctx context.Context) bool {
+	only, _ := ctx.Value(cachedLookupsOnlyKey{}).(bool)
+	return only
+}
+
+func traceLookup(ctx context.Context, lookupstats *LookupStats) {
+	trace, ok := ctx.Value(lookupTraceKey{}).(*LookupTrace)
+	if !ok {
+		return
+	}
+	switch lookupstats {
+	case &stats.Safebrowsing:
+		trace.Safebrowsing = true
+	case &stats.Parental:
+		trace.Parental = true
+	}
+}
+
 // Dnsfilter holds added rules and performs hostname matches against the rules
 type Dnsfilter struct {
 	storage      map[string]bool // rule storage, not used for matching, just for filtering out duplicates
@@ -110,6 +167,10 @@ type Dnsfilter struct {
 	client    http.Client     // handle for http client -- single instance as recommended by docs
 	transport *http.Transport // handle for http transport used by http client
 
+	// safebrowsing and parental databases, HTTP lookups by default
+	safeBrowsingLookup LookupProvider
+	parentalLookup     LookupProvider
+
 	config config
 }
 
@@ -125,11 +186,14 @@ const (
 	NotFilteredError                   // there was a transitive error during check
 
 	// reasons for filtering
-	FilteredBlackList    // the host was matched to be advertising host
-	FilteredSafeBrowsing // the host was matched to be malicious/phishing
-	FilteredParental     // the host was matched to be outside of parental control settings
-	FilteredInvalid      // the request was invalid and was not processed
-	FilteredSafeSearch   // the host was replaced with safesearch variant
+	FilteredBlackList      // the host was matched to be advertising host
+	FilteredSafeBrowsing   // the host was matched to be malicious/phishing
+	FilteredParental       // the host was matched to be outside of parental control settings
+	FilteredInvalid        // the request was invalid and was not processed
+	FilteredSafeSearch     // the host was replaced with safesearch variant
+	FilteredDNSRewrite     // the response was synthesized by $dnsrewrite rules
+	FilteredBlockedIP      // the response contained an IP address from a blocked network
+	FilteredBlockedService // the host belongs to a blocked service
 )
 
 // these variables need to survive coredns reload
@@ -137,6 +201,10 @@ var (
 	stats             Stats
 	safebrowsingCache gcache.Cache
 	parentalCache     gcache.Cache
+
+	// in-flight lookups, shared by all instances just like the caches
+	safebrowsingLookups singleflight.Group
+	parentalLookups     singleflight.Group
 )
 
 // Result holds state of hostname check
@@ -146,6 +214,27 @@ type Result struct {
 	Rule       string `json:",omitempty"` // Original rule text
 	Ip         net.IP `json:",omitempty"` // Not nil only in the case of a hosts file syntax
 	FilterID   int64  `json:",omitempty"` // Filter ID the rule belongs to
+
+	DNSRewrite *DNSRewriteResult `json:",omitempty"` // Not nil only if Reason is FilteredDNSRewrite
+
+	// CNAME targets of the upstream response, set only if the response was blocked because of its records
+	CNAMEChain []string `json:",omitempty"`
+
+	ServiceID string `json:",omitempty"` // ID of the blocked service, set only if Reason is FilteredBlockedService
+
+	dnsTypeOnly bool // the matched rule has $dnstype modifier, see IsDNSTypeSpecific
+}
+
+// IsDNSTypeSpecific tells if the result applies to some query types of the host only, like the rules with $dnstype modifier
+// such requests must not be answered with NXDOMAIN, resolvers cache it for all the types of the name (RFC 8020)
+func (r Result) IsDNSTypeSpecific() bool {
+	return r.dnsTypeOnly
+}
+
+// ClientInfo describes the client that sent the request, it's used by the rules with $client modifier
+type ClientInfo struct {
+	IP   net.IP // client IP address
+	Name string // name of the client, empty if unknown
 }
 
 // Matched can be used to see if any match at all was found, no matter filtered or not
@@ -155,6 +244,13 @@ func (r Reason) Matched() bool {
 
 // CheckHost tries to match host against rules, then safebrowsing and parental if they are enabled
 func (d *Dnsfilter) CheckHost(host string) (Result, error) {
+	return d.CheckRequest(context.Background(), host, 0, ClientInfo{})
+}
+
+// CheckRequest is the same as CheckHost, but it also takes into account the rules
+// restricted to specific clients ($client) or query types ($dnstype), qtype is 0 if unknown
+// safebrowsing and parental lookups are given up when ctx is done, the host isn't filtered by them then
+func (d *Dnsfilter) CheckRequest(ctx context.Context, host string, qtype uint16, client ClientInfo) (Result, error) {
 	// sometimes DNS clients will try to resolve ".", which is a request to get root servers
 	if host == "" {
 		return Result{Reason: NotFilteredNotFound}, nil
@@ -162,7 +258,7 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	host = strings.ToLower(host)
 
 	// try filter lists first
-	result, err := d.matchHost(host)
+	result, err := d.matchHost(host, qtype, client)
 	if err != nil {
 		return result, err
 	}
@@ -173,7 +269,7 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 
 	// check safebrowsing if no match
 	if d.config.safeBrowsingEnabled {
-		result, err = d.checkSafeBrowsing(host)
+		result, err = d.checkSafeBrowsing(ctx, host)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
 			log.Printf("Failed to do safebrowsing HTTP lookup, ignoring check: %v", err)
@@ -186,7 +282,7 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 
 	// check parental if no match
 	if d.config.parentalEnabled {
-		result, err = d.checkParental(host)
+		result, err = d.checkParental(ctx, host)
 		if err != nil {
 			// failed to do HTTP lookup -- treat it as if we got empty response, but don't save cache
 			log.Printf("Failed to do parental HTTP lookup, ignoring check: %v", err)
@@ -201,31 +297,65 @@ func (d *Dnsfilter) CheckHost(host string) (Result, error) {
 	return Result{}, nil
 }
 
+// CheckHostRules matches host against the filtering rules only, without safebrowsing and parental lookups
+// it's used for the names and addresses found in the upstream responses
+func (d *Dnsfilter) CheckHostRules(host string, qtype uint16, client ClientInfo) (Result, error) {
+	if host == "" {
+		return Result{Reason: NotFilteredNotFound}, nil
+	}
+	return d.matchHost(strings.ToLower(host), qtype, client)
+}
+
 //
 // rules table
 //
 
 type rulesTable struct {
-	rulesByHost     map[string]*rule
-	rulesByShortcut map[string][]*rule
-	rulesLeftovers  []*rule
+	rulesByName     *hostTrie          // hosts-syntax and ||example.org^ rules
+	rulesByShortcut map[string][]*rule // other adblock-syntax rules with a shortcut
+	rulesLeftovers  []*rule            // adblock-syntax rules too short to have a shortcut, regexps
+	rulesByNetwork  networkIndex       // ||203.0.113.0/24^ rules, matched against the IP addresses in responses
+
+	// $dnsrewrite rules, they're looked up separately since all of them are combined into a single response
+	rewritesByName    *hostTrie // ||example.org^$dnsrewrite rules
+	rewritesLeftovers []*rule   // other $dnsrewrite rules
 	sync.RWMutex
 }
 
 func newRulesTable() *rulesTable {
 	return &rulesTable{
-		rulesByHost:     make(map[string]*rule),
+		rulesByName:     &hostTrie{},
 		rulesByShortcut: make(map[string][]*rule),
 		rulesLeftovers:  make([]*rule, 0),
+		rewritesByName:  &hostTrie{},
 	}
 }
 
 func (r *rulesTable) Add(rule *rule) {
 	r.Lock()
 
-	if rule.ip != nil {
+	if rule.ipNet != nil && rule.dnsRewrite == nil && !rule.isNetworkOnly() {
+		// ||203.0.113.1^ blocks the address in responses and still matches the host name written as the address
+		r.rulesByNetwork.add(rule)
+	}
+	if rule.dnsRewrite != nil && !rule.isWhitelist {
+		// $dnsrewrite rules, whitelisted ones are regular whitelist rules
+		if rule.extractSuffix() {
+			r.rewritesByName.addSuffix(rule.suffix, rule)
+		} else {
+			r.rewritesLeftovers = append(r.rewritesLeftovers, rule)
+		}
+	} else if rule.ip != nil {
 		// Hosts syntax
-		r.rulesByHost[rule.text] = rule
+		r.rulesByName.addExact(rule.text, rule)
+	} else if rule.isNetworkOnly() {
+		// Blocked network
+		r.rulesByNetwork.add(rule)
+	} else if //noinspection GoBoolExpressions
+	rule.extractSuffix() && enableTrieLookup {
+
+		// Adblock syntax matching the domain and its subdomains
+		r.rulesByName.addSuffix(rule.suffix, rule)
 	} else if //noinspection GoBoolExpressions
 	len(rule.shortcut) == shortcutLength && enableFastLookup {
 
@@ -239,19 +369,16 @@ func (r *rulesTable) Add(rule *rule) {
 	r.Unlock()
 }
 
-func (r *rulesTable) matchByHost(host string) (Result, error) {
+func (r *rulesTable) matchByHost(host string, qtype uint16, client ClientInfo) (Result, error) {
 
-	// First: examine the hosts-syntax rules
-	res, err := r.searchByHost(host)
-	if err != nil {
-		return res, err
-	}
+	// First: examine the hosts-syntax and suffix rules
+	res := r.searchByName(host, qtype, client)
 	if res.Reason.Matched() {
 		return res, nil
 	}
 
 	// Second: examine the adblock-syntax rules with shortcuts
-	res, err = r.searchShortcuts(host)
+	res, err := r.searchShortcuts(host, qtype, client)
 	if err != nil {
 		return res, err
 	}
@@ -260,7 +387,7 @@ func (r *rulesTable) matchByHost(host string) (Result, error) {
 	}
 
 	// Third: examine the others
-	res, err = r.searchLeftovers(host)
+	res, err = r.searchLeftovers(host, qtype, client)
 	if err != nil {
 		return res, err
 	}
@@ -271,18 +398,20 @@ func (r *rulesTable) matchByHost(host string) (Result, error) {
 	return Result{}, nil
 }
 
-func (r *rulesTable) searchByHost(host string) (Result, error) {
-
-	rule, ok := r.rulesByHost[host]
-
-	if ok {
-		return rule.match(host)
-	}
-
-	return Result{}, nil
+func (r *rulesTable) searchByName(host string, qtype uint16, client ClientInfo) Result {
+	res := Result{}
+	r.rulesByName.walk(host, func(rule *rule) bool {
+		if !rule.matchOptions(qtype, client) {
+			return true
+		}
+		// the trie has already matched the host, no need to check it again
+		res = rule.result()
+		return false
+	})
+	return res
 }
 
-func (r *rulesTable) searchShortcuts(host string) (Result, error) {
+func (r *rulesTable) searchShortcuts(host string, qtype uint16, client ClientInfo) (Result, error) {
 	// check in shortcuts first
 	for i := 0; i < len(host); i++ {
 		shortcut := host[i:]
@@ -297,7 +426,7 @@ func (r *rulesTable) searchShortcuts(host string) (Result, error) {
 			continue
 		}
 		for _, rule := range rules {
-			res, err := rule.match(host)
+			res, err := rule.match(host, qtype, client)
 			// error? stop search
 			if err != nil {
 				return res, err
@@ -312,9 +441,9 @@ func (r *rulesTable) searchShortcuts(host string) (Result, error) {
 	return Result{}, nil
 }
 
-func (r *rulesTable) searchLeftovers(host string) (Result, error) {
+func (r *rulesTable) searchLeftovers(host string, qtype uint16, client ClientInfo) (Result, error) {
 	for _, rule := range r.rulesLeftovers {
-		res, err := rule.match(host)
+		res, err := rule.match(host, qtype, client)
 		// error? stop search
 		if err != nil {
 			return res, err
@@ -328,6 +457,59 @@ func (r *rulesTable) searchLeftovers(host string) (Result, error) {
 	return Result{}, nil
 }
 
+// matchAllByHost returns all the rules matching host, not just the first one
+func (r *rulesTable) matchAllByHost(host string, qtype uint16, client ClientInfo) ([]Result, error) {
+	results := []Result{}
+
+	r.rulesByName.walk(host, func(rule *rule) bool {
+		if rule.matchOptions(qtype, client) {
+			results = append(results, rule.result())
+		}
+		return true
+	})
+
+	// a rule can be found by different shortcuts of the same host
+	seen := map[*rule]bool{}
+	check := func(rule *rule) error {
+		if seen[rule] {
+			return nil
+		}
+		seen[rule] = true
+		res, err := rule.match(host, qtype, client)
+		if err != nil {
+			return err
+		}
+		if res.Reason.Matched() {
+			results = append(results, res)
+		}
+		return nil
+	}
+
+	for i := 0; i+shortcutLength <= len(host); i++ {
+		for _, rule := range r.rulesByShortcut[host[i:i+shortcutLength]] {
+			if err := check(rule); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, rule := range r.rulesLeftovers {
+		if err := check(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	rewrites, err := r.matchDNSRewrites(host, qtype, client)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rewrites {
+		results = append(results, rule.result())
+	}
+
+	return results, nil
+}
+
 func findOptionIndex(text string) int {
 	for i, r := range text {
 		// ignore non-$
@@ -398,6 +580,33 @@ func (rule *rule) parseOptions() error {
 		case strings.HasPrefix(option, "app="):
 			option = strings.TrimPrefix(option, "app=")
 			rule.apps = strings.Split(option, "|")
+		case strings.HasPrefix(option, "client="):
+			option = strings.TrimPrefix(option, "client=")
+			clients, err := parseRuleClients(option)
+			if err != nil {
+				return err
+			}
+			rule.clients = clients
+		case strings.HasPrefix(option, "dnsrewrite="):
+			option = strings.TrimPrefix(option, "dnsrewrite=")
+			dnsRewrite, err := parseRuleDNSRewrite(option)
+			if err != nil {
+				return err
+			}
+			rule.dnsRewrite = dnsRewrite
+		case strings.HasPrefix(option, "dnstype="):
+			option = strings.TrimPrefix(option, "dnstype=")
+			dnsTypes, err := parseRuleDNSTypes(option)
+			if err != nil {
+				return err
+			}
+			rule.dnsTypes = dnsTypes
+		case strings.HasPrefix(option, "blocked_service="):
+			option = strings.TrimPrefix(option, "blocked_service=")
+			if !isValidServiceID(option) {
+				return ErrInvalidSyntax
+			}
+			rule.blockedService = option
 		default:
 			return ErrInvalidSyntax
 		}
@@ -431,6 +640,25 @@ func (rule *rule) extractShortcut() {
 	rule.shortcut = strings.ToLower(longestField)
 }
 
+// Checks if the rule is ||example.org^ and can be matched by suffix without compiling it
+// must be called before the rule is added to a table
+func (rule *rule) extractSuffix() bool {
+	if len(rule.text) < 4 {
+		return false
+	}
+	isSuffix, suffix := getSuffix(rule.text)
+	if !isSuffix {
+		return false
+	}
+	suffix = strings.ToLower(suffix)
+	if !isTrieHost(suffix) {
+		return false
+	}
+	rule.isSuffix = true
+	rule.suffix = suffix
+	return true
+}
+
 func (rule *rule) compile() error {
 	rule.RLock()
 	isCompiled := rule.isSuffix || rule.compiled != nil
@@ -466,23 +694,22 @@ func (rule *rule) compile() error {
 }
 
 // Checks if the rule matches the specified host and returns a corresponding Result object
-func (rule *rule) match(host string) (Result, error) {
-	res := Result{}
+func (rule *rule) match(host string, qtype uint16, client ClientInfo) (Result, error) {
+	if !rule.matchOptions(qtype, client) {
+		return Result{}, nil
+	}
 
-	if rule.ip != nil && rule.text == host {
-		// This is a hosts-syntax rule -- just check that the hostname matches and return the result
-		return Result{
-			IsFiltered: true,
-			Reason:     FilteredBlackList,
-			Rule:       rule.originalText,
-			Ip:         rule.ip,
-			FilterID:   rule.listID,
-		}, nil
+	if rule.ip != nil {
+		// This is a hosts-syntax rule -- just check that the hostname matches
+		if rule.text == host {
+			return rule.result(), nil
+		}
+		return Result{}, nil
 	}
 
 	err := rule.compile()
 	if err != nil {
-		return res, err
+		return Result{}, err
 	}
 	rule.RLock()
 	matched := false
@@ -497,23 +724,68 @@ func (rule *rule) match(host string) (Result, error) {
 	}
 	rule.RUnlock()
 	if matched {
-		res.Reason = FilteredBlackList
-		res.IsFiltered = true
-		res.FilterID = rule.listID
-		res.Rule = rule.originalText
-		if rule.isWhitelist {
-			res.Reason = NotFilteredWhiteList
-			res.IsFiltered = false
+		return rule.result(), nil
+	}
+	return Result{}, nil
+}
+
+// Checks if the rule options allow it to be applied to the request
+func (rule *rule) matchOptions(qtype uint16, client ClientInfo) bool {
+	if !rule.matchClient(client) {
+		// This rule is restricted to other clients
+		return false
+	}
+	if !rule.matchDNSType(qtype) {
+		// This rule is restricted to other query types
+		return false
+	}
+	return true
+}
+
+// Returns the Result object for the case when the rule matches the host
+func (rule *rule) result() Result {
+	if rule.ip != nil {
+		return Result{
+			IsFiltered: true,
+			Reason:     FilteredBlackList,
+			Rule:       rule.originalText,
+			Ip:         rule.ip,
+			FilterID:   rule.listID,
 		}
 	}
-	return res, nil
+
+	res := Result{
+		IsFiltered:  true,
+		Reason:      FilteredBlackList,
+		FilterID:    rule.listID,
+		Rule:        rule.originalText,
+		dnsTypeOnly: len(rule.dnsTypes) != 0,
+	}
+	if rule.isWhitelist {
+		res.Reason = NotFilteredWhiteList
+		res.IsFiltered = false
+	} else if rule.dnsRewrite != nil {
+		res.Reason = FilteredDNSRewrite
+		res.IsFiltered = false
+	} else if len(rule.blockedService) != 0 {
+		res.Reason = FilteredBlockedService
+		res.ServiceID = rule.blockedService
+	}
+	return res
+}
+
+// lookupCacheKey is the key of safebrowsing and parental caches
+// parental results depend on the sensitivity of the client profile, it's zero for safebrowsing
+type lookupCacheKey struct {
+	host        string
+	sensitivity int
 }
 
-func getCachedReason(cache gcache.Cache, host string) (result Result, isFound bool, err error) {
+func getCachedReason(cache gcache.Cache, key lookupCacheKey) (result Result, isFound bool, err error) {
 	isFound = false // not found yet
 
 	// get raw value
-	rawValue, err := cache.Get(host)
+	rawValue, err := cache.Get(key)
 	if err == gcache.KeyNotFoundError {
 		// not a real error, just not found
 		err = nil
@@ -525,7 +797,7 @@ func getCachedReason(cache gcache.Cache, host string) (result Result, isFound bo
 	}
 
 	// since it can be something else, validate that it belongs to proper type
-	cachedValue, ok := rawValue.(Result)
+	cachedValue, ok := rawValue.(cachedResult)
 	if !ok {
 		// this is not our type -- error
 		text := "SHOULD NOT HAPPEN: entry with invalid type was found in lookup cache"
@@ -534,7 +806,7 @@ func getCachedReason(cache gcache.Cache, host string) (result Result, isFound bo
 		return
 	}
 	isFound = ok
-	return cachedValue, isFound, err
+	return cachedValue.Result, isFound, err
 }
 
 // for each dot, hash it and add it to string
@@ -574,11 +846,18 @@ func hostnameToHashParam(host string, addslash bool) (string, map[string]bool) {
 	return hashparam.String(), hashes
 }
 
-func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
+func (d *Dnsfilter) checkSafeBrowsing(ctx context.Context, host string) (Result, error) {
 	// prevent recursion -- checking the host of safebrowsing server makes no sense
 	if host == d.config.safeBrowsingServer {
 		return Result{}, nil
 	}
+	cache := getLookupCache(&safebrowsingCache)
+	result, err := d.lookupCommon(ctx, host, 0, &stats.Safebrowsing, cache, &safebrowsingLookups, true, d.safeBrowsingLookup)
+	return result, err
+}
+
+// newSafeBrowsingHTTPLookup creates the default safebrowsing provider that sends the hash prefixes to safeBrowsingServer
+func (d *Dnsfilter) newSafeBrowsingHTTPLookup() *httpLookup {
 	format := func(hashparam string) string {
 		url := fmt.Sprintf(defaultSafebrowsingURL, d.config.safeBrowsingServer, hashparam)
 		return url
@@ -608,18 +887,21 @@ func (d *Dnsfilter) checkSafeBrowsing(host string) (Result, error) {
 		}
 		return result, nil
 	}
-	if safebrowsingCache == nil {
-		safebrowsingCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
-	}
-	result, err := d.lookupCommon(host, &stats.Safebrowsing, safebrowsingCache, true, format, handleBody)
-	return result, err
+	return &httpLookup{d: d, lookupstats: &stats.Safebrowsing, format: format, handleBody: handleBody}
 }
 
-func (d *Dnsfilter) checkParental(host string) (Result, error) {
+func (d *Dnsfilter) checkParental(ctx context.Context, host string) (Result, error) {
 	// prevent recursion -- checking the host of parental safety server makes no sense
 	if host == d.config.parentalServer {
 		return Result{}, nil
 	}
+	cache := getLookupCache(&parentalCache)
+	result, err := d.lookupCommon(ctx, host, d.config.parentalSensitivity, &stats.Parental, cache, &parentalLookups, false, d.parentalLookup)
+	return result, err
+}
+
+// newParentalHTTPLookup creates the default parental provider that sends the hash prefixes to parentalServer
+func (d *Dnsfilter) newParentalHTTPLookup() *httpLookup {
 	format := func(hashparam string) string {
 		url := fmt.Sprintf(defaultParentalURL, d.config.parentalServer, hashparam, d.config.parentalSensitivity)
 		return url
@@ -654,20 +936,26 @@ func (d *Dnsfilter) checkParental(host string) (Result, error) {
 		}
 		return result, nil
 	}
-	if parentalCache == nil {
-		parentalCache = gcache.New(defaultCacheSize).LRU().Expiration(defaultCacheTime).Build()
-	}
-	result, err := d.lookupCommon(host, &stats.Parental, parentalCache, false, format, handleBody)
-	return result, err
+	return &httpLookup{d: d, lookupstats: &stats.Parental, format: format, handleBody: handleBody}
 }
 
 // real implementation of lookup/check
-func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gcache.Cache, hashparamNeedSlash bool, format func(hashparam string) string, handleBody func(body []byte, hashes map[string]bool) (Result, error)) (Result, error) {
+// concurrent lookups of the same host by the same provider are coalesced, every caller waits for the result until its ctx is done
+// the lookup itself isn't cancelled by ctx of any caller, it's bounded by the HTTP timeout, see SetHTTPTimeout
+// the providers that aren't Cached, like local databases, are neither cached nor coalesced
+func (d *Dnsfilter) lookupCommon(ctx context.Context, host string, sensitivity int, lookupstats *LookupStats, cache gcache.Cache, group *singleflight.Group, hashparamNeedSlash bool, provider LookupProvider) (Result, error) {
 	// if host ends with a dot, trim it
 	host = strings.ToLower(strings.Trim(host, "."))
+	key := lookupCacheKey{host: host, sensitivity: sensitivity}
+
+	if !provider.Cached() {
+		hashparam, hashes := hostnameToHashParam(host, hashparamNeedSlash)
+		result, _, err := provider.Lookup(ctx, hashparam, hashes, sensitivity)
+		return result, err
+	}
 
 	// check cache
-	cachedValue, isFound, err := getCachedReason(cache, host)
+	cachedValue, isFound, err := getCachedReason(cache, key)
 	if isFound {
 		atomic.AddUint64(&lookupstats.CacheHits, 1)
 		return cachedValue, nil
@@ -675,59 +963,62 @@ func (d *Dnsfilter) lookupCommon(host string, lookupstats *LookupStats, cache gc
 	if err != nil {
 		return Result{}, err
 	}
-
-	// convert hostname to hash parameters
-	hashparam, hashes := hostnameToHashParam(host, hashparamNeedSlash)
-
-	// format URL with our hashes
-	url := format(hashparam)
-
-	// do HTTP request
-	atomic.AddUint64(&lookupstats.Requests, 1)
-	atomic.AddInt64(&lookupstats.Pending, 1)
-	updateMax(&lookupstats.Pending, &lookupstats.PendingMax)
-	resp, err := d.client.Get(url)
-	atomic.AddInt64(&lookupstats.Pending, -1)
-	if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
+	if cachedLookupsOnly(ctx) {
+		return Result{}, ErrNotCached
 	}
-	if err != nil {
-		// error, don't save cache
-		return Result{}, err
+	if provider.Remote() {
+		traceLookup(ctx, lookupstats)
 	}
 
-	// get body text
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		// error, don't save cache
-		return Result{}, err
-	}
+	started := false // true if this caller started the lookup, it's read after the result is received
+	groupKey := fmt.Sprintf("%s %d %s", host, sensitivity, lookupProviderKey(provider))
+	ch := group.DoChan(groupKey, func() (interface{}, error) {
+		started = true
 
-	// handle status code
-	switch {
-	case resp.StatusCode == 204:
-		// empty result, save cache
-		err = cache.Set(host, Result{})
+		// convert hostname to hash parameters
+		hashparam, hashes := hostnameToHashParam(host, hashparamNeedSlash)
+
+		timeout := d.client.Timeout
+		if timeout <= 0 {
+			timeout = defaultHTTPTimeout
+		}
+		lookupCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		result, cacheable, err := provider.Lookup(lookupCtx, hashparam, hashes, sensitivity)
 		if err != nil {
+			// error, don't save cache
 			return Result{}, err
 		}
-		return Result{}, nil
-	case resp.StatusCode != 200:
-		// error, don't save cache
-		return Result{}, nil
-	}
+		if !cacheable {
+			return result, nil
+		}
 
-	result, err := handleBody(body, hashes)
-	if err != nil {
-		// error, don't save cache
-		return Result{}, err
-	}
+		lookupCacheLock.RLock()
+		expires := time.Now().Add(lookupCacheTime)
+		lookupCacheLock.RUnlock()
+		err = cache.Set(key, cachedResult{Result: result, Expires: expires})
+		if err != nil {
+			return Result{}, err
+		}
+		return result, nil
+	})
 
-	err = cache.Set(host, result)
-	if err != nil {
-		return Result{}, err
+	select {
+	case res := <-ch:
+		if res.Shared && !started {
+			atomic.AddUint64(&lookupstats.Coalesced, 1)
+		}
+		if res.Err != nil {
+			if ctx.Err() != nil {
+				atomic.AddUint64(&lookupstats.Timeouts, 1)
+			}
+			return Result{}, res.Err
+		}
+		return res.Val.(Result), nil
+	case <-ctx.Done():
+		atomic.AddUint64(&lookupstats.Timeouts, 1)
+		return Result{}, ctx.Err()
 	}
-	return result, nil
 }
 
 //
@@ -774,6 +1065,7 @@ func (d *Dnsfilter) AddRule(input string, filterListID int64) error {
 	}
 
 	rule.extractShortcut()
+	rule.extractNetwork()
 
 	//noinspection GoBoolExpressions
 	if !enableDelayedCompilation {
@@ -819,7 +1111,7 @@ func (d *Dnsfilter) parseEtcHosts(input string, filterListID int64) bool {
 
 	for _, host := range fields[1:] {
 		rule := rule{
-			text:         host,
+			text:         strings.ToLower(host),
 			originalText: input,
 			listID:       filterListID,
 			ip:           addr,
@@ -830,7 +1122,7 @@ func (d *Dnsfilter) parseEtcHosts(input string, filterListID int64) bool {
 }
 
 // matchHost is a low-level way to check only if hostname is filtered by rules, skipping expensive safebrowsing and parental lookups
-func (d *Dnsfilter) matchHost(host string) (Result, error) {
+func (d *Dnsfilter) matchHost(host string, qtype uint16, client ClientInfo) (Result, error) {
 	lists := []*rulesTable{
 		d.important,
 		d.whiteList,
@@ -838,10 +1130,20 @@ func (d *Dnsfilter) matchHost(host string) (Result, error) {
 	}
 
 	for _, table := range lists {
-		res, err := table.matchByHost(host)
+		res, err := table.matchByHost(host, qtype, client)
 		if err != nil {
 			return res, err
 		}
+		if !res.Reason.Matched() || res.Reason == FilteredBlackList {
+			// $dnsrewrite rules of the host take precedence over a plain blocking rule
+			rewrites, err := table.matchDNSRewrites(host, qtype, client)
+			if err != nil {
+				return Result{}, err
+			}
+			if len(rewrites) != 0 {
+				return newDNSRewriteRulesResult(host, qtype, rewrites), nil
+			}
+		}
 		if res.Reason.Matched() {
 			return res, nil
 		}
@@ -877,6 +1179,9 @@ func New() *Dnsfilter {
 	}
 	d.config.safeBrowsingServer = defaultSafebrowsingServer
 	d.config.parentalServer = defaultParentalServer
+	d.config.safeSearchCatalog = defaultSafeSearchCatalog
+	d.safeBrowsingLookup = d.newSafeBrowsingHTTPLookup()
+	d.parentalLookup = d.newParentalHTTPLookup()
 
 	return d
 }
@@ -916,6 +1221,19 @@ func (d *Dnsfilter) EnableSafeSearch() {
 	d.config.safeSearchEnabled = true
 }
 
+// SetSafeSearchCatalog replaces the built-in list of search engines, nil restores it
+func (d *Dnsfilter) SetSafeSearchCatalog(catalog *SafeSearchCatalog) {
+	if catalog == nil {
+		catalog = defaultSafeSearchCatalog
+	}
+	d.config.safeSearchCatalog = catalog
+}
+
+// SetSafeSearchEngines enables or disables safesearch engines by name, the engines not in the map keep their catalog default
+func (d *Dnsfilter) SetSafeSearchEngines(engines map[string]bool) {
+	d.config.safeSearchEngines = engines
+}
+
 // SetSafeBrowsingServer lets you optionally change hostname of safesearch lookup
 func (d *Dnsfilter) SetSafeBrowsingServer(host string) {
 	if len(host) == 0 {
@@ -925,6 +1243,26 @@ func (d *Dnsfilter) SetSafeBrowsingServer(host string) {
 	}
 }
 
+// SetSafeBrowsingProvider replaces the HTTP lookups of safebrowsing with the specified provider
+// the provider isn't closed by Destroy since it can be shared by several instances
+func (d *Dnsfilter) SetSafeBrowsingProvider(provider LookupProvider) {
+	if provider == nil {
+		d.safeBrowsingLookup = d.newSafeBrowsingHTTPLookup()
+	} else {
+		d.safeBrowsingLookup = provider
+	}
+}
+
+// SetParentalProvider replaces the HTTP lookups of parental control with the specified provider
+// the provider isn't closed by Destroy since it can be shared by several instances
+func (d *Dnsfilter) SetParentalProvider(provider LookupProvider) {
+	if provider == nil {
+		d.parentalLookup = d.newParentalHTTPLookup()
+	} else {
+		d.parentalLookup = provider
+	}
+}
+
 // SetHTTPTimeout lets you optionally change timeout during lookups
 func (d *Dnsfilter) SetHTTPTimeout(t time.Duration) {
 	d.client.Timeout = t
@@ -935,13 +1273,12 @@ func (d *Dnsfilter) ResetHTTPTimeout() {
 	d.client.Timeout = defaultHTTPTimeout
 }
 
-// SafeSearchDomain returns replacement address for search engine
-func (d *Dnsfilter) SafeSearchDomain(host string) (string, bool) {
-	if d.config.safeSearchEnabled {
-		val, ok := safeSearchDomains[host]
-		return val, ok
+// SafeSearchDomain returns replacement for search engine, subdomains are matched by wildcard entries of the catalog
+func (d *Dnsfilter) SafeSearchDomain(host string) (SafeSearchTarget, bool) {
+	if !d.config.safeSearchEnabled {
+		return SafeSearchTarget{}, false
 	}
-	return "", false
+	return d.config.safeSearchCatalog.Find(host, SafeSearchEnabled(d.config.safeSearchEngines))
 }
 
 //
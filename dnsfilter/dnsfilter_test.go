@@ -0,0 +1,215 @@
+package dnsfilter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestFilter creates a filter with the rules of filter list 1
+func newTestFilter(t *testing.T, rules ...string) *Dnsfilter {
+	d := New()
+	for _, text := range rules {
+		err := d.AddRule(text, 1)
+		if err != nil {
+			t.Fatalf("couldn't add rule %s: %s", text, err)
+		}
+	}
+	return d
+}
+
+func TestCheckRequestClient(t *testing.T) {
+	d := newTestFilter(t,
+		"||games.example.org^$client=192.168.1.0/24|'Kids tablet'|~192.168.1.10",
+		"||ads.example.org^$client=~'Office laptop'",
+	)
+
+	tests := []struct {
+		host     string
+		client   ClientInfo
+		filtered bool
+	}{
+		{"games.example.org", ClientInfo{IP: net.ParseIP("192.168.1.20")}, true},
+		{"games.example.org", ClientInfo{IP: net.ParseIP("192.168.1.10")}, false},
+		{"games.example.org", ClientInfo{IP: net.ParseIP("10.0.0.1"), Name: "kids tablet"}, true},
+		{"games.example.org", ClientInfo{IP: net.ParseIP("10.0.0.1")}, false},
+		{"games.example.org", ClientInfo{}, false},
+		{"ads.example.org", ClientInfo{IP: net.ParseIP("10.0.0.1")}, true},
+		{"ads.example.org", ClientInfo{IP: net.ParseIP("10.0.0.1"), Name: "Office laptop"}, false},
+	}
+	for _, tc := range tests {
+		res, err := d.CheckRequest(context.Background(), tc.host, 0, tc.client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != tc.filtered {
+			t.Errorf("%s for %v: expected filtered=%v, got %+v", tc.host, tc.client, tc.filtered, res)
+		}
+	}
+}
+
+func TestCheckRequestDNSType(t *testing.T) {
+	d := newTestFilter(t,
+		"||ipv6.example.org^$dnstype=AAAA|HTTPS",
+		"||only-a.example.org^$dnstype=~A",
+		"||all.example.org^",
+	)
+
+	tests := []struct {
+		host     string
+		qtype    uint16
+		filtered bool
+		specific bool
+	}{
+		{"ipv6.example.org", dns.TypeAAAA, true, true},
+		{"ipv6.example.org", 65, true, true},
+		{"ipv6.example.org", dns.TypeA, false, false},
+		{"only-a.example.org", dns.TypeA, false, false},
+		{"only-a.example.org", dns.TypeMX, true, true},
+		{"all.example.org", dns.TypeAAAA, true, false},
+	}
+	for _, tc := range tests {
+		res, err := d.CheckRequest(context.Background(), tc.host, tc.qtype, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != tc.filtered || res.IsDNSTypeSpecific() != tc.specific {
+			t.Errorf("%s %s: expected filtered=%v specific=%v, got %+v", tc.host, dns.TypeToString[tc.qtype], tc.filtered, tc.specific, res)
+		}
+	}
+}
+
+func TestDNSRewrites(t *testing.T) {
+	d := newTestFilter(t,
+		"||example.org^",
+		"||example.org^$dnsrewrite=1.2.3.4",
+		"||www.example.org^$dnsrewrite=NOERROR;A;5.6.7.8",
+		"|anchored.example.net^$dnsrewrite=9.9.9.9",
+		"||allowed.example.org^$dnsrewrite=1.1.1.1",
+		"@@||allowed.example.org^",
+		"||blocked.example.com^",
+	)
+
+	tests := []struct {
+		host    string
+		reason  Reason
+		rule    string
+		answers []string
+	}{
+		{"www.example.org", FilteredDNSRewrite, "||www.example.org^$dnsrewrite=NOERROR;A;5.6.7.8", []string{"5.6.7.8", "1.2.3.4"}},
+		{"example.org", FilteredDNSRewrite, "||example.org^$dnsrewrite=1.2.3.4", []string{"1.2.3.4"}},
+		{"anchored.example.net", FilteredDNSRewrite, "|anchored.example.net^$dnsrewrite=9.9.9.9", []string{"9.9.9.9"}},
+		{"allowed.example.org", NotFilteredWhiteList, "@@||allowed.example.org^", nil},
+		{"blocked.example.com", FilteredBlackList, "||blocked.example.com^", nil},
+	}
+	for _, tc := range tests {
+		res, err := d.CheckRequest(context.Background(), tc.host, dns.TypeA, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Reason != tc.reason || res.Rule != tc.rule {
+			t.Errorf("%s: expected %s by %s, got %s by %s", tc.host, tc.reason, tc.rule, res.Reason, res.Rule)
+			continue
+		}
+		answers := []string{}
+		if res.DNSRewrite != nil {
+			for _, rr := range res.DNSRewrite.Answer {
+				answers = append(answers, rr.(*dns.A).A.String())
+			}
+		}
+		if len(answers) != len(tc.answers) {
+			t.Errorf("%s: expected answers %v, got %v", tc.host, tc.answers, answers)
+			continue
+		}
+		for i := range answers {
+			if answers[i] != tc.answers[i] {
+				t.Errorf("%s: expected answers %v, got %v", tc.host, tc.answers, answers)
+				break
+			}
+		}
+	}
+}
+
+func TestNetworkRules(t *testing.T) {
+	d := newTestFilter(t,
+		"||203.0.113.1^",
+		"||10.0.0.0/8^",
+		"@@||10.1.0.0/16^",
+		"||cafe.example.org^",
+	)
+
+	res, err := d.CheckRequest(context.Background(), "203.0.113.1", dns.TypeA, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != FilteredBlackList {
+		t.Errorf("the host rule for the address is lost: %+v", res)
+	}
+
+	tests := []struct {
+		ip     string
+		reason Reason
+	}{
+		{"203.0.113.1", FilteredBlockedIP},
+		{"203.0.113.2", NotFilteredNotFound},
+		{"10.2.3.4", FilteredBlockedIP},
+		{"10.1.2.3", NotFilteredWhiteList},
+		{"2001:db8::1", NotFilteredNotFound},
+	}
+	for _, tc := range tests {
+		res := d.CheckResponseIP(net.ParseIP(tc.ip), dns.TypeA, ClientInfo{})
+		if res.Reason != tc.reason {
+			t.Errorf("%s: expected %s, got %s", tc.ip, tc.reason, res.Reason)
+		}
+	}
+
+	if looksLikeNetwork("||cafe.example.org^") || !looksLikeNetwork("||2001:db8::/32^") {
+		t.Errorf("the rules are told from the networks by their characters")
+	}
+}
+
+func TestSafeSearchCatalogConflict(t *testing.T) {
+	engines := []SafeSearchEngine{
+		{Name: "exact", Enabled: true, Domains: []string{"www.example.org"}, CNAME: "safe.example.org"},
+		{Name: "wildcard", Enabled: true, Domains: []string{"*.example.org"}, CNAME: "strict.example.org"},
+	}
+	_, err := NewSafeSearchCatalog(engines)
+	if err == nil {
+		t.Fatal("the exact domain overlapping with the wildcard isn't a conflict")
+	}
+
+	engines[1].Enabled = false
+	c, err := NewSafeSearchCatalog(engines)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second, conflict := c.Conflict(SafeSearchEnabled(map[string]bool{"wildcard": true}))
+	if !conflict || first != "exact" || second != "wildcard" {
+		t.Errorf("expected exact and wildcard to conflict, got %s and %s", first, second)
+	}
+	_, _, conflict = c.Conflict(SafeSearchEnabled(map[string]bool{"exact": false, "wildcard": true}))
+	if conflict {
+		t.Error("the disabled engine conflicts")
+	}
+
+	tests := []struct {
+		host   string
+		engine string
+	}{
+		{"www.google.com", "google"},
+		{"forcesafesearch.google.com", ""},
+		{"mail.google.com", ""},
+		{"www.bing.com", "bing"},
+		{"strict.bing.com", ""},
+		{"m.youtube.com", "youtube_strict"},
+		{"restrict.youtube.com", ""},
+	}
+	for _, tc := range tests {
+		target, _ := DefaultSafeSearchCatalog().Find(tc.host, SafeSearchEnabled(nil))
+		if target.Engine != tc.engine {
+			t.Errorf("%s: expected engine %q, got %q", tc.host, tc.engine, target.Engine)
+		}
+	}
+}
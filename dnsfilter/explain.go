@@ -0,0 +1,146 @@
+package dnsfilter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// MatchedRule is a rule matching the host, see Explain
+type MatchedRule struct {
+	Table  string // "important", "whitelist" or "blacklist"
+	Result        // the result of this rule alone
+}
+
+// Explanation describes every check applied to a host and what each of them would do
+type Explanation struct {
+	Rules []MatchedRule // all the rules matching the host, in the order they are checked
+
+	// the result of the filtering rules, its Rule is the one that won
+	RulesResult Result
+	Why         string // human-readable reason why the result was chosen
+
+	SafeBrowsingEnabled bool
+	SafeBrowsing        Result // empty if disabled
+	SafeBrowsingError   string // lookup error, the check is skipped in this case
+
+	ParentalEnabled bool
+	Parental        Result // empty if disabled
+	ParentalError   string // lookup error, the check is skipped in this case
+
+	SafeSearchEnabled bool
+	SafeSearchHost    string // replacement host or addresses, empty if safesearch doesn't apply
+	SafeSearchEngine  string
+
+	Result Result // the final result, the same as a DNS request would get unless its upstream response is blocked
+	Note   string // what the explanation doesn't cover, empty if the request isn't passed to upstream
+}
+
+// Explain matches host against every rule instead of stopping at the first one,
+// and reports what safebrowsing, parental and safesearch would do with it
+// it's slow and does HTTP lookups regardless of the rules, it's meant for troubleshooting only
+// with the context from WithCachedLookupsOnly it uses the cached lookup results only, see ErrNotCached
+func (d *Dnsfilter) Explain(ctx context.Context, host string, qtype uint16, client ClientInfo) (Explanation, error) {
+	e := Explanation{
+		SafeBrowsingEnabled: d.config.safeBrowsingEnabled,
+		ParentalEnabled:     d.config.parentalEnabled,
+		SafeSearchEnabled:   d.config.safeSearchEnabled,
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		e.Why = "empty host name is never filtered"
+		return e, nil
+	}
+
+	tables := []struct {
+		name  string
+		table *rulesTable
+	}{
+		{"important", d.important},
+		{"whitelist", d.whiteList},
+		{"blacklist", d.blackList},
+	}
+	for _, t := range tables {
+		results, err := t.table.matchAllByHost(host, qtype, client)
+		if err != nil {
+			return e, err
+		}
+		for _, res := range results {
+			e.Rules = append(e.Rules, MatchedRule{Table: t.name, Result: res})
+		}
+	}
+
+	result, err := d.matchHost(host, qtype, client)
+	if err != nil {
+		return e, err
+	}
+	e.RulesResult = result
+	e.Why = explainRulesResult(e.Rules, result)
+
+	if e.SafeBrowsingEnabled {
+		e.SafeBrowsing, err = d.checkSafeBrowsing(ctx, host)
+		if err != nil {
+			e.SafeBrowsingError = err.Error()
+		}
+	}
+	if e.ParentalEnabled {
+		e.Parental, err = d.checkParental(ctx, host)
+		if err != nil {
+			e.ParentalError = err.Error()
+		}
+	}
+	if target, ok := d.SafeSearchDomain(host); ok {
+		e.SafeSearchHost = target.String()
+		e.SafeSearchEngine = target.Engine
+	}
+
+	// the same order as the requests are processed in
+	switch {
+	case len(e.SafeSearchHost) != 0:
+		e.Result = Result{Reason: FilteredSafeSearch}
+		e.Why = fmt.Sprintf("safesearch replaces the host with %s, it's checked before the rules", e.SafeSearchHost)
+	case e.RulesResult.Reason.Matched():
+		e.Result = e.RulesResult
+	case e.SafeBrowsing.Reason.Matched():
+		e.Result = e.SafeBrowsing
+		e.Why = "no rule matched, the host is blocked by safebrowsing"
+	case e.Parental.Reason.Matched():
+		e.Result = e.Parental
+		e.Why = "no rule matched, the host is blocked by parental control"
+	}
+	if !e.Result.Reason.Matched() {
+		// it takes an upstream request, the explanation doesn't make one
+		e.Note = "the request is passed to upstream, it can still be blocked by the rules matching the CNAME targets or the IP addresses of the response"
+	}
+	return e, nil
+}
+
+// explains why result was chosen among the matched rules
+func explainRulesResult(rules []MatchedRule, result Result) string {
+	if !result.Reason.Matched() {
+		return "no rule matched"
+	}
+
+	winner := ""
+	for _, r := range rules {
+		if r.Rule == result.Rule && r.FilterID == result.FilterID {
+			winner = r.Table
+			break
+		}
+	}
+
+	switch {
+	case result.Reason == FilteredDNSRewrite:
+		return fmt.Sprintf("$dnsrewrite rule in %s, the response is combined from all the $dnsrewrite rules of that list", winner)
+	case result.Reason == FilteredBlockedService:
+		return fmt.Sprintf("rule of blocked service %s in %s", result.ServiceID, winner)
+	case winner == "important":
+		return "$important rule, it has priority over whitelist and blacklist"
+	case winner == "whitelist":
+		return "whitelist rule, it has priority over blacklist"
+	case result.Ip != nil:
+		return "hosts-syntax rule, the host is answered with its IP address"
+	default:
+		return "blacklist rule"
+	}
+}
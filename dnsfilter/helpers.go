@@ -5,6 +5,11 @@ import (
 	"sync/atomic"
 )
 
+// IsValidRule checks if the line of a filter is a rule, not a comment or a cosmetic rule
+func IsValidRule(line string) bool {
+	return isValidRule(strings.TrimSpace(line))
+}
+
 func isValidRule(rule string) bool {
 	if len(rule) < 4 {
 		return false
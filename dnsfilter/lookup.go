@@ -0,0 +1,288 @@
+package dnsfilter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LookupProvider looks up host names in a safebrowsing or parental database
+type LookupProvider interface {
+	// Lookup checks the hashes of the host and its parent domains, see hostnameToHashParam
+	// hashparam is the list of 4-byte hash prefixes in hex separated by slashes, hashes are the full hashes in hex
+	// cacheable tells if the result can be cached, it's not cached if there's an error
+	// sensitivity is the parental sensitivity of the filter, it's zero for safebrowsing
+	// ctx is done when the lookup takes longer than the HTTP timeout of the filter, it's shared by all the callers
+	Lookup(ctx context.Context, hashparam string, hashes map[string]bool, sensitivity int) (result Result, cacheable bool, err error)
+
+	// Cached tells if the results are cached and the concurrent lookups of the same host are coalesced
+	// it's false for the providers that are fast enough to be looked up every time
+	Cached() bool
+
+	// Remote tells if the lookups are sent over the network, they're reported in the lookup trace
+	Remote() bool
+}
+
+//
+// HTTP lookups
+//
+
+// httpLookup sends the hash prefixes to a remote server and matches its response against the full hashes
+type httpLookup struct {
+	d           *Dnsfilter
+	lookupstats *LookupStats
+	format      func(hashparam string) string
+	handleBody  func(body []byte, hashes map[string]bool) (Result, error)
+}
+
+// Cached implements LookupProvider, HTTP lookups are slow and they're cached
+func (h *httpLookup) Cached() bool {
+	return true
+}
+
+// Remote implements LookupProvider
+func (h *httpLookup) Remote() bool {
+	return true
+}
+
+// Lookup implements LookupProvider, the sensitivity is already in the URL
+func (h *httpLookup) Lookup(ctx context.Context, hashparam string, hashes map[string]bool, sensitivity int) (Result, bool, error) {
+	// format URL with our hashes
+	url := h.format(hashparam)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Result{}, false, err
+	}
+
+	// do HTTP request
+	atomic.AddUint64(&h.lookupstats.Requests, 1)
+	atomic.AddInt64(&h.lookupstats.Pending, 1)
+	updateMax(&h.lookupstats.Pending, &h.lookupstats.PendingMax)
+	resp, err := h.d.client.Do(req.WithContext(ctx))
+	atomic.AddInt64(&h.lookupstats.Pending, -1)
+	if resp != nil && resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return Result{}, false, err
+	}
+
+	// get body text
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, false, err
+	}
+
+	// handle status code
+	switch {
+	case resp.StatusCode == 204:
+		// empty result, save cache
+		return Result{}, true, nil
+	case resp.StatusCode != 200:
+		// error, don't save cache
+		return Result{}, false, nil
+	}
+
+	result, err := h.handleBody(body, hashes)
+	if err != nil {
+		return Result{}, false, err
+	}
+	return result, true, nil
+}
+
+// lookupProviderKey identifies the provider in the keys of in-flight lookups, only the lookups of the same provider are coalesced
+func lookupProviderKey(provider LookupProvider) string {
+	if h, ok := provider.(*httpLookup); ok {
+		// the URL without the hashes has the server and the parental sensitivity
+		return "http " + h.format("")
+	}
+	return fmt.Sprintf("%T %p", provider, provider)
+}
+
+//
+// local database
+//
+
+// HashDB is a LookupProvider that uses a local database file instead of HTTP lookups
+// the file has one entry per line -- a hash in hex and an optional label reported as the rule, e.g. "4C1D3B0A malware"
+// the hashes are calculated the same way as for HTTP lookups, see hostnameToHashParam
+// an entry with 8 hex digits is a hash prefix and matches every hash starting with it
+// an entry of a parental database can have the minimum age after the hash, e.g. "4C1D3B0A 13 gambling",
+// it's blocked only for the parental sensitivities below it, the entries without it are blocked for all of them
+// the file is reloaded periodically if it was modified, lines starting with # are ignored
+type HashDB struct {
+	path   string
+	reason Reason // FilteredSafeBrowsing or FilteredParental
+
+	entries map[string]hashDBEntry // hash or hash prefix -> entry
+	modTime time.Time
+	sync.RWMutex
+
+	stop chan bool
+}
+
+type hashDBEntry struct {
+	label  string
+	minAge int // the entry isn't blocked for the parental sensitivities from it, 0 if it's blocked for all
+}
+
+// hash prefix length in hex digits, see hostnameToHashParam
+const hashPrefixLength = 8
+
+// NewHashDB loads the database file and starts reloading it every refresh period if refresh isn't zero
+// reason must be either FilteredSafeBrowsing or FilteredParental
+func NewHashDB(path string, reason Reason, refresh time.Duration) (*HashDB, error) {
+	if reason != FilteredSafeBrowsing && reason != FilteredParental {
+		return nil, fmt.Errorf("dnsfilter: invalid hash database reason %s", reason)
+	}
+	db := &HashDB{
+		path:   path,
+		reason: reason,
+		stop:   make(chan bool),
+	}
+	err := db.load()
+	if err != nil {
+		return nil, err
+	}
+	if refresh > 0 {
+		go db.periodicReload(refresh)
+	}
+	return db, nil
+}
+
+// Close stops reloading the database
+func (db *HashDB) Close() {
+	close(db.stop)
+}
+
+// Count returns number of entries in the database
+func (db *HashDB) Count() int {
+	db.RLock()
+	defer db.RUnlock()
+	return len(db.entries)
+}
+
+func (db *HashDB) load() error {
+	file, err := os.Open(db.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]hashDBEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		hash := strings.ToUpper(fields[0])
+		if len(hash) != hashPrefixLength && len(hash) != 64 {
+			continue
+		}
+		entry := hashDBEntry{}
+		if len(fields) == 2 {
+			entry.label = strings.TrimSpace(fields[1])
+		}
+		if db.reason == FilteredParental {
+			ageFields := strings.SplitN(entry.label, " ", 2)
+			if age, err := strconv.Atoi(ageFields[0]); err == nil && age > 0 {
+				entry.minAge = age
+				entry.label = ""
+				if len(ageFields) == 2 {
+					entry.label = strings.TrimSpace(ageFields[1])
+				}
+			}
+		}
+		entries[hash] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	db.Lock()
+	db.entries = entries
+	db.modTime = info.ModTime()
+	db.Unlock()
+	log.Printf("Loaded %d entries from %s", len(entries), db.path)
+	return nil
+}
+
+func (db *HashDB) periodicReload(refresh time.Duration) {
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(db.path)
+		if err != nil {
+			log.Printf("Couldn't check %s for updates: %s", db.path, err)
+			continue
+		}
+		db.RLock()
+		modified := !info.ModTime().Equal(db.modTime)
+		db.RUnlock()
+		if !modified {
+			continue
+		}
+		err = db.load()
+		if err != nil {
+			// keep using the old entries
+			log.Printf("Couldn't reload %s: %s", db.path, err)
+		}
+	}
+}
+
+// Cached implements LookupProvider, the results aren't cached since the database can be reloaded anytime
+func (db *HashDB) Cached() bool {
+	return false
+}
+
+// Remote implements LookupProvider
+func (db *HashDB) Remote() bool {
+	return false
+}
+
+// Lookup implements LookupProvider, the parental entries are matched against the sensitivity like the HTTP lookups
+func (db *HashDB) Lookup(ctx context.Context, hashparam string, hashes map[string]bool, sensitivity int) (Result, bool, error) {
+	db.RLock()
+	defer db.RUnlock()
+	for hash := range hashes {
+		entry, ok := db.entries[hash]
+		if !ok {
+			entry, ok = db.entries[hash[:hashPrefixLength]]
+		}
+		if !ok {
+			continue
+		}
+		if db.reason == FilteredParental && entry.minAge > 0 && sensitivity >= entry.minAge {
+			continue
+		}
+
+		result := Result{IsFiltered: true, Reason: db.reason, Rule: entry.label}
+		if db.reason == FilteredParental {
+			result.Rule = fmt.Sprintf("parental %s", entry.label)
+		}
+		return result, false, nil
+	}
+	return Result{}, false, nil
+}
@@ -0,0 +1,201 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+)
+
+// cachedResult is a safebrowsing or parental result saved in the lookup cache
+// gcache doesn't expose expiration times, so it's kept along with the result to be saved to disk
+type cachedResult struct {
+	Result  Result
+	Expires time.Time
+}
+
+// lookup caches parameters, they're shared by all instances just like the caches
+var (
+	lookupCacheSize = defaultCacheSize
+	lookupCacheTime = defaultCacheTime
+	lookupCacheLock sync.RWMutex // protects the parameters and the caches pointers
+)
+
+func newLookupCache() gcache.Cache {
+	return gcache.New(lookupCacheSize).LRU().Expiration(lookupCacheTime).Build()
+}
+
+// getLookupCache returns the cache creating it if necessary
+func getLookupCache(cache *gcache.Cache) gcache.Cache {
+	lookupCacheLock.RLock()
+	c := *cache
+	lookupCacheLock.RUnlock()
+	if c != nil {
+		return c
+	}
+
+	lookupCacheLock.Lock()
+	if *cache == nil {
+		*cache = newLookupCache()
+	}
+	c = *cache
+	lookupCacheLock.Unlock()
+	return c
+}
+
+// adds the entry if it isn't expired yet, it can't live longer than the TTL of the cache
+// lookupCacheLock must be held
+func addCachedResult(cache gcache.Cache, key lookupCacheKey, cached cachedResult, now time.Time) bool {
+	if cached.Expires.After(now.Add(lookupCacheTime)) {
+		cached.Expires = now.Add(lookupCacheTime)
+	}
+	ttl := cached.Expires.Sub(now)
+	if ttl <= 0 {
+		return false
+	}
+	err := cache.SetWithExpire(key, cached, ttl)
+	if err != nil {
+		log.Printf("Couldn't add lookup cache entry for %s: %s", key.host, err)
+		return false
+	}
+	return true
+}
+
+// SetLookupCacheParameters sets the size and TTL of safebrowsing and parental caches
+// the caches are rebuilt if the parameters change, the entries are kept
+func SetLookupCacheParameters(size int, ttl time.Duration) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultCacheTime
+	}
+
+	lookupCacheLock.Lock()
+	defer lookupCacheLock.Unlock()
+	if size == lookupCacheSize && ttl == lookupCacheTime {
+		return
+	}
+	lookupCacheSize = size
+	lookupCacheTime = ttl
+
+	for _, cache := range []*gcache.Cache{&safebrowsingCache, &parentalCache} {
+		if *cache == nil {
+			continue
+		}
+		newCache := newLookupCache()
+		now := time.Now()
+		for key, value := range (*cache).GetALL() {
+			cacheKey, isKey := key.(lookupCacheKey)
+			cached, isCached := value.(cachedResult)
+			if isKey && isCached {
+				addCachedResult(newCache, cacheKey, cached, now)
+			}
+		}
+		*cache = newCache
+	}
+}
+
+// the format of the lookup caches file
+type lookupCacheEntry struct {
+	Host        string    `json:"host"`
+	Sensitivity int       `json:"sensitivity,omitempty"` // parental only, the results depend on it
+	Result      Result    `json:"result"`
+	Expires     time.Time `json:"expires"`
+}
+
+type lookupCacheFile struct {
+	SafeBrowsing []lookupCacheEntry `json:"safebrowsing"`
+	Parental     []lookupCacheEntry `json:"parental"`
+}
+
+func lookupCacheEntries(cache gcache.Cache) []lookupCacheEntry {
+	entries := []lookupCacheEntry{}
+	if cache == nil {
+		return entries
+	}
+	now := time.Now()
+	for key, value := range cache.GetALL() {
+		cacheKey, ok := key.(lookupCacheKey)
+		if !ok {
+			continue
+		}
+		cached, ok := value.(cachedResult)
+		if !ok || !cached.Expires.After(now) {
+			continue
+		}
+		entries = append(entries, lookupCacheEntry{
+			Host:        cacheKey.host,
+			Sensitivity: cacheKey.sensitivity,
+			Result:      cached.Result,
+			Expires:     cached.Expires,
+		})
+	}
+	return entries
+}
+
+// SaveLookupCaches writes safebrowsing and parental caches to the file along with the expiration times
+func SaveLookupCaches(path string) error {
+	lookupCacheLock.RLock()
+	data := lookupCacheFile{
+		SafeBrowsing: lookupCacheEntries(safebrowsingCache),
+		Parental:     lookupCacheEntries(parentalCache),
+	}
+	lookupCacheLock.RUnlock()
+
+	body, err := json.Marshal(&data)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash doesn't leave a broken file
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, body, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// LoadLookupCaches adds the entries saved by SaveLookupCaches to safebrowsing and parental caches
+// expired entries are skipped, it's not an error if the file doesn't exist
+func LoadLookupCaches(path string) error {
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data := lookupCacheFile{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	load := func(cache gcache.Cache, entries []lookupCacheEntry) int {
+		count := 0
+		for _, e := range entries {
+			key := lookupCacheKey{host: e.Host, sensitivity: e.Sensitivity}
+			if addCachedResult(cache, key, cachedResult{Result: e.Result, Expires: e.Expires}, now) {
+				count++
+			}
+		}
+		return count
+	}
+
+	sb := getLookupCache(&safebrowsingCache)
+	pc := getLookupCache(&parentalCache)
+	lookupCacheLock.RLock()
+	sbCount := load(sb, data.SafeBrowsing)
+	pcCount := load(pc, data.Parental)
+	lookupCacheLock.RUnlock()
+	log.Printf("Loaded %d safebrowsing and %d parental cache entries from %s", sbCount, pcCount, path)
+	return nil
+}
@@ -0,0 +1,125 @@
+package dnsfilter
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// testLookup is a LookupProvider that blocks every host after the delay or when ctx is done
+type testLookup struct {
+	cached bool
+	delay  time.Duration
+	calls  int32
+}
+
+func (l *testLookup) Cached() bool { return l.cached }
+func (l *testLookup) Remote() bool { return false }
+
+func (l *testLookup) Lookup(ctx context.Context, hashparam string, hashes map[string]bool, sensitivity int) (Result, bool, error) {
+	atomic.AddInt32(&l.calls, 1)
+	select {
+	case <-time.After(l.delay):
+		return Result{IsFiltered: true, Reason: FilteredSafeBrowsing}, l.cached, nil
+	case <-ctx.Done():
+		return Result{}, false, ctx.Err()
+	}
+}
+
+func TestLookupCommonCached(t *testing.T) {
+	for _, cached := range []bool{true, false} {
+		d := New()
+		provider := &testLookup{cached: cached}
+		cache := newLookupCache()
+		for i := 0; i < 2; i++ {
+			res, err := d.lookupCommon(context.Background(), "example.org", 0, &LookupStats{}, cache, &singleflight.Group{}, true, provider)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.IsFiltered {
+				t.Fatalf("expected the host to be blocked, got %+v", res)
+			}
+		}
+
+		calls := int32(2)
+		if cached {
+			calls = 1
+		}
+		if provider.calls != calls {
+			t.Errorf("cached=%v: expected %d lookups, got %d", cached, calls, provider.calls)
+		}
+	}
+}
+
+func TestLookupCommonTimeout(t *testing.T) {
+	d := New()
+	d.SetHTTPTimeout(10 * time.Millisecond)
+	provider := &testLookup{cached: true, delay: time.Minute}
+
+	// the lookup isn't cancelled by the caller, but it's bounded by the timeout of the filter
+	done := make(chan error)
+	go func() {
+		_, err := d.lookupCommon(context.Background(), "example.org", 0, &LookupStats{}, newLookupCache(), &singleflight.Group{}, true, provider)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the lookup to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the lookup isn't bounded by the timeout")
+	}
+}
+
+func TestHashDBParentalSensitivity(t *testing.T) {
+	file, err := ioutil.TempFile("", "parental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	entries := map[string]string{
+		"adult.example.org":  "17 adult",
+		"casino.example.org": "13 gambling",
+		"bad.example.org":    "weapons",
+	}
+	for host, entry := range entries {
+		fmt.Fprintf(file, "%X %s\n", sha256.Sum256([]byte(host)), entry)
+	}
+	file.Close()
+	db, err := NewHashDB(file.Name(), FilteredParental, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host        string
+		sensitivity int
+		blocked     bool
+		rule        string
+	}{
+		{"adult.example.org", 13, true, "parental adult"},
+		{"adult.example.org", 17, false, ""},
+		{"casino.example.org", 10, true, "parental gambling"},
+		{"casino.example.org", 13, false, ""},
+		{"bad.example.org", 17, true, "parental weapons"},
+		{"example.org", 3, false, ""},
+	}
+	d := New()
+	for _, tc := range tests {
+		res, err := d.lookupCommon(context.Background(), tc.host, tc.sensitivity, &LookupStats{}, newLookupCache(), &singleflight.Group{}, false, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != tc.blocked || res.Rule != tc.rule {
+			t.Errorf("%s with sensitivity %d: expected blocked=%v %q, got %+v", tc.host, tc.sensitivity, tc.blocked, tc.rule, res)
+		}
+	}
+}
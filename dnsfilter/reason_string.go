@@ -2,9 +2,9 @@ package dnsfilter
 
 import "strconv"
 
-const _Reason_name = "NotFilteredNotFoundNotFilteredWhiteListNotFilteredErrorFilteredBlackListFilteredSafeBrowsingFilteredParentalFilteredInvalidFilteredSafeSearch"
+const _Reason_name = "NotFilteredNotFoundNotFilteredWhiteListNotFilteredErrorFilteredBlackListFilteredSafeBrowsingFilteredParentalFilteredInvalidFilteredSafeSearchFilteredDNSRewriteFilteredBlockedIPFilteredBlockedService"
 
-var _Reason_index = [...]uint8{0, 19, 39, 55, 72, 92, 108, 123, 141}
+var _Reason_index = [...]uint8{0, 19, 39, 55, 72, 92, 108, 123, 141, 159, 176, 198}
 
 func (i Reason) String() string {
 	if i < 0 || i >= Reason(len(_Reason_index)-1) {
@@ -0,0 +1,84 @@
+package dnsfilter
+
+import (
+	"net"
+	"strings"
+)
+
+// ruleClient is a single value of the $client modifier -- an IP address, a network or a client name
+type ruleClient struct {
+	ip       net.IP
+	ipnet    *net.IPNet
+	name     string
+	isNegate bool // the value is prefixed with ~ and excludes the client
+}
+
+// parses the value of $client modifier, for example 192.168.1.0/24|'Kids tablet'|~192.168.1.10
+func parseRuleClients(value string) ([]ruleClient, error) {
+	clients := []ruleClient{}
+	for _, s := range strings.Split(value, "|") {
+		s = strings.TrimSpace(s)
+
+		c := ruleClient{}
+		if strings.HasPrefix(s, "~") {
+			c.isNegate = true
+			s = strings.TrimSpace(s[1:])
+		}
+
+		// names can be quoted, commas inside them must be escaped
+		if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+			s = s[1 : len(s)-1]
+		}
+		s = strings.Replace(s, `\,`, ",", -1)
+		if len(s) == 0 {
+			return nil, ErrInvalidSyntax
+		}
+
+		if ip := net.ParseIP(s); ip != nil {
+			c.ip = ip
+		} else if _, ipnet, err := net.ParseCIDR(s); err == nil {
+			c.ipnet = ipnet
+		} else {
+			c.name = s
+		}
+		clients = append(clients, c)
+	}
+	return clients, nil
+}
+
+func (c *ruleClient) match(client ClientInfo) bool {
+	switch {
+	case c.ip != nil:
+		return client.IP != nil && c.ip.Equal(client.IP)
+	case c.ipnet != nil:
+		return client.IP != nil && c.ipnet.Contains(client.IP)
+	default:
+		return len(client.Name) != 0 && strings.EqualFold(c.name, client.Name)
+	}
+}
+
+// Checks if the rule applies to the specified client
+// excluded clients (~) have priority, if there are no included ones, the rule applies to everyone else
+func (rule *rule) matchClient(client ClientInfo) bool {
+	if len(rule.clients) == 0 {
+		return true
+	}
+
+	hasIncluded := false
+	matchedIncluded := false
+	for i := range rule.clients {
+		c := &rule.clients[i]
+		if c.isNegate {
+			if c.match(client) {
+				return false
+			}
+			continue
+		}
+		hasIncluded = true
+		if !matchedIncluded && c.match(client) {
+			matchedIncluded = true
+		}
+	}
+
+	return !hasIncluded || matchedIncluded
+}
@@ -0,0 +1,209 @@
+package dnsfilter
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ruleDNSRewrite is the parsed value of the $dnsrewrite modifier
+type ruleDNSRewrite struct {
+	rcode  int    // response code, dns.RcodeSuccess if there's a record
+	rrtype uint16 // record type, 0 if only rcode is rewritten
+	value  string // record value in the presentation format, without the name, class and ttl
+}
+
+// DNSRewriteResult holds the response synthesized by the rules with $dnsrewrite modifier
+type DNSRewriteResult struct {
+	RCode int `json:",omitempty"` // response code to reply with
+
+	// Answer records, their TTL is left for the caller to set
+	// not serialized since the records are saved as part of the answer in the query log anyway
+	Answer []dns.RR `json:"-"`
+}
+
+// parses the value of $dnsrewrite modifier, the following forms are supported:
+//   NXDOMAIN, REFUSED, NOERROR, SERVFAIL   -- respond with the rcode and no records
+//   1.2.3.4, ::1, example.org              -- short form for A, AAAA and CNAME records
+//   NOERROR;A;1.2.3.4, NOERROR;MX;10 mx.example.org, NXDOMAIN;; -- full form RCODE;TYPE;VALUE
+func parseRuleDNSRewrite(value string) (*ruleDNSRewrite, error) {
+	value = strings.Replace(strings.TrimSpace(value), `\,`, ",", -1)
+	if len(value) == 0 {
+		return nil, ErrInvalidSyntax
+	}
+
+	if !strings.Contains(value, ";") {
+		// short form
+		if rcode, ok := dns.StringToRcode[strings.ToUpper(value)]; ok {
+			return &ruleDNSRewrite{rcode: rcode}, nil
+		}
+		if ip := net.ParseIP(value); ip != nil {
+			if ip.To4() != nil {
+				return &ruleDNSRewrite{rcode: dns.RcodeSuccess, rrtype: dns.TypeA, value: value}, nil
+			}
+			return &ruleDNSRewrite{rcode: dns.RcodeSuccess, rrtype: dns.TypeAAAA, value: value}, nil
+		}
+		if _, ok := dns.IsDomainName(value); !ok {
+			return nil, ErrInvalidSyntax
+		}
+		return &ruleDNSRewrite{rcode: dns.RcodeSuccess, rrtype: dns.TypeCNAME, value: value}, nil
+	}
+
+	parts := strings.SplitN(value, ";", 3)
+	if len(parts) != 3 {
+		return nil, ErrInvalidSyntax
+	}
+	rcode, ok := dns.StringToRcode[strings.ToUpper(strings.TrimSpace(parts[0]))]
+	if !ok {
+		return nil, ErrInvalidSyntax
+	}
+	typeStr := strings.ToUpper(strings.TrimSpace(parts[1]))
+	rrValue := strings.TrimSpace(parts[2])
+
+	if rcode != dns.RcodeSuccess || (len(typeStr) == 0 && len(rrValue) == 0) {
+		// records make sense only for NOERROR
+		return &ruleDNSRewrite{rcode: rcode}, nil
+	}
+
+	rrtype, ok := dns.StringToType[typeStr]
+	if !ok {
+		return nil, ErrInvalidSyntax
+	}
+	rewrite := &ruleDNSRewrite{rcode: rcode, rrtype: rrtype, value: rrValue}
+
+	// make sure that the record can be built
+	if _, err := rewrite.newRR("example.org."); err != nil {
+		return nil, ErrInvalidSyntax
+	}
+	return rewrite, nil
+}
+
+// builds the record for the specified fully qualified name
+func (rw *ruleDNSRewrite) newRR(name string) (dns.RR, error) {
+	hdr := dns.RR_Header{Name: name, Rrtype: rw.rrtype, Class: dns.ClassINET}
+
+	switch rw.rrtype {
+	case dns.TypeA:
+		ip := net.ParseIP(rw.value)
+		if ip == nil || ip.To4() == nil {
+			return nil, ErrInvalidSyntax
+		}
+		return &dns.A{Hdr: hdr, A: ip.To4()}, nil
+	case dns.TypeAAAA:
+		ip := net.ParseIP(rw.value)
+		if ip == nil || ip.To4() != nil {
+			return nil, ErrInvalidSyntax
+		}
+		return &dns.AAAA{Hdr: hdr, AAAA: ip}, nil
+	case dns.TypeCNAME:
+		if _, ok := dns.IsDomainName(rw.value); !ok {
+			return nil, ErrInvalidSyntax
+		}
+		return &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(rw.value)}, nil
+	case dns.TypePTR:
+		if _, ok := dns.IsDomainName(rw.value); !ok {
+			return nil, ErrInvalidSyntax
+		}
+		return &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(rw.value)}, nil
+	case dns.TypeTXT:
+		return &dns.TXT{Hdr: hdr, Txt: []string{rw.value}}, nil
+	case dns.TypeMX:
+		fields := strings.Fields(rw.value)
+		if len(fields) != 2 {
+			return nil, ErrInvalidSyntax
+		}
+		pref, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, ErrInvalidSyntax
+		}
+		return &dns.MX{Hdr: hdr, Preference: uint16(pref), Mx: dns.Fqdn(fields[1])}, nil
+	case dns.TypeSRV:
+		fields := strings.Fields(rw.value)
+		if len(fields) != 4 {
+			return nil, ErrInvalidSyntax
+		}
+		var nums [3]uint16
+		for i := range nums {
+			n, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, ErrInvalidSyntax
+			}
+			nums[i] = uint16(n)
+		}
+		return &dns.SRV{Hdr: hdr, Priority: nums[0], Weight: nums[1], Port: nums[2], Target: dns.Fqdn(fields[3])}, nil
+	default:
+		return nil, ErrInvalidSyntax
+	}
+}
+
+// matchDNSRewrites returns the $dnsrewrite rules matching host, the most specific ones first
+func (r *rulesTable) matchDNSRewrites(host string, qtype uint16, client ClientInfo) ([]*rule, error) {
+	rules := []*rule{}
+	r.rewritesByName.walk(host, func(rule *rule) bool {
+		if rule.matchOptions(qtype, client) {
+			rules = append(rules, rule)
+		}
+		return true
+	})
+	for _, rule := range r.rewritesLeftovers {
+		res, err := rule.match(host, qtype, client)
+		if err != nil {
+			return nil, err
+		}
+		if res.Reason.Matched() {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// Combines the matched $dnsrewrite rules into a single result, the first rule is reported as the rule of the result
+func newDNSRewriteRulesResult(host string, qtype uint16, rules []*rule) Result {
+	rewrites := make([]*ruleDNSRewrite, 0, len(rules))
+	for _, rule := range rules {
+		rewrites = append(rewrites, rule.dnsRewrite)
+	}
+	res := rules[0].result()
+	res.DNSRewrite = newDNSRewriteResult(host, qtype, rewrites)
+	return res
+}
+
+// Combines the matched $dnsrewrite rules into a response for the specified query
+// The first rule with rcode other than NOERROR wins, then the first CNAME record,
+// otherwise the records of the requested type are returned (none means NODATA)
+func newDNSRewriteResult(host string, qtype uint16, rewrites []*ruleDNSRewrite) *DNSRewriteResult {
+	for _, rw := range rewrites {
+		if rw.rcode != dns.RcodeSuccess {
+			return &DNSRewriteResult{RCode: rw.rcode}
+		}
+	}
+
+	result := &DNSRewriteResult{RCode: dns.RcodeSuccess}
+	name := dns.Fqdn(host)
+
+	// CNAME can't coexist with other records, the caller resolves its target instead
+	for _, rw := range rewrites {
+		if rw.rrtype == dns.TypeCNAME && qtype != dns.TypeCNAME {
+			rr, err := rw.newRR(name)
+			if err == nil {
+				result.Answer = append(result.Answer, rr)
+				return result
+			}
+		}
+	}
+
+	for _, rw := range rewrites {
+		if rw.rrtype == 0 || rw.rrtype != qtype {
+			continue
+		}
+		rr, err := rw.newRR(name)
+		if err != nil {
+			// validated when the rule was added
+			continue
+		}
+		result.Answer = append(result.Answer, rr)
+	}
+	return result
+}
@@ -0,0 +1,69 @@
+package dnsfilter
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// query types that are missing in dns.StringToType
+var extraDNSTypes = map[string]uint16{
+	"SVCB":  64,
+	"HTTPS": 65,
+}
+
+// ruleDNSType is a single value of the $dnstype modifier
+type ruleDNSType struct {
+	qtype    uint16
+	isNegate bool // the value is prefixed with ~ and excludes the query type
+}
+
+// parses the value of $dnstype modifier, for example AAAA|HTTPS or ~A
+func parseRuleDNSTypes(value string) ([]ruleDNSType, error) {
+	dnsTypes := []ruleDNSType{}
+	for _, s := range strings.Split(value, "|") {
+		s = strings.ToUpper(strings.TrimSpace(s))
+
+		t := ruleDNSType{}
+		if strings.HasPrefix(s, "~") {
+			t.isNegate = true
+			s = s[1:]
+		}
+
+		qtype, ok := dns.StringToType[s]
+		if !ok {
+			qtype, ok = extraDNSTypes[s]
+		}
+		if !ok {
+			return nil, ErrInvalidSyntax
+		}
+		t.qtype = qtype
+		dnsTypes = append(dnsTypes, t)
+	}
+	return dnsTypes, nil
+}
+
+// Checks if the rule applies to the specified query type
+// excluded types (~) have priority, if there are no included ones, the rule applies to every other type
+func (rule *rule) matchDNSType(qtype uint16) bool {
+	if len(rule.dnsTypes) == 0 {
+		return true
+	}
+
+	hasIncluded := false
+	matchedIncluded := false
+	for _, t := range rule.dnsTypes {
+		if t.isNegate {
+			if t.qtype == qtype {
+				return false
+			}
+			continue
+		}
+		hasIncluded = true
+		if t.qtype == qtype {
+			matchedIncluded = true
+		}
+	}
+
+	return !hasIncluded || matchedIncluded
+}
@@ -0,0 +1,161 @@
+package dnsfilter
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// looksLikeNetwork tells if the rule text has only the characters of an IP address or a CIDR network,
+// so that the rest of the rules aren't parsed as addresses
+func looksLikeNetwork(text string) bool {
+	text = strings.TrimPrefix(text, "||")
+	text = strings.TrimPrefix(text, "|")
+	text = strings.TrimSuffix(text, "^")
+	if text == "" {
+		return false
+	}
+	for _, c := range text {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		case c == '.', c == ':', c == '/':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if the rule blocks a network, like ||203.0.113.0/24^, and saves the network
+// ||203.0.113.1^ blocks a single address, it's saved as /32 or /128 network
+// the networks are checked against the IP addresses in responses, the CIDR ones never match host names
+func (rule *rule) extractNetwork() {
+	if !looksLikeNetwork(rule.text) {
+		return
+	}
+	text := rule.text
+	anchored := strings.HasPrefix(text, "||") && strings.HasSuffix(text, "^")
+	text = strings.TrimPrefix(text, "||")
+	text = strings.TrimPrefix(text, "|")
+	text = strings.TrimSuffix(text, "^")
+	if !strings.Contains(text, "/") {
+		if !anchored {
+			return
+		}
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		rule.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		return
+	}
+	_, ipnet, err := net.ParseCIDR(text)
+	if err != nil {
+		return
+	}
+	rule.ipNet = ipnet
+}
+
+// isNetworkOnly tells if the rule blocks a CIDR network, unlike ||203.0.113.1^ it can't match a host name
+func (rule *rule) isNetworkOnly() bool {
+	return rule.ipNet != nil && strings.Contains(rule.text, "/")
+}
+
+// networkIndex stores the rules blocking networks keyed by the network address for every prefix length,
+// so that an address is matched against all of them in O(number of prefix lengths)
+// IPv4 networks are keyed by 4-byte addresses, so they never clash with IPv6 ones
+type networkIndex struct {
+	networks map[int]map[string][]*rule // prefix length -> network address -> rules
+	prefixes []int                      // prefix lengths that have rules, the longest first
+}
+
+func (n *networkIndex) add(networkRule *rule) {
+	ones, _ := networkRule.ipNet.Mask.Size()
+	if n.networks == nil {
+		n.networks = map[int]map[string][]*rule{}
+	}
+	networks, ok := n.networks[ones]
+	if !ok {
+		networks = map[string][]*rule{}
+		n.networks[ones] = networks
+		n.prefixes = append(n.prefixes, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(n.prefixes)))
+	}
+	key := string(networkRule.ipNet.IP)
+	networks[key] = append(networks[key], networkRule)
+}
+
+// walk calls f for the rules whose networks contain ip, the most specific networks first, until f returns false
+func (n *networkIndex) walk(ip net.IP, f func(*rule) bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := len(ip) * 8
+	for _, ones := range n.prefixes {
+		if ones > bits {
+			continue
+		}
+		network := ip.Mask(net.CIDRMask(ones, bits))
+		for _, rule := range n.networks[ones][string(network)] {
+			if !f(rule) {
+				return
+			}
+		}
+	}
+}
+
+func (r *rulesTable) matchByIP(ip net.IP, qtype uint16, client ClientInfo) Result {
+	res := Result{}
+	r.rulesByNetwork.walk(ip, func(rule *rule) bool {
+		if !rule.matchOptions(qtype, client) {
+			return true
+		}
+		res = Result{
+			IsFiltered:  true,
+			Reason:      FilteredBlockedIP,
+			Rule:        rule.originalText,
+			FilterID:    rule.listID,
+			dnsTypeOnly: len(rule.dnsTypes) != 0,
+		}
+		if rule.isWhitelist {
+			res.Reason = NotFilteredWhiteList
+			res.IsFiltered = false
+		}
+		return false
+	})
+	return res
+}
+
+// HasNetworkRules tells if there are rules blocking networks, the IP addresses in responses needn't be checked otherwise
+func (d *Dnsfilter) HasNetworkRules() bool {
+	for _, table := range []*rulesTable{d.important, d.whiteList, d.blackList} {
+		table.RLock()
+		count := len(table.rulesByNetwork.prefixes)
+		table.RUnlock()
+		if count != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckResponseIP matches the IP address found in a response against the rules blocking networks
+// the important rules are checked first, then whitelist and blacklist
+func (d *Dnsfilter) CheckResponseIP(ip net.IP, qtype uint16, client ClientInfo) Result {
+	lists := []*rulesTable{
+		d.important,
+		d.whiteList,
+		d.blackList,
+	}
+
+	for _, table := range lists {
+		res := table.matchByIP(ip, qtype, client)
+		if res.Reason.Matched() {
+			return res
+		}
+	}
+	return Result{}
+}
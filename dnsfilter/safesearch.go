@@ -1,207 +1,294 @@
 package dnsfilter
 
-var safeSearchDomains = map[string]string{
-	"yandex.com": "213.180.193.56",
-	"yandex.ru":  "213.180.193.56",
-	"yandex.ua":  "213.180.193.56",
-	"yandex.by":  "213.180.193.56",
-	"yandex.kz":  "213.180.193.56",
-
-	"www.bing.com": "strict.bing.com",
-
-	"www.google.com":    "forcesafesearch.google.com",
-	"www.google.ad":     "forcesafesearch.google.com",
-	"www.google.ae":     "forcesafesearch.google.com",
-	"www.google.com.af": "forcesafesearch.google.com",
-	"www.google.com.ag": "forcesafesearch.google.com",
-	"www.google.com.ai": "forcesafesearch.google.com",
-	"www.google.al":     "forcesafesearch.google.com",
-	"www.google.am":     "forcesafesearch.google.com",
-	"www.google.co.ao":  "forcesafesearch.google.com",
-	"www.google.com.ar": "forcesafesearch.google.com",
-	"www.google.as":     "forcesafesearch.google.com",
-	"www.google.at":     "forcesafesearch.google.com",
-	"www.google.com.au": "forcesafesearch.google.com",
-	"www.google.az":     "forcesafesearch.google.com",
-	"www.google.ba":     "forcesafesearch.google.com",
-	"www.google.com.bd": "forcesafesearch.google.com",
-	"www.google.be":     "forcesafesearch.google.com",
-	"www.google.bf":     "forcesafesearch.google.com",
-	"www.google.bg":     "forcesafesearch.google.com",
-	"www.google.com.bh": "forcesafesearch.google.com",
-	"www.google.bi":     "forcesafesearch.google.com",
-	"www.google.bj":     "forcesafesearch.google.com",
-	"www.google.com.bn": "forcesafesearch.google.com",
-	"www.google.com.bo": "forcesafesearch.google.com",
-	"www.google.com.br": "forcesafesearch.google.com",
-	"www.google.bs":     "forcesafesearch.google.com",
-	"www.google.bt":     "forcesafesearch.google.com",
-	"www.google.co.bw":  "forcesafesearch.google.com",
-	"www.google.by":     "forcesafesearch.google.com",
-	"www.google.com.bz": "forcesafesearch.google.com",
-	"www.google.ca":     "forcesafesearch.google.com",
-	"www.google.cd":     "forcesafesearch.google.com",
-	"www.google.cf":     "forcesafesearch.google.com",
-	"www.google.cg":     "forcesafesearch.google.com",
-	"www.google.ch":     "forcesafesearch.google.com",
-	"www.google.ci":     "forcesafesearch.google.com",
-	"www.google.co.ck":  "forcesafesearch.google.com",
-	"www.google.cl":     "forcesafesearch.google.com",
-	"www.google.cm":     "forcesafesearch.google.com",
-	"www.google.cn":     "forcesafesearch.google.com",
-	"www.google.com.co": "forcesafesearch.google.com",
-	"www.google.co.cr":  "forcesafesearch.google.com",
-	"www.google.com.cu": "forcesafesearch.google.com",
-	"www.google.cv":     "forcesafesearch.google.com",
-	"www.google.com.cy": "forcesafesearch.google.com",
-	"www.google.cz":     "forcesafesearch.google.com",
-	"www.google.de":     "forcesafesearch.google.com",
-	"www.google.dj":     "forcesafesearch.google.com",
-	"www.google.dk":     "forcesafesearch.google.com",
-	"www.google.dm":     "forcesafesearch.google.com",
-	"www.google.com.do": "forcesafesearch.google.com",
-	"www.google.dz":     "forcesafesearch.google.com",
-	"www.google.com.ec": "forcesafesearch.google.com",
-	"www.google.ee":     "forcesafesearch.google.com",
-	"www.google.com.eg": "forcesafesearch.google.com",
-	"www.google.es":     "forcesafesearch.google.com",
-	"www.google.com.et": "forcesafesearch.google.com",
-	"www.google.fi":     "forcesafesearch.google.com",
-	"www.google.com.fj": "forcesafesearch.google.com",
-	"www.google.fm":     "forcesafesearch.google.com",
-	"www.google.fr":     "forcesafesearch.google.com",
-	"www.google.ga":     "forcesafesearch.google.com",
-	"www.google.ge":     "forcesafesearch.google.com",
-	"www.google.gg":     "forcesafesearch.google.com",
-	"www.google.com.gh": "forcesafesearch.google.com",
-	"www.google.com.gi": "forcesafesearch.google.com",
-	"www.google.gl":     "forcesafesearch.google.com",
-	"www.google.gm":     "forcesafesearch.google.com",
-	"www.google.gp":     "forcesafesearch.google.com",
-	"www.google.gr":     "forcesafesearch.google.com",
-	"www.google.com.gt": "forcesafesearch.google.com",
-	"www.google.gy":     "forcesafesearch.google.com",
-	"www.google.com.hk": "forcesafesearch.google.com",
-	"www.google.hn":     "forcesafesearch.google.com",
-	"www.google.hr":     "forcesafesearch.google.com",
-	"www.google.ht":     "forcesafesearch.google.com",
-	"www.google.hu":     "forcesafesearch.google.com",
-	"www.google.co.id":  "forcesafesearch.google.com",
-	"www.google.ie":     "forcesafesearch.google.com",
-	"www.google.co.il":  "forcesafesearch.google.com",
-	"www.google.im":     "forcesafesearch.google.com",
-	"www.google.co.in":  "forcesafesearch.google.com",
-	"www.google.iq":     "forcesafesearch.google.com",
-	"www.google.is":     "forcesafesearch.google.com",
-	"www.google.it":     "forcesafesearch.google.com",
-	"www.google.je":     "forcesafesearch.google.com",
-	"www.google.com.jm": "forcesafesearch.google.com",
-	"www.google.jo":     "forcesafesearch.google.com",
-	"www.google.co.jp":  "forcesafesearch.google.com",
-	"www.google.co.ke":  "forcesafesearch.google.com",
-	"www.google.com.kh": "forcesafesearch.google.com",
-	"www.google.ki":     "forcesafesearch.google.com",
-	"www.google.kg":     "forcesafesearch.google.com",
-	"www.google.co.kr":  "forcesafesearch.google.com",
-	"www.google.com.kw": "forcesafesearch.google.com",
-	"www.google.kz":     "forcesafesearch.google.com",
-	"www.google.la":     "forcesafesearch.google.com",
-	"www.google.com.lb": "forcesafesearch.google.com",
-	"www.google.li":     "forcesafesearch.google.com",
-	"www.google.lk":     "forcesafesearch.google.com",
-	"www.google.co.ls":  "forcesafesearch.google.com",
-	"www.google.lt":     "forcesafesearch.google.com",
-	"www.google.lu":     "forcesafesearch.google.com",
-	"www.google.lv":     "forcesafesearch.google.com",
-	"www.google.com.ly": "forcesafesearch.google.com",
-	"www.google.co.ma":  "forcesafesearch.google.com",
-	"www.google.md":     "forcesafesearch.google.com",
-	"www.google.me":     "forcesafesearch.google.com",
-	"www.google.mg":     "forcesafesearch.google.com",
-	"www.google.mk":     "forcesafesearch.google.com",
-	"www.google.ml":     "forcesafesearch.google.com",
-	"www.google.com.mm": "forcesafesearch.google.com",
-	"www.google.mn":     "forcesafesearch.google.com",
-	"www.google.ms":     "forcesafesearch.google.com",
-	"www.google.com.mt": "forcesafesearch.google.com",
-	"www.google.mu":     "forcesafesearch.google.com",
-	"www.google.mv":     "forcesafesearch.google.com",
-	"www.google.mw":     "forcesafesearch.google.com",
-	"www.google.com.mx": "forcesafesearch.google.com",
-	"www.google.com.my": "forcesafesearch.google.com",
-	"www.google.co.mz":  "forcesafesearch.google.com",
-	"www.google.com.na": "forcesafesearch.google.com",
-	"www.google.com.nf": "forcesafesearch.google.com",
-	"www.google.com.ng": "forcesafesearch.google.com",
-	"www.google.com.ni": "forcesafesearch.google.com",
-	"www.google.ne":     "forcesafesearch.google.com",
-	"www.google.nl":     "forcesafesearch.google.com",
-	"www.google.no":     "forcesafesearch.google.com",
-	"www.google.com.np": "forcesafesearch.google.com",
-	"www.google.nr":     "forcesafesearch.google.com",
-	"www.google.nu":     "forcesafesearch.google.com",
-	"www.google.co.nz":  "forcesafesearch.google.com",
-	"www.google.com.om": "forcesafesearch.google.com",
-	"www.google.com.pa": "forcesafesearch.google.com",
-	"www.google.com.pe": "forcesafesearch.google.com",
-	"www.google.com.pg": "forcesafesearch.google.com",
-	"www.google.com.ph": "forcesafesearch.google.com",
-	"www.google.com.pk": "forcesafesearch.google.com",
-	"www.google.pl":     "forcesafesearch.google.com",
-	"www.google.pn":     "forcesafesearch.google.com",
-	"www.google.com.pr": "forcesafesearch.google.com",
-	"www.google.ps":     "forcesafesearch.google.com",
-	"www.google.pt":     "forcesafesearch.google.com",
-	"www.google.com.py": "forcesafesearch.google.com",
-	"www.google.com.qa": "forcesafesearch.google.com",
-	"www.google.ro":     "forcesafesearch.google.com",
-	"www.google.ru":     "forcesafesearch.google.com",
-	"www.google.rw":     "forcesafesearch.google.com",
-	"www.google.com.sa": "forcesafesearch.google.com",
-	"www.google.com.sb": "forcesafesearch.google.com",
-	"www.google.sc":     "forcesafesearch.google.com",
-	"www.google.se":     "forcesafesearch.google.com",
-	"www.google.com.sg": "forcesafesearch.google.com",
-	"www.google.sh":     "forcesafesearch.google.com",
-	"www.google.si":     "forcesafesearch.google.com",
-	"www.google.sk":     "forcesafesearch.google.com",
-	"www.google.com.sl": "forcesafesearch.google.com",
-	"www.google.sn":     "forcesafesearch.google.com",
-	"www.google.so":     "forcesafesearch.google.com",
-	"www.google.sm":     "forcesafesearch.google.com",
-	"www.google.sr":     "forcesafesearch.google.com",
-	"www.google.st":     "forcesafesearch.google.com",
-	"www.google.com.sv": "forcesafesearch.google.com",
-	"www.google.td":     "forcesafesearch.google.com",
-	"www.google.tg":     "forcesafesearch.google.com",
-	"www.google.co.th":  "forcesafesearch.google.com",
-	"www.google.com.tj": "forcesafesearch.google.com",
-	"www.google.tk":     "forcesafesearch.google.com",
-	"www.google.tl":     "forcesafesearch.google.com",
-	"www.google.tm":     "forcesafesearch.google.com",
-	"www.google.tn":     "forcesafesearch.google.com",
-	"www.google.to":     "forcesafesearch.google.com",
-	"www.google.com.tr": "forcesafesearch.google.com",
-	"www.google.tt":     "forcesafesearch.google.com",
-	"www.google.com.tw": "forcesafesearch.google.com",
-	"www.google.co.tz":  "forcesafesearch.google.com",
-	"www.google.com.ua": "forcesafesearch.google.com",
-	"www.google.co.ug":  "forcesafesearch.google.com",
-	"www.google.co.uk":  "forcesafesearch.google.com",
-	"www.google.com.uy": "forcesafesearch.google.com",
-	"www.google.co.uz":  "forcesafesearch.google.com",
-	"www.google.com.vc": "forcesafesearch.google.com",
-	"www.google.co.ve":  "forcesafesearch.google.com",
-	"www.google.vg":     "forcesafesearch.google.com",
-	"www.google.co.vi":  "forcesafesearch.google.com",
-	"www.google.com.vn": "forcesafesearch.google.com",
-	"www.google.vu":     "forcesafesearch.google.com",
-	"www.google.ws":     "forcesafesearch.google.com",
-	"www.google.rs":     "forcesafesearch.google.com",
-
-	"www.youtube.com":          "restrict.youtube.com",
-	"m.youtube.com":            "restrict.youtube.com",
-	"youtubei.googleapis.com":  "restrict.youtube.com",
-	"youtube.googleapis.com":   "restrict.youtube.com",
-	"www.youtube-nocookie.com": "restrict.youtube.com",
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// SafeSearchEngine is a search engine entry of the safesearch catalog
+// requests for its domains are answered with its safe search version instead
+type SafeSearchEngine struct {
+	Name    string   `json:"name"`
+	Enabled bool     `json:"enabled"` // whether it's enforced unless the settings say otherwise
+	Domains []string `json:"domains"` // host names, "*.example.org" matches all subdomains of example.org
+	CNAME   string   `json:"cname,omitempty"`
+	A       []string `json:"a,omitempty"`    // IPv4 addresses, they take priority over CNAME for A requests
+	AAAA    []string `json:"aaaa,omitempty"` // IPv6 addresses, they take priority over CNAME for AAAA requests
+}
+
+// SafeSearchTarget is what a safesearch domain is replaced with
+type SafeSearchTarget struct {
+	Engine string
+	CNAME  string // resolved with upstream if there are no addresses for the requested type
+	A      []net.IP
+	AAAA   []net.IP
+}
+
+// String returns the host name the domain is replaced with, or the addresses if there's no host name
+func (t SafeSearchTarget) String() string {
+	if len(t.CNAME) != 0 {
+		return t.CNAME
+	}
+	addrs := []string{}
+	for _, ip := range t.A {
+		addrs = append(addrs, ip.String())
+	}
+	for _, ip := range t.AAAA {
+		addrs = append(addrs, ip.String())
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// SafeSearchCatalog is the list of search engines that safesearch applies to
+type SafeSearchCatalog struct {
+	Engines []SafeSearchEngine `json:"engines"`
+
+	targets  []SafeSearchTarget // the same order as Engines
+	exact    map[string][]int   // host -> indexes of the engines, in catalog order
+	wildcard map[string][]int   // parent domain -> indexes of the engines
+}
+
+// NewSafeSearchCatalog checks the engines and indexes their domains
+func NewSafeSearchCatalog(engines []SafeSearchEngine) (*SafeSearchCatalog, error) {
+	c := &SafeSearchCatalog{
+		Engines:  engines,
+		exact:    map[string][]int{},
+		wildcard: map[string][]int{},
+	}
+	names := map[string]bool{}
+	for i, engine := range engines {
+		if len(engine.Name) == 0 {
+			return nil, fmt.Errorf("safesearch engine #%d has no name", i+1)
+		}
+		if strings.ContainsAny(engine.Name, " \t\r\n\"{}") {
+			return nil, fmt.Errorf("safesearch engine name %q contains invalid characters", engine.Name)
+		}
+		if names[engine.Name] {
+			return nil, fmt.Errorf("safesearch engine %s is specified more than once", engine.Name)
+		}
+		names[engine.Name] = true
+
+		target := SafeSearchTarget{Engine: engine.Name, CNAME: strings.TrimSuffix(engine.CNAME, ".")}
+		for _, addr := range engine.A {
+			ip := net.ParseIP(addr)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("safesearch engine %s: %s is not an IPv4 address", engine.Name, addr)
+			}
+			target.A = append(target.A, ip.To4())
+		}
+		for _, addr := range engine.AAAA {
+			ip := net.ParseIP(addr)
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("safesearch engine %s: %s is not an IPv6 address", engine.Name, addr)
+			}
+			target.AAAA = append(target.AAAA, ip)
+		}
+		if len(target.CNAME) == 0 && len(target.A) == 0 && len(target.AAAA) == 0 {
+			return nil, fmt.Errorf("safesearch engine %s has neither cname nor addresses", engine.Name)
+		}
+		c.targets = append(c.targets, target)
+
+		for _, domain := range engine.Domains {
+			domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+			if strings.HasPrefix(domain, "*.") {
+				c.wildcard[domain[2:]] = append(c.wildcard[domain[2:]], i)
+			} else if len(domain) != 0 {
+				c.exact[domain] = append(c.exact[domain], i)
+			}
+		}
+	}
+
+	first, second, conflict := c.Conflict(func(engine *SafeSearchEngine) bool {
+		return engine.Enabled
+	})
+	if conflict {
+		return nil, fmt.Errorf("safesearch engines %s and %s have the same domains and can't be enabled by default both", first, second)
+	}
+	return c, nil
+}
+
+// LoadSafeSearchCatalog reads the catalog from a JSON file, e.g.
+// {"engines": [{"name": "bing", "enabled": true, "domains": ["www.bing.com"], "cname": "strict.bing.com"}]}
+func LoadSafeSearchCatalog(path string) (*SafeSearchCatalog, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := SafeSearchCatalog{}
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %s", path, err)
+	}
+	return NewSafeSearchCatalog(data.Engines)
+}
+
+// DefaultSafeSearchCatalog returns the built-in catalog, it must not be modified
+func DefaultSafeSearchCatalog() *SafeSearchCatalog {
+	return defaultSafeSearchCatalog
+}
+
+// Find returns the target of the first engine that matches the host and is enabled
+// exact domains are checked first, then wildcards from the most specific one
+func (c *SafeSearchCatalog) Find(host string, enabled func(engine *SafeSearchEngine) bool) (SafeSearchTarget, bool) {
+	for _, i := range c.matching(host, true) {
+		if enabled(&c.Engines[i]) {
+			return c.targets[i], true
+		}
+	}
+	return SafeSearchTarget{}, false
+}
+
+// matching returns the indexes of the engines whose domains match the host, in the order Find checks them
+// if exact is false, the host is the parent domain of a wildcard and only the wildcards matching its subdomains are returned
+func (c *SafeSearchCatalog) matching(host string, exact bool) []int {
+	engines := []int{}
+	if exact {
+		engines = append(engines, c.exact[host]...)
+	} else {
+		engines = append(engines, c.wildcard[host]...)
+	}
+	parent := host
+	for {
+		pos := strings.IndexByte(parent, '.')
+		if pos < 0 {
+			break
+		}
+		parent = parent[pos+1:]
+		engines = append(engines, c.wildcard[parent]...)
+	}
+	return engines
+}
+
+// Conflict returns the names of two enabled engines whose domains overlap, only the first of them would be applied
+// an exact domain overlaps with the wildcards of its parent domains, e.g. www.youtube.com and *.youtube.com
+// e.g. youtube_strict and youtube_moderate are the modes of the same engine and only one of them can be enabled
+func (c *SafeSearchCatalog) Conflict(enabled func(engine *SafeSearchEngine) bool) (string, string, bool) {
+	check := func(engines []int) (string, string, bool) {
+		first := -1
+		for _, i := range engines {
+			if !enabled(&c.Engines[i]) {
+				continue
+			}
+			if first >= 0 && c.Engines[first].Name != c.Engines[i].Name {
+				return c.Engines[first].Name, c.Engines[i].Name, true
+			}
+			first = i
+		}
+		return "", "", false
+	}
+	for host := range c.exact {
+		if first, second, conflict := check(c.matching(host, true)); conflict {
+			return first, second, conflict
+		}
+	}
+	for domain := range c.wildcard {
+		if first, second, conflict := check(c.matching(domain, false)); conflict {
+			return first, second, conflict
+		}
+	}
+	return "", "", false
+}
+
+// SafeSearchEnabled returns the function telling if the engine is enabled by the settings, or by the catalog if the settings don't have it
+func SafeSearchEnabled(engines map[string]bool) func(engine *SafeSearchEngine) bool {
+	return func(engine *SafeSearchEngine) bool {
+		enabled, ok := engines[engine.Name]
+		if !ok {
+			return engine.Enabled
+		}
+		return enabled
+	}
+}
+
+var youtubeDomains = []string{
+	"www.youtube.com", "m.youtube.com", "youtubei.googleapis.com", "youtube.googleapis.com", "www.youtube-nocookie.com",
+}
+
+var defaultSafeSearchCatalog = mustSafeSearchCatalog([]SafeSearchEngine{
+	{
+		Name:    "google",
+		Enabled: true,
+		Domains: []string{
+			"www.google.com", "www.google.ad", "www.google.ae", "www.google.com.af", "www.google.com.ag", "www.google.com.ai",
+			"www.google.al", "www.google.am", "www.google.co.ao", "www.google.com.ar", "www.google.as", "www.google.at",
+			"www.google.com.au", "www.google.az", "www.google.ba", "www.google.com.bd", "www.google.be", "www.google.bf",
+			"www.google.bg", "www.google.com.bh", "www.google.bi", "www.google.bj", "www.google.com.bn", "www.google.com.bo",
+			"www.google.com.br", "www.google.bs", "www.google.bt", "www.google.co.bw", "www.google.by", "www.google.com.bz",
+			"www.google.ca", "www.google.cd", "www.google.cf", "www.google.cg", "www.google.ch", "www.google.ci",
+			"www.google.co.ck", "www.google.cl", "www.google.cm", "www.google.cn", "www.google.com.co", "www.google.co.cr",
+			"www.google.com.cu", "www.google.cv", "www.google.com.cy", "www.google.cz", "www.google.de", "www.google.dj",
+			"www.google.dk", "www.google.dm", "www.google.com.do", "www.google.dz", "www.google.com.ec", "www.google.ee",
+			"www.google.com.eg", "www.google.es", "www.google.com.et", "www.google.fi", "www.google.com.fj", "www.google.fm",
+			"www.google.fr", "www.google.ga", "www.google.ge", "www.google.gg", "www.google.com.gh", "www.google.com.gi",
+			"www.google.gl", "www.google.gm", "www.google.gp", "www.google.gr", "www.google.com.gt", "www.google.gy",
+			"www.google.com.hk", "www.google.hn", "www.google.hr", "www.google.ht", "www.google.hu", "www.google.co.id",
+			"www.google.ie", "www.google.co.il", "www.google.im", "www.google.co.in", "www.google.iq", "www.google.is",
+			"www.google.it", "www.google.je", "www.google.com.jm", "www.google.jo", "www.google.co.jp", "www.google.co.ke",
+			"www.google.com.kh", "www.google.ki", "www.google.kg", "www.google.co.kr", "www.google.com.kw", "www.google.kz",
+			"www.google.la", "www.google.com.lb", "www.google.li", "www.google.lk", "www.google.co.ls", "www.google.lt",
+			"www.google.lu", "www.google.lv", "www.google.com.ly", "www.google.co.ma", "www.google.md", "www.google.me",
+			"www.google.mg", "www.google.mk", "www.google.ml", "www.google.com.mm", "www.google.mn", "www.google.ms",
+			"www.google.com.mt", "www.google.mu", "www.google.mv", "www.google.mw", "www.google.com.mx", "www.google.com.my",
+			"www.google.co.mz", "www.google.com.na", "www.google.com.nf", "www.google.com.ng", "www.google.com.ni", "www.google.ne",
+			"www.google.nl", "www.google.no", "www.google.com.np", "www.google.nr", "www.google.nu", "www.google.co.nz",
+			"www.google.com.om", "www.google.com.pa", "www.google.com.pe", "www.google.com.pg", "www.google.com.ph", "www.google.com.pk",
+			"www.google.pl", "www.google.pn", "www.google.com.pr", "www.google.ps", "www.google.pt", "www.google.com.py",
+			"www.google.com.qa", "www.google.ro", "www.google.ru", "www.google.rw", "www.google.com.sa", "www.google.com.sb",
+			"www.google.sc", "www.google.se", "www.google.com.sg", "www.google.sh", "www.google.si", "www.google.sk",
+			"www.google.com.sl", "www.google.sn", "www.google.so", "www.google.sm", "www.google.sr", "www.google.st",
+			"www.google.com.sv", "www.google.td", "www.google.tg", "www.google.co.th", "www.google.com.tj", "www.google.tk",
+			"www.google.tl", "www.google.tm", "www.google.tn", "www.google.to", "www.google.com.tr", "www.google.tt",
+			"www.google.com.tw", "www.google.co.tz", "www.google.com.ua", "www.google.co.ug", "www.google.co.uk", "www.google.com.uy",
+			"www.google.co.uz", "www.google.com.vc", "www.google.co.ve", "www.google.vg", "www.google.co.vi", "www.google.com.vn",
+			"www.google.vu", "www.google.ws", "www.google.rs",
+		},
+		CNAME: "forcesafesearch.google.com",
+	},
+	{
+		Name:    "bing",
+		Enabled: true,
+		Domains: []string{"www.bing.com"},
+		CNAME:   "strict.bing.com",
+	},
+	{
+		Name:    "duckduckgo",
+		Enabled: true,
+		Domains: []string{"duckduckgo.com", "www.duckduckgo.com", "start.duckduckgo.com"},
+		CNAME:   "safe.duckduckgo.com",
+	},
+	{
+		Name:    "yandex",
+		Enabled: true,
+		Domains: []string{"yandex.com", "yandex.ru", "yandex.ua", "yandex.by", "yandex.kz"},
+		A:       []string{"213.180.193.56"},
+		AAAA:    []string{"2a02:6b8::feed:a11"},
+	},
+	{
+		Name:    "youtube_strict",
+		Enabled: true,
+		Domains: youtubeDomains,
+		CNAME:   "restrict.youtube.com",
+	},
+	{
+		Name:    "youtube_moderate",
+		Domains: youtubeDomains,
+		CNAME:   "restrictmoderate.youtube.com",
+	},
+	{
+		Name:    "pixabay",
+		Enabled: true,
+		Domains: []string{"pixabay.com"},
+		CNAME:   "safesearch.pixabay.com",
+	},
+})
+
+func mustSafeSearchCatalog(engines []SafeSearchEngine) *SafeSearchCatalog {
+	c, err := NewSafeSearchCatalog(engines)
+	if err != nil {
+		panic(err)
+	}
+	return c
 }
@@ -0,0 +1,112 @@
+package dnsfilter
+
+import (
+	"strings"
+)
+
+// maximum number of labels in a host name, see RFC 1035
+const maxLabels = 128
+
+// hostTrie stores hosts-syntax and ||example.org^ rules keyed by the host name labels in reverse order,
+// so that a host is matched against all of them in O(number of labels)
+type hostTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	exact    []*rule // rules matching this name only (hosts syntax), the last added one first
+	suffix   []*rule // rules matching this name and all of its subdomains
+}
+
+// returns the node for the specified name, creating it if necessary
+func (t *hostTrie) node(name string) *trieNode {
+	n := &t.root
+	for len(name) > 0 {
+		label := name
+		name = ""
+		if pos := strings.LastIndexByte(label, '.'); pos >= 0 {
+			label, name = label[pos+1:], label[:pos]
+		}
+		child, ok := n.children[label]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			n.children[label] = child
+		}
+		n = child
+	}
+	return n
+}
+
+// the hosts-syntax rule added later overrides the earlier ones of the same name
+func (t *hostTrie) addExact(name string, hostsRule *rule) {
+	n := t.node(name)
+	n.exact = append([]*rule{hostsRule}, n.exact...)
+}
+
+func (t *hostTrie) addSuffix(suffix string, rule *rule) {
+	n := t.node(suffix)
+	n.suffix = append(n.suffix, rule)
+}
+
+// walk calls onRule for the rules matching host: hosts-syntax rules first,
+// then suffix rules from the most specific to the least specific one, until onRule returns false
+func (t *hostTrie) walk(host string, onRule func(rule *rule) bool) {
+	var path [maxLabels + 1]*trieNode
+	depth := 0
+
+	n := &t.root
+	path[depth] = n
+	rest := host
+	for len(rest) > 0 && depth < maxLabels {
+		label := rest
+		rest = ""
+		if pos := strings.LastIndexByte(label, '.'); pos >= 0 {
+			label, rest = label[pos+1:], label[:pos]
+		}
+		child, ok := n.children[label]
+		if !ok {
+			n = nil
+			break
+		}
+		n = child
+		depth++
+		path[depth] = n
+	}
+
+	// exact rules exist only in the node of the whole host
+	if n != nil && len(rest) == 0 {
+		for _, rule := range n.exact {
+			if !onRule(rule) {
+				return
+			}
+		}
+	}
+
+	for i := depth; i > 0; i-- {
+		for _, rule := range path[i].suffix {
+			if !onRule(rule) {
+				return
+			}
+		}
+	}
+}
+
+// checks if the text can be a host name stored in the trie
+func isTrieHost(text string) bool {
+	if len(text) == 0 || text[0] == '.' || text[len(text)-1] == '.' {
+		return false
+	}
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return !strings.Contains(text, "..")
+}
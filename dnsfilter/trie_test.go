@@ -0,0 +1,165 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExtractSuffix(t *testing.T) {
+	tests := []struct {
+		text     string
+		isSuffix bool
+		suffix   string
+	}{
+		{"||example.org^", true, "example.org"},
+		{"||Example.ORG^", true, "example.org"},
+		{"||example.org|", true, "example.org"},
+		{"||my_host.example.org^", true, "my_host.example.org"},
+		{"||*.example.org^", false, ""},
+		{"||example..org^", false, ""},
+		{"||example.org^/path", false, ""},
+		{"|example.org^", false, ""},
+		{"example.org", false, ""},
+		{"/example.org/", false, ""},
+	}
+	for _, tc := range tests {
+		r := rule{text: tc.text}
+		isSuffix := r.extractSuffix()
+		if isSuffix != tc.isSuffix || r.suffix != tc.suffix {
+			t.Errorf("%s: expected %v %q, got %v %q", tc.text, tc.isSuffix, tc.suffix, isSuffix, r.suffix)
+		}
+	}
+}
+
+func TestSearchByName(t *testing.T) {
+	d := newTestFilter(t,
+		"||example.org^",
+		"||sub.example.org^$dnstype=AAAA",
+		"||kids.example.com^$client=192.168.1.10",
+		"1.1.1.1 exact.example.net",
+		"2.2.2.2 exact.example.net",
+	)
+
+	kids := ClientInfo{IP: net.ParseIP("192.168.1.10")}
+	other := ClientInfo{IP: net.ParseIP("192.168.1.20")}
+	tests := []struct {
+		host   string
+		qtype  uint16
+		client ClientInfo
+		rule   string
+	}{
+		{"example.org", dns.TypeA, other, "||example.org^"},
+		{"www.example.org", dns.TypeA, other, "||example.org^"},
+		{"notexample.org", dns.TypeA, other, ""},
+		{"org", dns.TypeA, other, ""},
+		{"sub.example.org", dns.TypeAAAA, other, "||sub.example.org^$dnstype=AAAA"},
+		{"www.sub.example.org", dns.TypeAAAA, other, "||sub.example.org^$dnstype=AAAA"},
+		{"sub.example.org", dns.TypeA, other, "||example.org^"},
+		{"kids.example.com", dns.TypeA, kids, "||kids.example.com^$client=192.168.1.10"},
+		{"kids.example.com", dns.TypeA, other, ""},
+		{"exact.example.net", dns.TypeA, other, "2.2.2.2 exact.example.net"}, // the later hosts rule wins
+		{"www.exact.example.net", dns.TypeA, other, ""},                      // hosts rules don't match subdomains
+	}
+	for _, tc := range tests {
+		res := d.blackList.searchByName(tc.host, tc.qtype, tc.client)
+		if res.Rule != tc.rule {
+			t.Errorf("%s %s for %s: expected rule %q, got %q", tc.host, dns.TypeToString[tc.qtype], tc.client.IP, tc.rule, res.Rule)
+		}
+	}
+}
+
+func TestMatchHostWhitelist(t *testing.T) {
+	d := newTestFilter(t,
+		"||example.org^",
+		"@@||www.example.org^",
+		"||ads.example.com^",
+		"@@||example.com^",
+		"||important.example.com^$important",
+	)
+
+	tests := []struct {
+		host   string
+		reason Reason
+	}{
+		{"example.org", FilteredBlackList},
+		{"www.example.org", NotFilteredWhiteList},
+		{"cdn.www.example.org", NotFilteredWhiteList},
+		{"ads.example.com", NotFilteredWhiteList}, // whitelist has priority over a more specific blacklist rule
+		{"important.example.com", FilteredBlackList},
+	}
+	for _, tc := range tests {
+		res, err := d.matchHost(tc.host, dns.TypeA, ClientInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Reason != tc.reason {
+			t.Errorf("%s: expected %s, got %s by %s", tc.host, tc.reason, res.Reason, res.Rule)
+		}
+	}
+}
+
+const benchmarkRulesCount = 50000
+
+// benchmarkHosts generates host names that look like the ones in blocklists
+func benchmarkHosts(r *rand.Rand, count int) []string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	tlds := []string{"com", "net", "org", "ru", "de", "co.uk", "info"}
+	hosts := make([]string, count)
+	for i := range hosts {
+		labels := 1 + r.Intn(3)
+		host := ""
+		for j := 0; j < labels; j++ {
+			label := make([]byte, 3+r.Intn(10))
+			for k := range label {
+				label[k] = letters[r.Intn(len(letters))]
+			}
+			host += string(label) + "."
+		}
+		hosts[i] = host + tlds[r.Intn(len(tlds))]
+	}
+	return hosts
+}
+
+// benchmarkMatchHost matches a mix of blocked hosts, their subdomains and unknown hosts against a large ||domain^ list
+func benchmarkMatchHost(b *testing.B, trie bool) {
+	enableTrieLookup = trie
+	defer func() { enableTrieLookup = true }()
+
+	r := rand.New(rand.NewSource(1))
+	blocked := benchmarkHosts(r, benchmarkRulesCount)
+	d := New()
+	for _, host := range blocked {
+		err := d.AddRule(fmt.Sprintf("||%s^", host), 1)
+		if err != nil && err != ErrAlreadyExists {
+			b.Fatal(err)
+		}
+	}
+
+	queries := benchmarkHosts(r, 1000)
+	for i := 0; i < len(queries); i += 3 {
+		queries[i] = blocked[r.Intn(len(blocked))]
+		if i+1 < len(queries) {
+			queries[i+1] = "sub." + blocked[r.Intn(len(blocked))]
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := d.matchHost(queries[i%len(queries)], dns.TypeA, ClientInfo{})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMatchHostTrie(b *testing.B) {
+	benchmarkMatchHost(b, true)
+}
+
+func BenchmarkMatchHostShortcuts(b *testing.B) {
+	benchmarkMatchHost(b, false)
+}
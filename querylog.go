@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+const queryLogHashKeySize = 32 // in bytes
+
+// checkQueryLogAnonymization validates the anonymization mode and generates the key of the hash mode if it's missing
+func checkQueryLogAnonymization(c *coreDNSConfig) error {
+	switch c.QueryLogAnonymize {
+	case "none", "truncate":
+		return nil
+	case "hash":
+		if len(c.QueryLogHashKey) != 0 {
+			return nil
+		}
+		key := make([]byte, queryLogHashKeySize)
+		_, err := rand.Read(key)
+		if err != nil {
+			return fmt.Errorf("couldn't generate query log anonymization key: %s", err)
+		}
+		// it's saved to the config so that the hashes of the same client stay the same after restarts
+		c.QueryLogHashKey = hex.EncodeToString(key)
+		return nil
+	default:
+		return fmt.Errorf("unknown querylog_anonymize_client_ip mode %q", c.QueryLogAnonymize)
+	}
+}
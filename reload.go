@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	corednsplugin "github.com/whitehat/whitehat/coredns_plugin"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	reloadDelay       = time.Millisecond * 500 // the reloads requested within it are done with one restart
+	reloadWaitTimeout = time.Second * 10       // how long the handlers wait for the reload before answering that it's pending
+	reloadHistorySize = 100                    // number of the finished reloads whose status can be requested
+)
+
+const (
+	reloadPending = "pending"
+	reloadOK      = "ok"
+	reloadFailed  = "failed"
+)
+
+type reloadStatus struct {
+	ID         uint64 `json:"id"`
+	Status     string `json:"status"` // pending, ok or failed
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolled_back,omitempty"` // the previous working config was restored after the failure
+}
+
+type reload struct {
+	status reloadStatus
+	done   chan struct{} // closed when the reload is finished
+}
+
+var reloads = struct {
+	sync.Mutex
+	lastID   uint64
+	all      map[uint64]*reload
+	finished []uint64 // oldest first, the oldest are forgotten
+	pending  []*reload
+	timer    *time.Timer
+}{all: map[uint64]*reload{}}
+
+var (
+	reloadRunLock     sync.Mutex // restarts run one at a time
+	lastWorkingConfig []byte     // YAML config of the running DNS server, it's restored if a restart fails
+
+	restartDNSServer = corednsplugin.Restart // replaced in tests
+)
+
+// requestReload schedules the restart of the DNS server with the configs on disk
+// the reloads requested in a burst are coalesced into one restart and they all get its status
+func requestReload() *reload {
+	reloads.Lock()
+	defer reloads.Unlock()
+	reloads.lastID++
+	r := &reload{
+		status: reloadStatus{ID: reloads.lastID, Status: reloadPending},
+		done:   make(chan struct{}),
+	}
+	reloads.all[r.status.ID] = r
+	reloads.pending = append(reloads.pending, r)
+	if reloads.timer == nil {
+		reloads.timer = time.AfterFunc(reloadDelay, runReload)
+	} else {
+		reloads.timer.Reset(reloadDelay)
+	}
+	return r
+}
+
+// waitReload returns the status of the reload once it's finished or after the timeout
+func waitReload(r *reload, timeout time.Duration) reloadStatus {
+	select {
+	case <-r.done:
+	case <-time.After(timeout):
+	}
+	reloads.Lock()
+	defer reloads.Unlock()
+	return r.status
+}
+
+func runReload() {
+	reloadRunLock.Lock()
+	defer reloadRunLock.Unlock()
+
+	reloads.Lock()
+	batch := reloads.pending
+	reloads.pending = nil
+	reloads.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	// the YAML config matches the Corefile that is about to be loaded
+	configFile := filepath.Join(config.ourBinaryDir, config.ourConfigFilename)
+	yamlText, readErr := ioutil.ReadFile(configFile)
+
+	status := reloadStatus{Status: reloadOK}
+	err := restartDNSServer()
+	switch {
+	case err == corednsplugin.ErrNotStarted:
+		// nothing to restart, the configs on disk are used when the server starts
+	case err != nil:
+		log.Printf("Couldn't reload the DNS server: %s", err)
+		status = reloadStatus{Status: reloadFailed, Error: err.Error()}
+		err = rollbackConfig()
+		if err != nil {
+			log.Printf("Couldn't restore the previous working config: %s", err)
+			status.Error = fmt.Sprintf("%s, and couldn't restore the previous working config: %s", status.Error, err)
+		} else {
+			log.Printf("Restored the previous working config")
+			status.RolledBack = true
+		}
+	case readErr != nil:
+		log.Printf("Couldn't read the config that was reloaded: %s", readErr)
+	default:
+		lastWorkingConfig = yamlText
+	}
+	finishReloads(batch, status)
+}
+
+func finishReloads(batch []*reload, status reloadStatus) {
+	reloads.Lock()
+	defer reloads.Unlock()
+	for _, r := range batch {
+		id := r.status.ID
+		r.status = status
+		r.status.ID = id
+		close(r.done)
+		reloads.finished = append(reloads.finished, id)
+	}
+	for len(reloads.finished) > reloadHistorySize {
+		delete(reloads.all, reloads.finished[0])
+		reloads.finished = reloads.finished[1:]
+	}
+}
+
+// rememberWorkingConfig saves the config the DNS server is started with, it's restored if a restart fails
+func rememberWorkingConfig() error {
+	yamlText, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	reloadRunLock.Lock()
+	lastWorkingConfig = yamlText
+	reloadRunLock.Unlock()
+	return nil
+}
+
+// rollbackConfig replaces the config with the last working one and writes it to disk
+// the running DNS server isn't touched, it's still using that config
+func rollbackConfig() error {
+	if lastWorkingConfig == nil {
+		return fmt.Errorf("there's no working config")
+	}
+
+	config.Lock()
+	previousFilters := map[int64]filter{}
+	for _, f := range config.Filters {
+		previousFilters[f.ID] = f
+	}
+	// yaml.Unmarshal merges maps into the existing ones instead of replacing them
+	config.CoreDNS.SafeSearchEngines = nil
+	config.CoreDNS.BlockingModes = nil
+	err := yaml.Unmarshal(lastWorkingConfig, &config)
+	if err == nil {
+		for i := range config.Filters {
+			filter := &config.Filters[i]
+			previous, ok := previousFilters[filter.ID]
+			if ok {
+				filter.RulesCount = previous.RulesCount
+				filter.contents = previous.contents
+				continue
+			}
+			// the filter was removed since
+			loadErr := filter.load()
+			if loadErr != nil {
+				log.Printf("Couldn't load filter %d contents due to %s", filter.ID, loadErr)
+			}
+		}
+	}
+	config.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeAllConfigs()
+}
+
+// respondWithReload requests a reload, waits for it and answers with its status
+// the body is written if the reload didn't fail, 202 is answered if it's still pending
+func respondWithReload(w http.ResponseWriter, body string) {
+	status := waitReload(requestReload(), reloadWaitTimeout)
+	w.Header().Set("X-Reload-ID", strconv.FormatUint(status.ID, 10))
+	w.Header().Set("X-Reload-Status", status.Status)
+	switch status.Status {
+	case reloadFailed:
+		if status.RolledBack {
+			httpError(w, http.StatusInternalServerError, "Couldn't reload the DNS server, the previous config is restored: %s", status.Error)
+		} else {
+			httpError(w, http.StatusInternalServerError, "Couldn't reload the DNS server: %s", status.Error)
+		}
+		return
+	case reloadPending:
+		w.WriteHeader(http.StatusAccepted)
+	}
+	_, err := fmt.Fprint(w, body)
+	if err != nil {
+		errorText := fmt.Sprintf("Couldn't write body: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+	}
+}
+
+// handleReloadStatus answers with the status of the reload with ?id=, the last one if it isn't set
+func handleReloadStatus(w http.ResponseWriter, r *http.Request) {
+	reloads.Lock()
+	id := reloads.lastID
+	reloads.Unlock()
+	if value := r.URL.Query().Get("id"); len(value) != 0 {
+		var err error
+		id, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "Invalid reload ID %q: %s", value, err)
+			return
+		}
+	}
+
+	reloads.Lock()
+	reload, ok := reloads.all[id]
+	var status reloadStatus
+	if ok {
+		status = reload.status
+	}
+	reloads.Unlock()
+	if !ok {
+		httpError(w, http.StatusNotFound, "There's no reload with ID %d", id)
+		return
+	}
+
+	jsonVal, err := json.Marshal(status)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal reload status json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, http.StatusInternalServerError)
+	}
+}
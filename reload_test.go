@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// setupTestReload makes the reloads use restart and write the configs to a temporary directory
+// until the returned function is called
+func setupTestReload(t *testing.T, restart func() error) func() {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedDir, savedPort := config.ourBinaryDir, config.BindPort
+	config.ourBinaryDir = dir
+	restartDNSServer = restart
+	return func() {
+		restartDNSServer = nil
+		lastWorkingConfig = nil
+		config.ourBinaryDir, config.BindPort = savedDir, savedPort
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReloadCoalesced(t *testing.T) {
+	var restarts int32
+	defer setupTestReload(t, func() error {
+		atomic.AddInt32(&restarts, 1)
+		return nil
+	})()
+
+	// the reloads requested in a burst are done with one restart and get their own IDs
+	burst := []*reload{requestReload(), requestReload(), requestReload()}
+	for i, r := range burst {
+		status := waitReload(r, 5*time.Second)
+		if status.Status != reloadOK {
+			t.Errorf("reload %d: expected %s, got %+v", i, reloadOK, status)
+		}
+		if i > 0 && status.ID != burst[i-1].status.ID+1 {
+			t.Errorf("reload %d: expected ID %d, got %d", i, burst[i-1].status.ID+1, status.ID)
+		}
+	}
+	if restarts != 1 {
+		t.Errorf("expected 1 restart, got %d", restarts)
+	}
+
+	// the status of a finished reload can be requested by its ID
+	id := burst[1].status.ID
+	w := httptest.NewRecorder()
+	handleReloadStatus(w, httptest.NewRequest(http.MethodGet, "/control/reload_status?id="+strconv.FormatUint(id, 10), nil))
+	status := reloadStatus{}
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil || w.Code != http.StatusOK || status.ID != id || status.Status != reloadOK {
+		t.Errorf("unexpected status of reload %d: %d %s", id, w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handleReloadStatus(w, httptest.NewRequest(http.MethodGet, "/control/reload_status?id="+strconv.FormatUint(id+100, 10), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown reload, got %d", w.Code)
+	}
+}
+
+func TestReloadRollback(t *testing.T) {
+	defer setupTestReload(t, func() error {
+		return errors.New("bad config")
+	})()
+
+	working, err := yaml.Marshal(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastWorkingConfig = working
+	workingPort := config.BindPort
+	config.BindPort = workingPort + 1
+
+	// the failed reload is reported and the previous working config is restored
+	status := waitReload(requestReload(), 5*time.Second)
+	if status.Status != reloadFailed || !status.RolledBack || status.Error != "bad config" {
+		t.Errorf("expected a rolled back failure, got %+v", status)
+	}
+	if config.BindPort != workingPort {
+		t.Errorf("expected the working port %d to be restored, got %d", workingPort, config.BindPort)
+	}
+
+	// without the working config the failure is reported as is
+	lastWorkingConfig = nil
+	status = waitReload(requestReload(), 5*time.Second)
+	if status.Status != reloadFailed || status.RolledBack {
+		t.Errorf("expected a failure without rollback, got %+v", status)
+	}
+}
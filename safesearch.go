@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+// Returns the full path of the safesearch catalog file, empty if the built-in one is used, config must be read-locked
+func getSafeSearchCatalogPath() string {
+	path := config.CoreDNS.SafeSearchCatalog
+	if len(path) != 0 && !filepath.IsAbs(path) {
+		path = filepath.Join(config.ourBinaryDir, path)
+	}
+	return path
+}
+
+// Returns the list of search engines that the DNS server uses, config must be read-locked
+func getSafeSearchCatalog() (*dnsfilter.SafeSearchCatalog, error) {
+	path := getSafeSearchCatalogPath()
+	if len(path) == 0 {
+		return dnsfilter.DefaultSafeSearchCatalog(), nil
+	}
+	return dnsfilter.LoadSafeSearchCatalog(path)
+}
+
+// ------------------
+// safesearch engines
+// ------------------
+
+type safeSearchEngineJSON struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleSafeSearchSettings shows the engines on GET and changes them on POST
+func handleSafeSearchSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleSafeSearchSettingsGet(w, r)
+	case "POST":
+		handleSafeSearchSettingsSet(w, r)
+	default:
+		http.Error(w, "This request must be GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+//noinspection GoUnusedParameter
+func handleSafeSearchSettingsGet(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	catalog, err := getSafeSearchCatalog()
+	if err != nil {
+		config.RUnlock()
+		httpError(w, http.StatusInternalServerError, "Couldn't load safesearch catalog: %s", err)
+		return
+	}
+	engines := []safeSearchEngineJSON{}
+	for _, engine := range catalog.Engines {
+		enabled, ok := config.CoreDNS.SafeSearchEngines[engine.Name]
+		if !ok {
+			enabled = engine.Enabled
+		}
+		engines = append(engines, safeSearchEngineJSON{Name: engine.Name, Enabled: enabled})
+	}
+	data := map[string]interface{}{
+		"enabled": config.CoreDNS.SafeSearchEnabled,
+		"catalog": config.CoreDNS.SafeSearchCatalog,
+		"engines": engines,
+	}
+	config.RUnlock()
+
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal safesearch settings json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+}
+
+// handleSafeSearchSettingsSet enables or disables the engines listed in the request, the others are left as they are
+func handleSafeSearchSettingsSet(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Enabled *bool                  `json:"enabled"`
+		Engines []safeSearchEngineJSON `json:"engines"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return
+	}
+
+	config.Lock()
+	catalog, err := getSafeSearchCatalog()
+	if err != nil {
+		config.Unlock()
+		httpError(w, http.StatusInternalServerError, "Couldn't load safesearch catalog: %s", err)
+		return
+	}
+	known := map[string]bool{}
+	for _, engine := range catalog.Engines {
+		known[engine.Name] = true
+	}
+	for _, engine := range req.Engines {
+		if !known[engine.Name] {
+			config.Unlock()
+			httpError(w, http.StatusBadRequest, "Unknown safesearch engine %s", engine.Name)
+			return
+		}
+	}
+
+	engines := map[string]bool{}
+	for name, enabled := range config.CoreDNS.SafeSearchEngines {
+		engines[name] = enabled
+	}
+	for _, engine := range req.Engines {
+		engines[engine.Name] = engine.Enabled
+	}
+	first, second, conflict := catalog.Conflict(dnsfilter.SafeSearchEnabled(engines))
+	if conflict {
+		config.Unlock()
+		httpError(w, http.StatusBadRequest, "Safesearch engines %s and %s can't be enabled at the same time", first, second)
+		return
+	}
+	config.CoreDNS.SafeSearchEngines = engines
+	if req.Enabled != nil {
+		config.CoreDNS.SafeSearchEnabled = *req.Enabled
+	}
+	config.Unlock()
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
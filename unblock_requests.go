@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	unblockRequestsFileName  = "unblock_requests.json" // in the data directory
+	maxUnblockRequests       = 1000                    // new requests are rejected when there are that many pending ones
+	maxClientUnblockRequests = 20                      // new requests of a client are rejected when it has that many pending ones
+	maxUnblockCommentLength  = 500
+)
+
+// unblockRequest is a request to unblock a host sent from the block page, it's kept until the admin reviews it
+type unblockRequest struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Client   string    `json:"client"`
+	Profile  string    `json:"profile,omitempty"` // the client profile the host is blocked by, empty for the global filters
+	Reason   string    `json:"reason"`
+	Rule     string    `json:"rule,omitempty"`
+	FilterID int64     `json:"filter_id,omitempty"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+var unblockRequests struct {
+	sync.Mutex
+	loaded   bool
+	requests []unblockRequest
+	nextID   int64
+}
+
+func getUnblockRequestsFilePath() string {
+	return filepath.Join(config.ourBinaryDir, config.ourDataDir, unblockRequestsFileName)
+}
+
+// loads the pending requests on the first use, unblockRequests must be locked
+func loadUnblockRequests() {
+	if unblockRequests.loaded {
+		return
+	}
+	unblockRequests.loaded = true
+	unblockRequests.nextID = 1
+
+	body, err := ioutil.ReadFile(getUnblockRequestsFilePath())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &unblockRequests.requests)
+	}
+	if err != nil {
+		log.Printf("Couldn't load unblock requests: %s", err)
+		return
+	}
+	for _, req := range unblockRequests.requests {
+		if req.ID >= unblockRequests.nextID {
+			unblockRequests.nextID = req.ID + 1
+		}
+	}
+}
+
+// saves the pending requests, unblockRequests must be locked
+func saveUnblockRequests() error {
+	body, err := json.Marshal(unblockRequests.requests)
+	if err != nil {
+		return err
+	}
+	path := getUnblockRequestsFilePath()
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileSafe(path, body)
+}
+
+// errClientUnblockRequests is returned by addUnblockRequest when the client has too many pending requests
+var errClientUnblockRequests = errors.New("too many pending unblock requests from this device")
+
+// addUnblockRequest records the request unless the same client already asked for the same host
+func addUnblockRequest(req unblockRequest) error {
+	unblockRequests.Lock()
+	defer unblockRequests.Unlock()
+	loadUnblockRequests()
+
+	clientRequests := 0
+	for _, pending := range unblockRequests.requests {
+		if pending.Client != req.Client {
+			continue
+		}
+		if pending.Host == req.Host {
+			return nil
+		}
+		clientRequests++
+	}
+	if clientRequests >= maxClientUnblockRequests {
+		return errClientUnblockRequests
+	}
+	if len(unblockRequests.requests) >= maxUnblockRequests {
+		return fmt.Errorf("too many pending unblock requests")
+	}
+	req.ID = unblockRequests.nextID
+	unblockRequests.nextID++
+	unblockRequests.requests = append(unblockRequests.requests, req)
+	return saveUnblockRequests()
+}
+
+// removeUnblockRequest removes the request and returns it, ok is false if there's no such request
+func removeUnblockRequest(id int64) (unblockRequest, bool, error) {
+	unblockRequests.Lock()
+	defer unblockRequests.Unlock()
+	loadUnblockRequests()
+
+	for i, req := range unblockRequests.requests {
+		if req.ID == id {
+			unblockRequests.requests = append(unblockRequests.requests[:i], unblockRequests.requests[i+1:]...)
+			return req, true, saveUnblockRequests()
+		}
+	}
+	return unblockRequest{}, false, nil
+}
+
+// unblockRequestsEnabled checks if the block page accepts unblock requests, config must be read-locked
+// they aren't accepted by the admin HTTP server, it serves the block page without the authentication
+func unblockRequestsEnabled() bool {
+	c := &config.BlockPage
+	return c.Enabled && c.UnblockRequests && len(c.BindHost) != 0
+}
+
+// handleUnblockRequestSubmit records the unblock request posted from the block page
+func handleUnblockRequestSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "This request must be POST", http.StatusMethodNotAllowed)
+		return
+	}
+	config.RLock()
+	enabled := unblockRequestsEnabled()
+	config.RUnlock()
+	if !enabled {
+		http.Error(w, "Unblock requests are disabled", http.StatusForbidden)
+		return
+	}
+
+	host := requestHost(r)
+	client := requestClientIP(r)
+	explanation, profile, err := explainBlockedHost(r, host)
+	if err != nil {
+		httpError(w, http.StatusServiceUnavailable, "Couldn't check %s: %s", host, err)
+		return
+	}
+	if explanation.Result.IsFiltered {
+		comment := strings.TrimSpace(r.PostFormValue("comment"))
+		if len(comment) > maxUnblockCommentLength {
+			comment = comment[:maxUnblockCommentLength]
+		}
+		err = addUnblockRequest(unblockRequest{
+			Time:     time.Now(),
+			Host:     host,
+			Client:   client,
+			Profile:  profile,
+			Reason:   explanation.Result.Reason.String(),
+			Rule:     explanation.Result.Rule,
+			FilterID: explanation.Result.FilterID,
+			Comment:  comment,
+		})
+		if err == errClientUnblockRequests {
+			httpError(w, http.StatusTooManyRequests, "Couldn't save the unblock request: %s", err)
+			return
+		}
+		if err != nil {
+			httpError(w, http.StatusServiceUnavailable, "Couldn't save the unblock request: %s", err)
+			return
+		}
+		log.Printf("Client %s asked to unblock %s", client, host)
+	}
+
+	// show the block page again, saying that the request was sent
+	http.Redirect(w, r, "/?requested=1", http.StatusSeeOther)
+}
+
+// ----------------
+// unblock requests
+// ----------------
+
+//noinspection GoUnusedParameter
+func handleUnblockRequestsList(w http.ResponseWriter, r *http.Request) {
+	unblockRequests.Lock()
+	loadUnblockRequests()
+	data := append([]unblockRequest{}, unblockRequests.requests...)
+	unblockRequests.Unlock()
+
+	jsonVal, err := json.Marshal(data)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to marshal unblock requests json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		errorText := fmt.Sprintf("Unable to write response json: %s", err)
+		log.Println(errorText)
+		http.Error(w, errorText, 500)
+		return
+	}
+}
+
+// approveUnblockRequest adds a whitelist rule for the host of the request to the rules of the client profile
+// the request came from, the user rules get it only if the host is blocked by the global filters
+// config must be locked
+func approveUnblockRequest(req unblockRequest) error {
+	rules := &config.UserRules
+	if len(req.Profile) != 0 {
+		index := findClientIndex(req.Profile)
+		if index < 0 {
+			return fmt.Errorf("client %s doesn't exist anymore", req.Profile)
+		}
+		rules = &config.Clients[index].Rules
+	}
+
+	rule := "@@||" + req.Host + "^"
+	for _, existing := range *rules {
+		if strings.TrimSpace(existing) == rule {
+			return nil
+		}
+	}
+	*rules = append(*rules, rule)
+	return nil
+}
+
+// handleUnblockRequestApprove removes the request and unblocks its host for the client profile it came from
+func handleUnblockRequestApprove(w http.ResponseWriter, r *http.Request) {
+	req, ok := removeUnblockRequestFromBody(w, r)
+	if !ok {
+		return
+	}
+
+	config.Lock()
+	err := approveUnblockRequest(req)
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Couldn't approve the unblock request: %s", err)
+		return
+	}
+	if len(req.Profile) != 0 {
+		log.Printf("Unblock request for %s is approved for client %s", req.Host, req.Profile)
+	} else {
+		log.Printf("Unblock request for %s is approved", req.Host)
+	}
+
+	httpUpdateConfigReloadDNSReturnOK(w, r)
+}
+
+// handleUnblockRequestDismiss removes the request without unblocking the host
+func handleUnblockRequestDismiss(w http.ResponseWriter, r *http.Request) {
+	_, ok := removeUnblockRequestFromBody(w, r)
+	if !ok {
+		return
+	}
+	returnOK(w, r)
+}
+
+// removes the request with the ID from the request body, replies with an error if it fails
+func removeUnblockRequestFromBody(w http.ResponseWriter, r *http.Request) (unblockRequest, bool) {
+	body := struct {
+		ID int64 `json:"id"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to parse request body json: %s", err)
+		return unblockRequest{}, false
+	}
+
+	req, ok, err := removeUnblockRequest(body.ID)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Couldn't save unblock requests: %s", err)
+		return unblockRequest{}, false
+	}
+	if !ok {
+		httpError(w, http.StatusBadRequest, "Unblock request %d not found", body.ID)
+		return unblockRequest{}, false
+	}
+	return req, true
+}
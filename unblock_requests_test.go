@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/whitehat/whitehat/dnsfilter"
+)
+
+var clientFilterLine = regexp.MustCompile(`client_filter "([^"]+)" (-?\d+) "([^"]+)"`)
+
+// loadClientDnsfilters returns the filters the DNS server would load for the client profiles
+func loadClientDnsfilters(t *testing.T) map[string]*dnsfilter.Dnsfilter {
+	err := writeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configText, err := generateCoreDNSConfigText()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filters := map[string]*dnsfilter.Dnsfilter{}
+	for i := range config.Clients {
+		filters[config.Clients[i].Name] = dnsfilter.New()
+	}
+	for _, match := range clientFilterLine.FindAllStringSubmatch(configText, -1) {
+		body, err := ioutil.ReadFile(match[3])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rule := range strings.Split(string(body), "\n") {
+			if len(rule) == 0 {
+				continue
+			}
+			err = filters[match[1]].AddRule(rule, 0)
+			if err != nil {
+				t.Fatalf("%s: %s", rule, err)
+			}
+		}
+	}
+	return filters
+}
+
+func TestApproveUnblockRequest(t *testing.T) {
+	defer setupTestReload(t, nil)()
+	savedFiltering, savedRules := config.CoreDNS.FilteringEnabled, config.UserRules
+	config.CoreDNS.FilteringEnabled = true
+	config.UserRules = []string{"||blocked.example.org^"}
+	config.Clients = []clientProfile{
+		{Name: "kids", IDs: []string{"192.168.1.10"}, FilterIDs: []int64{UserFilterId}},
+		{Name: "teens", IDs: []string{"192.168.1.20"}, FilterIDs: []int64{UserFilterId}},
+	}
+	defer func() {
+		config.CoreDNS.FilteringEnabled, config.UserRules = savedFiltering, savedRules
+		config.Clients = nil
+	}()
+
+	err := approveUnblockRequest(unblockRequest{Host: "blocked.example.org", Profile: "kids"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// approving it twice doesn't add the rule again
+	err = approveUnblockRequest(unblockRequest{Host: "blocked.example.org", Profile: "kids"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.UserRules) != 1 {
+		t.Errorf("expected the user rules to stay the same, got %v", config.UserRules)
+	}
+	if rules := config.Clients[0].Rules; len(rules) != 1 || rules[0] != "@@||blocked.example.org^" {
+		t.Errorf("expected the exception in the rules of kids, got %v", rules)
+	}
+
+	// the host is unblocked for the client that asked, the other profile still blocks it
+	filters := loadClientDnsfilters(t)
+	tests := []struct {
+		profile string
+		blocked bool
+	}{
+		{"kids", false},
+		{"teens", true},
+	}
+	for _, tc := range tests {
+		res, err := filters[tc.profile].CheckHost("blocked.example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.IsFiltered != tc.blocked {
+			t.Errorf("%s: expected blocked=%v, got %+v", tc.profile, tc.blocked, res)
+		}
+	}
+
+	// the requests blocked by the global filters are approved with a user rule
+	err = approveUnblockRequest(unblockRequest{Host: "other.example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.UserRules) != 2 || config.UserRules[1] != "@@||other.example.org^" {
+		t.Errorf("expected the exception in the user rules, got %v", config.UserRules)
+	}
+
+	err = approveUnblockRequest(unblockRequest{Host: "blocked.example.org", Profile: "adults"})
+	if err == nil {
+		t.Error("expected the request of a removed client to fail")
+	}
+}
+
+func TestUnblockRequestsAdminServer(t *testing.T) {
+	saved := config.BlockPage
+	defer func() {
+		config.BlockPage = saved
+	}()
+
+	// the admin HTTP server serves the block page without the authentication, it must not take the requests
+	config.BlockPage = blockPageConfig{Enabled: true, BindPort: 80, UnblockRequests: true}
+	err := checkBlockPageConfig(&config.BlockPage)
+	if err == nil {
+		t.Error("expected unblock requests without the separate listener to be rejected")
+	}
+	w := httptest.NewRecorder()
+	handleUnblockRequestSubmit(w, httptest.NewRequest(http.MethodPost, "http://blocked.example.org"+unblockRequestPath, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the request on the admin server to be forbidden, got %d", w.Code)
+	}
+
+	config.BlockPage.BindHost = "192.168.1.1"
+	err = checkBlockPageConfig(&config.BlockPage)
+	if err != nil {
+		t.Errorf("expected unblock requests on the separate listener to be accepted: %s", err)
+	}
+}
@@ -40,6 +40,17 @@ func NewDnsUpstream(endpoint string, proto string, tlsServerName string) (Upstre
 	return u, nil
 }
 
+// Address provides an implementation for the Upstream interface
+func (u *DnsUpstream) Address() string {
+	switch u.proto {
+	case "tcp":
+		return "tcp://" + u.endpoint
+	case "tcp-tls":
+		return "tls://" + u.endpoint
+	}
+	return u.endpoint
+}
+
 // Exchange provides an implementation for the Upstream interface
 func (u *DnsUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
 
@@ -62,6 +62,11 @@ func NewHttpsUpstream(endpoint string, bootstrap string) (Upstream, error) {
 	return &HttpsUpstream{client: client, endpoint: u}, nil
 }
 
+// Address provides an implementation for the Upstream interface
+func (u *HttpsUpstream) Address() string {
+	return u.endpoint.String()
+}
+
 // Exchange provides an implementation for the Upstream interface
 func (u *HttpsUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
 	queryBuf, err := query.Pack()
@@ -16,6 +16,7 @@ const (
 // Upstream is a simplified interface for proxy destination
 type Upstream interface {
 	Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+	Address() string // the upstream as it's written in the config
 	Close() error
 }
 
@@ -43,6 +44,7 @@ func (p *UpstreamPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *
 		upstream := p.Upstreams[i]
 		reply, backendErr = upstream.Exchange(ctx, r)
 		if backendErr == nil {
+			setServedBy(ctx, upstream.Address())
 			w.WriteMsg(reply)
 			return 0, nil
 		}
@@ -51,6 +53,21 @@ func (p *UpstreamPlugin) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *
 	return dns.RcodeServerFailure, errors.Wrap(backendErr, "failed to contact any of the upstreams")
 }
 
+type servedByKey struct{}
+
+// WithServedBy returns the context in which the upstream plugin records the address of the upstream
+// that answered the request, the address is empty if the request wasn't passed to any upstream
+func WithServedBy(ctx context.Context) (context.Context, *string) {
+	servedBy := new(string)
+	return context.WithValue(ctx, servedByKey{}, servedBy), servedBy
+}
+
+func setServedBy(ctx context.Context, address string) {
+	if servedBy, ok := ctx.Value(servedByKey{}).(*string); ok {
+		*servedBy = address
+	}
+}
+
 // Name implements interface for CoreDNS plugin
 func (p *UpstreamPlugin) Name() string {
 	return "upstream"